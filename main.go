@@ -22,6 +22,8 @@ import (
 	"github.com/raintank/worldping-api/pkg/middleware"
 	"github.com/raintank/worldping-api/pkg/services/endpointdiscovery"
 	"github.com/raintank/worldping-api/pkg/services/notifications"
+	"github.com/raintank/worldping-api/pkg/services/probealerting"
+	"github.com/raintank/worldping-api/pkg/services/probesessions"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
 	"github.com/raintank/worldping-api/pkg/setting"
 	jaegercfg "github.com/uber/jaeger-client-go/config"
@@ -70,6 +72,8 @@ func main() {
 	if err := notifications.Init(); err != nil {
 		log.Fatal(3, "Notification service failed to initialize", err)
 	}
+	probealerting.Init()
+	probesessions.Init()
 
 	if err := endpointdiscovery.InitEndpointDiscovery(); err != nil {
 		log.Fatal(3, "EndpointDiscovery service failed to initialize.", err)
@@ -119,8 +123,10 @@ func listenToSystemSignels(notifyShutdown chan struct{}) {
 	}
 	close(notifyShutdown)
 
-	publisher.Publisher.Close()
+	// probes keep sending results until they have reconnected elsewhere, so
+	// the publisher is closed last.
 	api.ShutdownController()
+	publisher.Publisher.Close()
 	log.Close()
 	os.Exit(code)
 }
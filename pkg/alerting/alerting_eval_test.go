@@ -145,3 +145,26 @@ func TestAlertingEval(t *testing.T) {
 		), ShouldEqual, m.EvalResultCrit)
 	})
 }
+
+func TestAlertingEvalDetails(t *testing.T) {
+	Convey("evalDetails should explain the outcome", t, func() {
+		res := graphite.Response([]graphite.Series{
+			getSeries([]int{1, 1, 1}),
+			getSeries([]int{0, 1, 1}),
+		})
+		res[0].Target = "worldping.test.probe1.http.error_state"
+		res[1].Target = "worldping.test.probe2.http.error_state"
+		details, err := evalDetails(res, 1, &m.CheckHealthSettings{NumProbes: 1, Steps: 3})
+		So(err, ShouldBeNil)
+		So(details.State, ShouldEqual, m.EvalResultCrit)
+		So(details.ProbesWithData, ShouldEqual, 2)
+		So(details.BadProbes, ShouldResemble, []string{"probe1"})
+		So(details.Probes, ShouldHaveLength, 2)
+		So(details.Probes[0].Bad, ShouldBeTrue)
+		So(details.Probes[0].MaxStreak, ShouldEqual, 3)
+		So(details.Probes[1].Bad, ShouldBeFalse)
+		So(details.Probes[1].CurrentStreak, ShouldEqual, 2)
+		So(details.Probes[1].Datapoints, ShouldHaveLength, 3)
+		So(*details.Probes[1].Datapoints[0].Value, ShouldEqual, 0)
+	})
+}
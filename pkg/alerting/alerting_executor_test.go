@@ -72,6 +72,7 @@ func TestExecutor(t *testing.T) {
 	}
 	graphite.DefaultClient.Transport = transport
 	setting.Alerting.Distributed = false
+	setting.Alerting.CatchUpLimit = time.Minute * 10
 	ResultQueue = make(chan *m.AlertingJob, 1000)
 
 	Convey("executor must do the right thing", t, func() {
@@ -1,6 +1,7 @@
 package alerting
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
@@ -8,97 +9,237 @@ import (
 	m "github.com/raintank/worldping-api/pkg/models"
 	"github.com/raintank/worldping-api/pkg/services/notifications"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	"github.com/raintank/worldping-api/pkg/setting"
 	"github.com/raintank/worldping-api/pkg/util"
 )
 
 var (
 	ResultQueue chan *m.AlertingJob
+
+	// useOutbox is set by InitResultHandler before any results are
+	// processed, after which results are persisted before being queued. The
+	// outbox is only used when emails can be sent.
+	useOutbox bool
+)
+
+const (
+	storeBatchSize     = 100
+	storeFlushInterval = time.Millisecond * 100
+	storeMaxBackoff    = time.Second * 30
+	// failed notifications are retried this many times before being left
+	// in the outbox until it is next replayed.
+	notificationAttempts = 5
 )
 
+// InitResultHandler starts processing results. The outbox is replayed before
+// it returns, so it must be called before any live results are produced.
 func InitResultHandler() {
 	ResultQueue = make(chan *m.AlertingJob, 1000)
+	useOutbox = setting.Smtp.Enabled
 
 	stateChanges := make(chan *m.AlertingJob, 1000)
 	for i := 0; i < 5; i++ {
 		go storeResults(stateChanges)
 	}
 	go handleStateChange(stateChanges)
+	if useOutbox {
+		replayOutbox(stateChanges)
+	}
+}
 
+// replayOutbox requeues the results that this instance had not finished
+// processing when it was last stopped, and those of other instances that have
+// not been processed within the claim age, as their instance may never
+// return.
+func replayOutbox(stateChanges chan *m.AlertingJob) {
+	claimed, err := sqlstore.ClaimAlertOutboxEntries(setting.InstanceId, time.Now().Add(-setting.Alerting.OutboxClaimAge))
+	if err != nil {
+		log.Error(3, "Alerting: failed to claim alert outbox entries of other instances. %s", err)
+	} else if claimed > 0 {
+		log.Info("Alerting: claimed %d alert outbox entries of other instances", claimed)
+	}
+	entries, err := sqlstore.GetAlertOutboxEntries(setting.InstanceId)
+	if err != nil {
+		log.Error(3, "Alerting: failed to load alert outbox. %s", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	log.Info("Alerting: replaying %d results from the alert outbox", len(entries))
+	for _, e := range entries {
+		if e.Job == nil || e.Job.CheckForAlertDTO == nil {
+			if err := sqlstore.DeleteAlertOutboxEntry(e.Id); err != nil {
+				log.Error(3, "Alerting: failed to remove invalid alert outbox entry %d. %s", e.Id, err)
+			}
+			continue
+		}
+		switch e.Status {
+		case m.AlertOutboxPendingState:
+			ResultQueue <- e.Job
+		case m.AlertOutboxPendingNotification:
+			stateChanges <- e.Job
+		}
+		executorOutboxReplayed.Inc()
+	}
 }
 
 func storeResults(stateChanges chan *m.AlertingJob) {
-	for j := range ResultQueue {
-		saved := false
-		attempts := 0
-		for !saved && attempts < 3 {
-			attempts++
-			pre := time.Now()
-			change, err := sqlstore.UpdateCheckState(j)
-			executorStateDBUpdate.Value(util.Since(pre))
-			if err != nil {
-				log.Warn("failed to update checkState for checkId=%d. %s", j.Id, err)
+	batch := make([]*m.AlertingJob, 0, storeBatchSize)
+	ticker := time.NewTicker(storeFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case j, ok := <-ResultQueue:
+			if !ok {
+				storeBatch(batch, stateChanges)
+				return
+			}
+			batch = append(batch, j)
+			if len(batch) < storeBatchSize {
 				continue
 			}
-			saved = true
-			log.Debug("updated state of checkId=%d stateChange=%v", j.Id, change)
-			if change {
-				stateChanges <- j
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		storeBatch(batch, stateChanges)
+		batch = make([]*m.AlertingJob, 0, storeBatchSize)
+	}
+}
+
+// storeBatch writes the state of a batch of jobs to the DB. As the jobs are
+// held in the outbox, failed writes are retried until they succeed rather than
+// being dropped.
+func storeBatch(batch []*m.AlertingJob, stateChanges chan *m.AlertingJob) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := time.Second
+	for {
+		pre := time.Now()
+		changes, err := sqlstore.BatchUpdateCheckState(batch)
+		executorStateDBUpdate.Value(util.Since(pre))
+		if err != nil {
+			executorStateDBRetries.Inc()
+			log.Warn("failed to update checkState for %d checks, retrying in %s. %s", len(batch), backoff, err)
+			time.Sleep(backoff)
+			if backoff < storeMaxBackoff {
+				backoff *= 2
 			}
+			continue
+		}
+		log.Debug("updated state of %d checks. %d state changes", len(batch), len(changes))
+		for _, j := range batch {
 			executorStateSaveDelay.Value(util.Since(j.TimeExec))
 		}
-		if !saved {
-			log.Error(3, "failed to update checkState for checkId=%d", j.Id)
+		for _, j := range changes {
+			stateChanges <- j
 		}
+		return
 	}
 }
 
 func ProcessResult(job *m.AlertingJob) {
+	if useOutbox {
+		if err := sqlstore.AddAlertOutboxEntry(setting.InstanceId, job); err != nil {
+			executorOutboxFailed.Inc()
+			log.Error(3, "failed to add result for checkId=%d to the alert outbox. %s", job.Id, err)
+		}
+	}
 	ResultQueue <- job
 }
 
+// completeOutboxEntry removes a job from the outbox once all of its
+// notifications have been handled.
+func completeOutboxEntry(job *m.AlertingJob) {
+	if job.OutboxId == 0 {
+		return
+	}
+	if err := sqlstore.DeleteAlertOutboxEntry(job.OutboxId); err != nil {
+		log.Error(3, "failed to remove checkId=%d from the alert outbox. %s", job.Id, err)
+	}
+}
+
 func handleStateChange(c chan *m.AlertingJob) {
 	for job := range c {
-		log.Debug("state change: orgId=%d, monitorId=%d, endpointSlug=%s, state=%s", job.OrgId, job.Id, job.Slug, job.NewState.String())
-		if job.HealthSettings.Notifications.Enabled {
-			emails := strings.Split(job.HealthSettings.Notifications.Addresses, ",")
-			if len(emails) < 1 {
-				log.Debug("no email addresses provided. OrgId: %d monitorId: %d", job.OrgId, job.Id)
-			} else {
-				emailTo := make([]string, 0)
-				for _, email := range emails {
-					email := strings.TrimSpace(email)
-					if email == "" {
-						continue
-					}
-					log.Info("sending email. addr=%s, orgId=%d, monitorId=%d, endpointSlug=%s, state=%s", email, job.OrgId, job.Id, job.Slug, job.NewState.String())
-					emailTo = append(emailTo, email)
-				}
-				if len(emailTo) == 0 {
-					continue
-				}
-				sendCmd := m.SendEmailCommand{
-					To:       emailTo,
-					Template: "alerting_notification.html",
-					Data: map[string]interface{}{
-						"EndpointId":   job.EndpointId,
-						"EndpointName": job.Name,
-						"EndpointSlug": job.Slug,
-						"Settings":     job.Settings,
-						"CheckType":    job.Type,
-						"State":        job.NewState.String(),
-						"TimeLastData": job.LastPointTs, // timestamp of the most recent data used
-						"TimeExec":     job.TimeExec,    // when we executed the alerting rule and made the determination
-					},
-				}
-				go func(sendCmd *m.SendEmailCommand, job *m.AlertingJob) {
-					if err := notifications.SendEmail(sendCmd); err != nil {
-						log.Error(3, "failed to send email to %s. OrgId: %d monitorId: %d due to: %s", sendCmd.To, job.OrgId, job.Id, err)
-						executorEmailFailed.Inc()
-					} else {
-						executorEmailSent.Inc()
-					}
-				}(&sendCmd, job)
-			}
+		sendCmd := notificationEmail(job)
+		if sendCmd == nil {
+			completeOutboxEntry(job)
+			continue
+		}
+		go sendNotification(sendCmd, job)
+	}
+}
+
+// sendNotification sends the email for a state change. The outbox entry of
+// the job is only removed once the SMTP server has accepted the email, so
+// notifications are sent at least once. If the process stops after sending
+// but before the entry is removed, the email is sent again on replay.
+func sendNotification(sendCmd *m.SendEmailCommand, job *m.AlertingJob) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := notifications.SendEmailSync(sendCmd)
+		if err == nil {
+			executorEmailSent.Inc()
+			completeOutboxEntry(job)
+			return
 		}
+		executorEmailFailed.Inc()
+		if attempt >= notificationAttempts {
+			log.Error(3, "failed to send email to %s. OrgId: %d monitorId: %d due to: %s. It will be retried when the alert outbox is replayed.", sendCmd.To, job.OrgId, job.Id, err)
+			return
+		}
+		log.Warn("failed to send email to %s. OrgId: %d monitorId: %d, retrying in %s. %s", sendCmd.To, job.OrgId, job.Id, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// notificationEmail builds the email to send for a state change of a job, or
+// returns nil if no notification should be sent.
+func notificationEmail(job *m.AlertingJob) *m.SendEmailCommand {
+	failingProbes := job.NewProbeState.Failing()
+	log.Debug("state change: orgId=%d, monitorId=%d, endpointSlug=%s, state=%s, failingProbes=%v", job.OrgId, job.Id, job.Slug, job.NewState.String(), failingProbes)
+	if !job.HealthSettings.Notifications.Enabled {
+		return nil
+	}
+	if !setting.Smtp.Enabled {
+		log.Debug("smtp is disabled, not sending notification. OrgId: %d monitorId: %d", job.OrgId, job.Id)
+		return nil
+	}
+	emails := strings.Split(job.HealthSettings.Notifications.Addresses, ",")
+	if len(emails) < 1 {
+		log.Debug("no email addresses provided. OrgId: %d monitorId: %d", job.OrgId, job.Id)
+		return nil
+	}
+	emailTo := make([]string, 0)
+	for _, email := range emails {
+		email := strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		log.Info("sending email. addr=%s, orgId=%d, monitorId=%d, endpointSlug=%s, state=%s", email, job.OrgId, job.Id, job.Slug, job.NewState.String())
+		emailTo = append(emailTo, email)
+	}
+	if len(emailTo) == 0 {
+		return nil
+	}
+	return &m.SendEmailCommand{
+		To:        emailTo,
+		Template:  "alerting_notification.html",
+		MessageId: fmt.Sprintf("worldping.alert.%d.%d", job.Id, job.TimeExec.UnixNano()),
+		Data: map[string]interface{}{
+			"EndpointId":    job.EndpointId,
+			"EndpointName":  job.Name,
+			"EndpointSlug":  job.Slug,
+			"Settings":      job.Settings,
+			"CheckType":     job.Type,
+			"State":         job.NewState.String(),
+			"FailingProbes": failingProbes,
+			"TimeLastData":  job.LastPointTs, // timestamp of the most recent data used
+			"TimeExec":      job.TimeExec,    // when we executed the alerting rule and made the determination
+		},
 	}
 }
@@ -41,7 +41,7 @@ func ChanExecutor(jobQueue <-chan *m.AlertingJob, cache *lru.Cache) {
 func execute(job *m.AlertingJob, cache *lru.Cache) {
 	key := fmt.Sprintf("%d-%d", job.Id, job.LastPointTs.Unix())
 
-	if time.Now().Sub(job.GeneratedAt) > time.Minute*time.Duration(10) {
+	if time.Now().Sub(job.GeneratedAt) > setting.Alerting.CatchUpLimit {
 		executorNumTooOld.Inc()
 		return
 	}
@@ -56,44 +56,27 @@ func execute(job *m.AlertingJob, cache *lru.Cache) {
 
 	preExec := time.Now()
 	executorJobExecDelay.Value(util.Since(job.LastPointTs))
-	tracer := opentracing.GlobalTracer()
-	span := tracer.StartSpan("queryGraphite")
-	ext.SpanKindRPCClient.Set(span)
-	ext.PeerService.Set(span, "graphite")
-	headers := make(http.Header)
-	headers.Add("x-org-id", fmt.Sprintf("%d", job.OrgId))
-	carrier := opentracing.HTTPHeadersCarrier(headers)
-	err := tracer.Inject(span.Context(), opentracing.HTTPHeaders, carrier)
-	if err != nil {
-		log.Error(3, "Alerting: failed to inject span into headers of graphite request: %s", err.Error())
-	}
-	start := job.LastPointTs.Add(time.Duration(int64(-1)*job.Frequency*int64(job.HealthSettings.Steps)) * time.Second)
-	req := graphite.Request{
-		Start:   &start,
-		End:     &job.LastPointTs,
-		Targets: []string{fmt.Sprintf("worldping.%s.*.%s.error_state", job.Slug, strings.ToLower(job.CheckForAlertDTO.Type))},
-	}
-	log.Debug("Alerting: querying graphite with /render?target=%s&from=%d&until=%d", req.Targets[0], req.Start.Unix(), req.End.Unix())
-	res, err := req.Query(setting.Alerting.GraphiteUrl+"render", headers)
+	res, err := queryGraphite(job.CheckForAlertDTO, job.HealthSettings, job.LastPointTs)
 	executorJobQueryGraphite.Value(util.Since(preExec))
 	log.Debug("Alerting: job results - job:%v err:%v res:%v", job, err, res)
-	span.Finish()
 	if err != nil {
 		executorAlertOutcomesErr.Inc()
 		log.Error(3, "Alerting: query failed for job %q : %s", job, err.Error())
 		return
 	}
 
-	newState, err := eval(res, job.Id, job.HealthSettings)
+	details, err := evalDetails(res, job.Id, job.HealthSettings)
 	if err != nil {
 		executorAlertOutcomesErr.Inc()
 		return
 	}
+	newState := details.State
 	job.NewState = newState
+	job.NewProbeState = details.ProbeState()
 	job.TimeExec = preExec
 
 	// lets only update the stateCheck value every second check, which will half the load we place on the DB.
-	if job.State != job.NewState || job.TimeExec.Sub(job.StateCheck) > (time.Second*time.Duration(job.Frequency*2)) {
+	if job.State != job.NewState || !job.ProbeState.Equal(job.NewProbeState) || job.TimeExec.Sub(job.StateCheck) > (time.Second*time.Duration(job.Frequency*2)) {
 		ProcessResult(job)
 	}
 
@@ -110,28 +93,107 @@ func execute(job *m.AlertingJob, cache *lru.Cache) {
 	}
 }
 
+// queryGraphite fetches the error_state series of every probe for the window
+// of healthSettings.Steps points that ends at lastPointTs.
+func queryGraphite(check *m.CheckForAlertDTO, healthSettings *m.CheckHealthSettings, lastPointTs time.Time) (graphite.Response, error) {
+	tracer := opentracing.GlobalTracer()
+	span := tracer.StartSpan("queryGraphite")
+	defer span.Finish()
+	ext.SpanKindRPCClient.Set(span)
+	ext.PeerService.Set(span, "graphite")
+	headers := make(http.Header)
+	headers.Add("x-org-id", fmt.Sprintf("%d", check.OrgId))
+	carrier := opentracing.HTTPHeadersCarrier(headers)
+	err := tracer.Inject(span.Context(), opentracing.HTTPHeaders, carrier)
+	if err != nil {
+		log.Error(3, "Alerting: failed to inject span into headers of graphite request: %s", err.Error())
+	}
+	req := graphiteRequest(check, healthSettings, lastPointTs)
+	log.Debug("Alerting: querying graphite with /render?target=%s&from=%d&until=%d", req.Targets[0], req.Start.Unix(), req.End.Unix())
+	return req.Query(setting.Alerting.GraphiteUrl+"render", headers)
+}
+
+func graphiteRequest(check *m.CheckForAlertDTO, healthSettings *m.CheckHealthSettings, lastPointTs time.Time) graphite.Request {
+	start := lastPointTs.Add(time.Duration(int64(-1)*check.Frequency*int64(healthSettings.Steps)) * time.Second)
+	end := lastPointTs
+	return graphite.Request{
+		Start:   &start,
+		End:     &end,
+		Targets: []string{fmt.Sprintf("worldping.%s.*.%s.error_state", check.Slug, strings.ToLower(check.Type))},
+	}
+}
+
+// Evaluate runs the alerting rule for a check against the data ending at
+// lastPointTs and explains how the resulting state was reached. Nothing is
+// persisted or published.
+func Evaluate(check *m.CheckForAlertDTO, healthSettings *m.CheckHealthSettings, lastPointTs time.Time) (*m.CheckEvaluation, error) {
+	req := graphiteRequest(check, healthSettings, lastPointTs)
+	evaluation := &m.CheckEvaluation{
+		CheckId:        check.Id,
+		Query:          req.Targets[0],
+		Start:          *req.Start,
+		End:            *req.End,
+		HealthSettings: healthSettings,
+	}
+	res, err := queryGraphite(check, healthSettings, lastPointTs)
+	if err != nil {
+		return nil, err
+	}
+	details, err := evalDetails(res, check.Id, healthSettings)
+	if err != nil && err != ErrNoData {
+		return nil, err
+	}
+	evaluation.Probes = details.Probes
+	evaluation.BadProbes = details.BadProbes
+	evaluation.ProbesWithData = details.ProbesWithData
+	evaluation.State = details.State
+	return evaluation, nil
+}
+
 func eval(res graphite.Response, checkId int64, healthSettings *m.CheckHealthSettings) (m.CheckEvalResult, error) {
+	details, err := evalDetails(res, checkId, healthSettings)
+	return details.State, err
+}
+
+// evalDetails applies the health settings to the error_state series of each
+// probe, recording the streaks that were found along with the resulting state.
+func evalDetails(res graphite.Response, checkId int64, healthSettings *m.CheckHealthSettings) (*m.CheckEvalDetails, error) {
+	details := &m.CheckEvalDetails{
+		State:     m.EvalResultUnknown,
+		Probes:    make([]m.ProbeEvalResult, 0, len(res)),
+		BadProbes: make([]string, 0),
+	}
 	if len(res) == 0 {
 		executorGraphiteEmptyResponse.Inc()
 		log.Debug("Alerting: no data returned for job checkId=%d", checkId)
-		return m.EvalResultUnknown, ErrNoData
+		return details, ErrNoData
 	}
-	badEndpoints := 0
-	endpointsWithData := 0
 	for _, ep := range res {
+		probe := m.ProbeEvalResult{
+			Probe:      probeFromTarget(ep.Target),
+			Target:     ep.Target,
+			Datapoints: make([]m.EvalDatapoint, 0, len(ep.Datapoints)),
+		}
 		curStreak := 0
 		maxStreak := 0
-		nonNullPoints := 0
 		for _, dp := range ep.Datapoints {
+			point := m.EvalDatapoint{}
+			if ts, err := dp[1].Int64(); err == nil {
+				point.Ts = ts
+			}
 			if dp[0].String() == "null" || dp[0].String() == "" {
+				probe.Datapoints = append(probe.Datapoints, point)
 				continue
 			}
-			nonNullPoints++
+			probe.NonNullPoints++
 			val, err := dp[0].Float64()
 			if err != nil {
 				log.Error(3, "Alerting: failed to parse graphite response. value %s=[%s, %s] not a number. %s", ep.Target, dp[0].String(), dp[1].String(), err.Error())
-				return m.EvalResultUnknown, err
+				details.State = m.EvalResultUnknown
+				return details, err
 			}
+			point.Value = &val
+			probe.Datapoints = append(probe.Datapoints, point)
 			if val > 0.0 {
 				curStreak++
 			} else {
@@ -141,27 +203,42 @@ func eval(res graphite.Response, checkId int64, healthSettings *m.CheckHealthSet
 				curStreak = 0
 			}
 		}
-		if nonNullPoints > 0 {
-			endpointsWithData++
+		if probe.NonNullPoints > 0 {
+			details.ProbesWithData++
 		}
+		probe.CurrentStreak = curStreak
 		if curStreak > maxStreak {
 			maxStreak = curStreak
 		}
+		probe.MaxStreak = maxStreak
 
 		if maxStreak >= healthSettings.Steps {
-			badEndpoints++
+			probe.Bad = true
+			details.BadProbes = append(details.BadProbes, probe.Probe)
 		}
+		details.Probes = append(details.Probes, probe)
 	}
 
-	if endpointsWithData == 0 {
-		return m.EvalResultUnknown, nil
+	switch {
+	case details.ProbesWithData == 0:
+		details.State = m.EvalResultUnknown
+	case len(details.BadProbes) >= healthSettings.NumProbes:
+		details.State = m.EvalResultCrit
+	default:
+		details.State = m.EvalResultOK
 	}
 
-	if badEndpoints >= healthSettings.NumProbes {
-		return m.EvalResultCrit, nil
-	}
+	return details, nil
+}
 
-	return m.EvalResultOK, nil
+// probeFromTarget extracts the probe slug from a
+// worldping.<endpoint>.<probe>.<type>.error_state series name.
+func probeFromTarget(target string) string {
+	parts := strings.Split(target, ".")
+	if len(parts) < 3 {
+		return target
+	}
+	return parts[len(parts)-3]
 }
 
 func StoreResult(job *m.AlertingJob) {
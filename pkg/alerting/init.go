@@ -20,6 +20,9 @@ var (
 	dispatcherGetSchedules    = stats.NewMeter32("alert-dispatcher.get-schedules", true)
 	dispatcherNumGetSchedules = stats.NewCounterRate32("alert-dispatcher.num-getschedules")
 	dispatcherJobsScheduled   = stats.NewCounterRate32("alert-dispatcher.jobs-scheduled")
+	dispatcherLag             = stats.NewGauge32("alert-dispatcher.lag")
+	dispatcherSlotsSkipped    = stats.NewCounterRate32("alert-dispatcher.slots-skipped")
+	dispatcherJobsCoalesced   = stats.NewCounterRate32("alert-dispatcher.jobs-coalesced")
 
 	executorNum = stats.NewGauge32("alert-executor.num")
 
@@ -41,6 +44,10 @@ var (
 	executorEmailSent   = stats.NewCounterRate32("alert-executor.emails.sent")
 	executorEmailFailed = stats.NewCounterRate32("alert-executor.emails.failed")
 
+	executorStateDBRetries = stats.NewCounterRate32("alert-executor.state_db_retries")
+	executorOutboxFailed   = stats.NewCounterRate32("alert-executor.outbox.failed")
+	executorOutboxReplayed = stats.NewCounterRate32("alert-executor.outbox.replayed")
+
 	metricsPublisher services.MetricsPublisher
 )
 
@@ -64,6 +71,10 @@ func Construct() {
 		log.Fatal(3, "Alerting requires a scheduler or a worker (enable_scheduler = true or enable_worker = true)")
 	}
 
+	// the result handler replays the outbox before any new results are
+	// produced by the executor.
+	InitResultHandler()
+
 	jobQ := jobqueue.NewJobQueue()
 
 	// create jobs
@@ -77,6 +88,4 @@ func Construct() {
 		log.Info("Alerting: starting alert executor")
 		go ChanExecutor(jobQ.Jobs(), cache)
 	}
-
-	InitResultHandler()
 }
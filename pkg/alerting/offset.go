@@ -8,22 +8,47 @@ import (
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
 )
 
+const defaultOffset = 30
+
 func LoadOrSetOffset() int {
-	offset, err := sqlstore.GetAlertSchedulerValue("offset")
+	offset, ok, err := readOffset()
 	if err != nil {
 		log.Error(3, "failure querying for current offset: %q", err)
-		return 30
+		return defaultOffset
+	}
+	if !ok {
+		log.Debug("initializing offset to default value of %d seconds.", defaultOffset)
+		setOffset(defaultOffset)
+	}
+	return offset
+}
+
+// LoadOffset returns the persisted offset, or the default offset if it has
+// never been stored. Unlike LoadOrSetOffset it does not store the default.
+func LoadOffset() int {
+	offset, _, err := readOffset()
+	if err != nil {
+		log.Error(3, "failure querying for current offset: %q", err)
+		return defaultOffset
+	}
+	return offset
+}
+
+// readOffset returns the persisted offset. ok is false if it has never been
+// stored, in which case the default offset is returned.
+func readOffset() (int, bool, error) {
+	offset, err := sqlstore.GetAlertSchedulerValue("offset")
+	if err != nil {
+		return defaultOffset, false, err
 	}
 	if offset == "" {
-		log.Debug("initializing offset to default value of 30 seconds.")
-		setOffset(30)
-		return 30
+		return defaultOffset, false, nil
 	}
 	i, err := strconv.Atoi(offset)
 	if err != nil {
 		panic(fmt.Sprintf("failure reading in offset: %q. input value was: %q", err, offset))
 	}
-	return i
+	return i, true, nil
 }
 
 func setOffset(offset int) {
@@ -32,3 +57,29 @@ func setOffset(offset int) {
 		log.Error(3, "Could not persist offset: %q", err)
 	}
 }
+
+// LoadPosition returns the last persisted slot of the scheduler, or 0 if it
+// has never been stored.
+func LoadPosition() int64 {
+	position, err := sqlstore.GetAlertSchedulerValue("position")
+	if err != nil {
+		log.Error(3, "failure querying for scheduler position: %q", err)
+		return 0
+	}
+	if position == "" {
+		return 0
+	}
+	i, err := strconv.ParseInt(position, 10, 64)
+	if err != nil {
+		log.Error(3, "failure reading in scheduler position: %q. input value was: %q", err, position)
+		return 0
+	}
+	return i
+}
+
+func setPosition(position int64) {
+	err := sqlstore.UpdateAlertSchedulerValue("position", fmt.Sprintf("%d", position))
+	if err != nil {
+		log.Error(3, "Could not persist scheduler position: %q", err)
+	}
+}
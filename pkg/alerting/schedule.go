@@ -1,15 +1,20 @@
 package alerting
 
 import (
+	"sync"
 	"time"
 
 	"github.com/raintank/worldping-api/pkg/alerting/jobqueue"
 	"github.com/raintank/worldping-api/pkg/log"
 	m "github.com/raintank/worldping-api/pkg/models"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	"github.com/raintank/worldping-api/pkg/setting"
 	"github.com/raintank/worldping-api/pkg/util"
 )
 
+// the position of the scheduler is persisted at most this often.
+const positionPersistInterval = time.Second * 5
+
 // getJobs retrieves all jobs for which lastPointAt % their freq == their offset.
 func getJobs(lastPointAt int64) ([]*m.AlertingJob, error) {
 	checks, err := sqlstore.GetChecksForAlerts(lastPointAt)
@@ -38,29 +43,29 @@ func dispatchJobs(jobQ *jobqueue.JobQueue) {
 	newOffsetChan := make(chan int)
 	offset := LoadOrSetOffset()
 	log.Info("Alerting using offset %d", offset)
-	next := time.Now().Unix() - int64(offset)
+	next := LoadPosition()
+	if next == 0 {
+		next = time.Now().Unix() - int64(offset)
+	}
+	log.Info("Alerting scheduler resuming at %d using catchup_mode=%s", next, setting.Alerting.CatchUpMode)
+	scheduler.start(offset, next)
+	positions := make(chan int64, 1)
+	go persistPositions(positions)
 	for {
 		select {
 		case lastPointAt := <-ticker.C:
-			for next <= lastPointAt.Unix()-int64(offset) {
-				pre := time.Now()
-				jobs, err := getJobs(next)
-				next++
-				dispatcherNumGetSchedules.Inc()
-				dispatcherGetSchedules.Value(util.Since(pre))
-
-				if err != nil {
-					log.Error(0, "Alerting failed to get jobs from DB: %q", err)
-					continue
-				}
-				log.Debug("%d jobs found for TS: %d", len(jobs), next)
-				for _, job := range jobs {
-					job.GeneratedAt = time.Now()
-					job.LastPointTs = time.Unix(next-1, 0)
-					jobQ.QueueJob(job)
-					dispatcherJobsScheduled.Inc()
-				}
+			now := lastPointAt.Unix() - int64(offset)
+			lag := now - next
+			if lag < 0 {
+				lag = 0
 			}
+			dispatcherLag.Set(int(lag))
+			dispatched := catchUp(jobQ, next, now)
+			if dispatched != next {
+				next = dispatched
+				offerPosition(positions, next)
+			}
+			scheduler.setPosition(next)
 		case <-offsetTicker.C:
 			// run this in a separate goroutine so we dont block the scheduler.
 			go func() {
@@ -70,8 +75,186 @@ func dispatchJobs(jobQ *jobqueue.JobQueue) {
 				}
 			}()
 		case newOffset := <-newOffsetChan:
-			log.Info("Alerting offset updated to %d", offset)
+			log.Info("Alerting offset updated to %d", newOffset)
 			offset = newOffset
+			scheduler.setOffset(offset)
+		}
+	}
+}
+
+// catchUp dispatches the jobs for all slots from next up to and including now,
+// honouring the configured catchup_mode. It returns the next slot to dispatch.
+func catchUp(jobQ *jobqueue.JobQueue, next, now int64) int64 {
+	if next > now {
+		return next
+	}
+
+	switch setting.Alerting.CatchUpMode {
+	case setting.CatchUpModeSkip:
+		// slots are only skipped once the scheduler is clearly behind, not
+		// when a tick is late.
+		if now-next > int64(setting.Alerting.SkipThreshold/time.Second) {
+			log.Debug("Alerting: skipping %d missed slots", now-next)
+			dispatcherSlotsSkipped.Add(int(now - next))
+			next = now
+		}
+	default:
+		oldest := now - int64(setting.Alerting.CatchUpLimit/time.Second)
+		if next < oldest {
+			log.Warn("Alerting: scheduler is %ds behind, skipping slots older than %s", now-next, setting.Alerting.CatchUpLimit)
+			dispatcherSlotsSkipped.Add(int(oldest - next))
+			next = oldest
+		}
+	}
+
+	if setting.Alerting.CatchUpMode == setting.CatchUpModeLatest && next < now {
+		// only evaluate each check against the most recent slot that it was due in.
+		latest := make(map[int64]*m.AlertingJob)
+		for ; next <= now; next++ {
+			jobs, err := getSlotJobs(next)
+			if err != nil {
+				continue
+			}
+			for _, job := range jobs {
+				if _, ok := latest[job.Id]; ok {
+					dispatcherJobsCoalesced.Inc()
+				}
+				job.LastPointTs = time.Unix(next, 0)
+				latest[job.Id] = job
+			}
+		}
+		for _, job := range latest {
+			queueJob(jobQ, job, job.LastPointTs)
+		}
+		return next
+	}
+
+	for ; next <= now; next++ {
+		jobs, err := getSlotJobs(next)
+		if err != nil {
+			continue
+		}
+		for _, job := range jobs {
+			queueJob(jobQ, job, time.Unix(next, 0))
+		}
+	}
+	return next
+}
+
+// offerPosition hands the latest position of the scheduler to
+// persistPositions, replacing any position it has not read yet.
+func offerPosition(c chan int64, position int64) {
+	select {
+	case <-c:
+	default:
+	}
+	c <- position
+}
+
+// persistPositions writes the latest position of the scheduler to the DB at
+// most once per positionPersistInterval, so that DB latency does not delay
+// dispatching. After a restart, the slots dispatched since the last write are
+// dispatched again.
+func persistPositions(c chan int64) {
+	ticker := time.NewTicker(positionPersistInterval)
+	defer ticker.Stop()
+	var pending int64
+	for {
+		select {
+		case position := <-c:
+			pending = position
+		case <-ticker.C:
+			if pending == 0 {
+				continue
+			}
+			setPosition(pending)
+			pending = 0
+		}
+	}
+}
+
+// getSlotJobs retrieves the jobs due for the slot ts.
+func getSlotJobs(ts int64) ([]*m.AlertingJob, error) {
+	pre := time.Now()
+	jobs, err := getJobs(ts)
+	dispatcherNumGetSchedules.Inc()
+	dispatcherGetSchedules.Value(util.Since(pre))
+
+	if err != nil {
+		log.Error(0, "Alerting failed to get jobs from DB: %q", err)
+		return nil, err
+	}
+	log.Debug("%d jobs found for TS: %d", len(jobs), ts)
+	return jobs, nil
+}
+
+func queueJob(jobQ *jobqueue.JobQueue, job *m.AlertingJob, lastPointTs time.Time) {
+	job.GeneratedAt = time.Now()
+	job.LastPointTs = lastPointTs
+	jobQ.QueueJob(job)
+	dispatcherJobsScheduled.Inc()
+}
+
+// schedulerState tracks the position of the local dispatcher so that it can
+// be reported through the admin api.
+type schedulerState struct {
+	sync.RWMutex
+	running  bool
+	offset   int
+	position int64
+}
+
+var scheduler = &schedulerState{}
+
+func (s *schedulerState) start(offset int, position int64) {
+	s.Lock()
+	s.running = true
+	s.offset = offset
+	s.position = position
+	s.Unlock()
+}
+
+func (s *schedulerState) setPosition(position int64) {
+	s.Lock()
+	s.position = position
+	s.Unlock()
+}
+
+func (s *schedulerState) setOffset(offset int) {
+	s.Lock()
+	s.offset = offset
+	s.Unlock()
+}
+
+// GetSchedulerStatus returns the position of the scheduler versus wall clock.
+// When the scheduler is not running in this process the last persisted
+// position is reported instead. It never writes to the DB.
+func GetSchedulerStatus() *m.AlertSchedulerStatus {
+	scheduler.RLock()
+	running := scheduler.running
+	offset := scheduler.offset
+	position := scheduler.position
+	scheduler.RUnlock()
+
+	if !running {
+		offset = LoadOffset()
+		position = LoadPosition()
+	}
+
+	now := time.Now()
+	status := &m.AlertSchedulerStatus{
+		Running:      running,
+		CatchUpMode:  setting.Alerting.CatchUpMode,
+		CatchUpLimit: int64(setting.Alerting.CatchUpLimit / time.Second),
+		Offset:       offset,
+		WallClock:    now,
+	}
+	if position > 0 {
+		status.Position = time.Unix(position, 0)
+		status.Lag = now.Unix() - int64(offset) - position
+		if status.Lag < 0 {
+			status.Lag = 0
 		}
 	}
+	return status
 }
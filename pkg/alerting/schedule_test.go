@@ -0,0 +1,20 @@
+package alerting
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOfferPosition(t *testing.T) {
+	Convey("When positions are offered faster than they are persisted", t, func() {
+		positions := make(chan int64, 1)
+		offerPosition(positions, 1)
+		offerPosition(positions, 2)
+		offerPosition(positions, 3)
+		Convey("only the latest position should be persisted", func() {
+			So(len(positions), ShouldEqual, 1)
+			So(<-positions, ShouldEqual, 3)
+		})
+	})
+}
@@ -1,7 +1,13 @@
 package api
 
 import (
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/raintank/worldping-api/pkg/alerting"
 	"github.com/raintank/worldping-api/pkg/api/rbody"
+	"github.com/raintank/worldping-api/pkg/api/sockets"
 	"github.com/raintank/worldping-api/pkg/middleware"
 	m "github.com/raintank/worldping-api/pkg/models"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
@@ -51,3 +57,59 @@ func GetBilling(c *middleware.Context) *rbody.ApiResponse {
 func GetApiKey(ctx *middleware.Context) *rbody.ApiResponse {
 	return rbody.OkResp("apiKey", map[string]string{"apiKey": ctx.ApiKey})
 }
+
+func GetAlertScheduler(c *middleware.Context) *rbody.ApiResponse {
+	return rbody.OkResp("scheduler", alerting.GetSchedulerStatus())
+}
+
+// versionLess orders probe versions semantically, so that 1.10.0 comes after
+// 1.9.0. Versions that cannot be parsed are sorted after all valid ones.
+func versionLess(a, b string) bool {
+	va, errA := version.NewVersion(a)
+	vb, errB := version.NewVersion(b)
+	switch {
+	case errA != nil && errB != nil:
+		return a < b
+	case errA != nil:
+		return false
+	case errB != nil:
+		return true
+	}
+	return va.LessThan(vb)
+}
+
+// GetProbeVersions reports how many sessions are connected with each probe
+// version, to know when support for old versions can be dropped.
+func GetProbeVersions(c *middleware.Context) *rbody.ApiResponse {
+	sessions, err := sqlstore.GetProbeSessions(0, "", time.Now().Add(-2*heartbeatInterval))
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	policy := sockets.Policy()
+	usage := make(map[string]*m.ProbeVersionUsage)
+	probes := make(map[string]map[int64]bool)
+	for _, sess := range sessions {
+		u, ok := usage[sess.Version]
+		if !ok {
+			u = &m.ProbeVersionUsage{Version: sess.Version}
+			if v, err := version.NewVersion(sess.Version); err == nil {
+				u.Allowed = policy.Allowed(v) == nil
+				u.Deprecated = policy.Deprecated(v)
+			}
+			usage[sess.Version] = u
+			probes[sess.Version] = make(map[int64]bool)
+		}
+		u.Sessions++
+		probes[sess.Version][sess.ProbeId] = true
+	}
+
+	result := make([]*m.ProbeVersionUsage, 0, len(usage))
+	for v, u := range usage {
+		u.Probes = len(probes[v])
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return versionLess(result[i].Version, result[j].Version)
+	})
+	return rbody.OkResp("probeVersions", result)
+}
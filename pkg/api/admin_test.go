@@ -2,12 +2,14 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/raintank/worldping-api/pkg/api/rbody"
 	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
 	"github.com/raintank/worldping-api/pkg/setting"
 	. "github.com/smartystreets/goconvey/convey"
 	"gopkg.in/macaron.v1"
@@ -49,3 +51,81 @@ func TestUsageApi(t *testing.T) {
 	})
 
 }
+
+func TestAlertSchedulerApi(t *testing.T) {
+	InitTestDB(t)
+	r := macaron.Classic()
+	setting.AdminKey = "test"
+	setting.Alerting.CatchUpMode = setting.CatchUpModeLatest
+	Register(r)
+
+	Convey("When getting the alert scheduler status", t, func() {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/api/v2/admin/alerting/scheduler", nil)
+		So(err, ShouldBeNil)
+		addAuthHeader(req)
+
+		r.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 200)
+		response := rbody.ApiResponse{}
+		err = json.Unmarshal(resp.Body.Bytes(), &response)
+		So(err, ShouldBeNil)
+		So(response.Meta.Type, ShouldEqual, "scheduler")
+
+		status := m.AlertSchedulerStatus{}
+		err = json.Unmarshal(response.Body, &status)
+		So(err, ShouldBeNil)
+		So(status.Running, ShouldBeFalse)
+		So(status.CatchUpMode, ShouldEqual, "latest")
+		So(status.Offset, ShouldEqual, 30)
+		So(status.Position.IsZero(), ShouldBeTrue)
+	})
+}
+
+func TestProbeVersionsApi(t *testing.T) {
+	InitTestDB(t)
+	r := macaron.Classic()
+	setting.AdminKey = "test"
+	Register(r)
+	populateCollectors(t)
+	for i, v := range []string{"0.9.0", "1.0.0", "1.0.0", "0.10.0"} {
+		err := sqlstore.AddProbeSession(&m.ProbeSession{
+			OrgId:      1,
+			ProbeId:    int64(i + 1),
+			SocketId:   fmt.Sprintf("sid%d", i),
+			Version:    v,
+			InstanceId: "default",
+			RemoteIp:   "127.0.0.1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Convey("When getting probe version usage", t, func() {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/api/v2/admin/probes/versions", nil)
+		So(err, ShouldBeNil)
+		addAuthHeader(req)
+
+		r.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 200)
+		response := rbody.ApiResponse{}
+		err = json.Unmarshal(resp.Body.Bytes(), &response)
+		So(err, ShouldBeNil)
+		So(response.Meta.Type, ShouldEqual, "probeVersions")
+
+		usage := make([]m.ProbeVersionUsage, 0)
+		err = json.Unmarshal(response.Body, &usage)
+		So(err, ShouldBeNil)
+		So(len(usage), ShouldEqual, 3)
+		So(usage[0].Version, ShouldEqual, "0.9.0")
+		So(usage[0].Sessions, ShouldEqual, 1)
+		So(usage[0].Allowed, ShouldBeTrue)
+		So(usage[1].Version, ShouldEqual, "0.10.0")
+		So(usage[1].Sessions, ShouldEqual, 1)
+		So(usage[2].Version, ShouldEqual, "1.0.0")
+		So(usage[2].Sessions, ShouldEqual, 2)
+		So(usage[2].Probes, ShouldEqual, 2)
+	})
+}
@@ -38,6 +38,9 @@ func Register(r *macaron.Macaron) {
 			})
 			r.Get("/usage", stats("admin.usage"), wrap(GetUsage))
 			r.Get("/billing", stats("admin.billing"), wrap(GetBilling))
+			r.Get("/alerting/scheduler", stats("admin.alerting"), wrap(GetAlertScheduler))
+			r.Get("/probes/versions", stats("admin.probes"), wrap(GetProbeVersions))
+			r.Delete("/probes/:id/sessions/:socketId", stats("admin.probes"), wrap(DisconnectProbeSession))
 		}, middleware.RequireAdmin())
 
 		r.Group("/endpoints", func() {
@@ -48,9 +51,21 @@ func Register(r *macaron.Macaron) {
 			r.Delete("/:id", reqEditorRole, stats("endpoints"), wrap(DeleteEndpoint))
 			r.Get("/discover", stats("endpoint_discover"), reqEditorRole, bind(m.DiscoverEndpointCmd{}), wrap(DiscoverEndpoint))
 			r.Get("/:id", stats("endpoints"), wrap(GetEndpointById))
+			r.Combo("/:id/checks").
+				Get(stats("endpoints"), wrap(GetEndpointChecks)).
+				Post(reqEditorRole, stats("endpoints"), bind(m.Check{}), wrap(AddEndpointCheck))
+			r.Combo("/:id/checks/:checkId").
+				Get(stats("endpoints"), wrap(GetEndpointCheck)).
+				Put(reqEditorRole, stats("endpoints"), bind(m.Check{}), wrap(UpdateEndpointCheck)).
+				Delete(reqEditorRole, stats("endpoints"), wrap(DeleteEndpointCheck))
 			r.Post("/disable", stats("endpoints"), reqEditorRole, wrap(DisableEndpoints))
 		})
 
+		r.Group("/checks", func() {
+			r.Post("/test", reqEditorRole, stats("checks.test"), bind(m.TestCheckCmd{}), wrap(TestCheck))
+			r.Post("/:id/evaluate", stats("checks.evaluate"), bind(m.EvaluateCheckCmd{}), wrap(EvaluateCheck))
+		})
+
 		r.Group("/probes", func() {
 			r.Combo("/").
 				Get(bind(m.GetProbesQuery{}), stats("probes"), wrap(GetProbes)).
@@ -59,6 +74,27 @@ func Register(r *macaron.Macaron) {
 			r.Delete("/:id", reqEditorRole, stats("probes"), wrap(DeleteProbe))
 			r.Get("/locations", stats("probes"), V1GetCollectorLocations)
 			r.Get("/:id", stats("probes"), wrap(GetProbeById))
+			r.Get("/:id/sessions", stats("probes"), wrap(GetProbeSessions))
+			r.Get("/:id/health", stats("probes"), wrap(GetProbeHealth))
+			r.Post("/:id/drain", reqEditorRole, stats("probes"), bind(m.DrainProbeCmd{}), wrap(DrainProbe))
+			r.Combo("/:id/tokens").
+				Get(reqEditorRole, stats("probes"), wrap(GetProbeTokens)).
+				Post(reqEditorRole, stats("probes"), bind(m.AddProbeTokenCmd{}), wrap(AddProbeToken))
+			r.Delete("/:id/tokens/:tokenId", reqEditorRole, stats("probes"), wrap(DeleteProbeToken))
+			r.Combo("/:id/grants").
+				Get(reqEditorRole, stats("probes"), wrap(GetProbeGrants)).
+				Post(reqEditorRole, stats("probes"), bind(m.AddProbeGrantCmd{}), wrap(AddProbeGrant))
+			r.Delete("/:id/grants/:orgId", reqEditorRole, stats("probes"), wrap(DeleteProbeGrant))
+		})
+
+		r.Group("/probe-groups", func() {
+			r.Combo("/").
+				Get(stats("probe_groups"), wrap(GetProbeGroups)).
+				Post(reqEditorRole, stats("probe_groups"), bind(m.AddProbeGroupCmd{}), wrap(AddProbeGroup))
+			r.Combo("/:id").
+				Get(stats("probe_groups"), wrap(GetProbeGroupById)).
+				Put(reqEditorRole, stats("probe_groups"), bind(m.UpdateProbeGroupCmd{}), wrap(UpdateProbeGroup)).
+				Delete(reqEditorRole, stats("probe_groups"), wrap(DeleteProbeGroup))
 		})
 
 	}, middleware.Auth(setting.AdminKey))
@@ -114,6 +150,7 @@ func Register(r *macaron.Macaron) {
 	//r.Get("/render/*", reqSignedIn, RenderToPng)
 
 	r.Any("/socket.io/", SocketIO)
+	r.Get("/probe/v1", ProbeWebSocket)
 
 	r.NotFound(stats("not_found"), NotFoundHandler)
 
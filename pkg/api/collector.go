@@ -4,6 +4,7 @@ import (
 	//"github.com/raintank/worldping-api/pkg/log"
 	"github.com/raintank/worldping-api/pkg/middleware"
 	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/management"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
 )
 
@@ -71,16 +72,8 @@ func V1DeleteCollector(c *middleware.Context) {
 
 func V1AddCollector(c *middleware.Context, probe m.ProbeDTO) {
 	probe.OrgId = int64(c.User.ID)
-	if probe.Id != 0 {
-		c.JSON(400, "Id already set. Try update instead of create.")
-		return
-	}
-	if probe.Name == "" {
-		c.JSON(400, "Collector Name not set.")
-		return
-	}
 
-	if err := sqlstore.AddProbe(&probe); err != nil {
+	if err := management.AddProbe(&probe, c.IsAdmin); err != nil {
 		handleError(c, err)
 		return
 	}
@@ -91,19 +84,8 @@ func V1AddCollector(c *middleware.Context, probe m.ProbeDTO) {
 
 func V1UpdateCollector(c *middleware.Context, probe m.ProbeDTO) {
 	probe.OrgId = int64(c.User.ID)
-	if probe.Name == "" {
-		c.JSON(400, "Collector Name not set.")
-		return
-	}
-
-	if probe.Public {
-		if !c.IsAdmin {
-			c.JSON(400, "Only admins can make public collectors")
-			return
-		}
-	}
 
-	if err := sqlstore.UpdateProbe(&probe); err != nil {
+	if err := management.UpdateProbe(&probe, c.IsAdmin); err != nil {
 		handleError(c, err)
 		return
 	}
@@ -8,6 +8,7 @@ import (
 	"github.com/raintank/worldping-api/pkg/middleware"
 	m "github.com/raintank/worldping-api/pkg/models"
 	"github.com/raintank/worldping-api/pkg/services/endpointdiscovery"
+	"github.com/raintank/worldping-api/pkg/services/management"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
 )
 
@@ -50,10 +51,6 @@ func V1DeleteEndpoint(c *middleware.Context) {
 
 func V1AddEndpoint(c *middleware.Context, cmd m.AddEndpointCommand) {
 	cmd.OrgId = int64(c.User.ID)
-	if cmd.Name == "" {
-		c.JSON(400, "Endpoint name not set.")
-		return
-	}
 	checks := make([]m.Check, len(cmd.Monitors))
 	for i, mon := range cmd.Monitors {
 		checks[i] = m.Check{
@@ -73,12 +70,6 @@ func V1AddEndpoint(c *middleware.Context, cmd m.AddEndpointCommand) {
 			checks[i].Route.Type = m.RouteByIds
 			checks[i].Route.Config = map[string]interface{}{"ids": mon.CollectorIds}
 		}
-		err := sqlstore.ValidateCheckRoute(&checks[i])
-		if err != nil {
-			handleError(c, err)
-			return
-		}
-
 	}
 	endpoint := m.EndpointDTO{
 		OrgId:   cmd.OrgId,
@@ -88,7 +79,7 @@ func V1AddEndpoint(c *middleware.Context, cmd m.AddEndpointCommand) {
 		Updated: time.Now(),
 		Checks:  checks,
 	}
-	err := sqlstore.AddEndpoint(&endpoint)
+	err := management.AddEndpoint(&endpoint)
 	if err != nil {
 		handleError(c, err)
 		return
@@ -99,10 +90,6 @@ func V1AddEndpoint(c *middleware.Context, cmd m.AddEndpointCommand) {
 
 func V1UpdateEndpoint(c *middleware.Context, cmd m.UpdateEndpointCommand) {
 	cmd.OrgId = int64(c.User.ID)
-	if cmd.Name == "" {
-		c.JSON(400, "Endpoint name not set.")
-		return
-	}
 	// get existing endpoint.
 	endpoint, err := sqlstore.GetEndpointById(cmd.OrgId, cmd.Id)
 	if err != nil {
@@ -117,7 +104,7 @@ func V1UpdateEndpoint(c *middleware.Context, cmd m.UpdateEndpointCommand) {
 	endpoint.Name = cmd.Name
 	endpoint.Tags = cmd.Tags
 
-	err = sqlstore.UpdateEndpoint(endpoint)
+	err = management.UpdateEndpoint(endpoint)
 	if err != nil {
 		handleError(c, err)
 		return
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"net"
+
+	"github.com/fiorix/freegeoip"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/raintank/worldping-api/pkg/setting"
+)
+
+var geoipDB *freegeoip.DB
+var asnDB *freegeoip.DB
+
+var errGeoIPUnavailable = errors.New("GEOIP DB not loaded")
+
+type asnQuery struct {
+	Number uint   `maxminddb:"autonomous_system_number"`
+	Org    string `maxminddb:"autonomous_system_organization"`
+}
+
+// probeLocation is the result of looking up the address of a probe.
+type probeLocation struct {
+	Latitude  float64
+	Longitude float64
+	Country   string
+	City      string
+	Asn       int64
+	AsnOrg    string
+}
+
+func initGeoIP() {
+	var err error
+	if setting.GeoIP.CityDbPath != "" {
+		geoipDB, err = freegeoip.Open(setting.GeoIP.CityDbPath)
+	} else {
+		geoipDB, err = freegeoip.OpenURL(setting.GeoIP.DownloadUrl, setting.GeoIP.UpdateInterval, setting.GeoIP.RetryInterval)
+	}
+	if err != nil {
+		log.Error(3, "failed to load GEOIP DB. Probes will not be located. ", err)
+		geoipDB = nil
+	} else {
+		go watchGeoIP("city", geoipDB)
+	}
+
+	if setting.GeoIP.AsnDbPath != "" {
+		asnDB, err = freegeoip.Open(setting.GeoIP.AsnDbPath)
+		if err != nil {
+			log.Error(3, "failed to load GEOIP ASN DB. ", err)
+			asnDB = nil
+		} else {
+			go watchGeoIP("asn", asnDB)
+		}
+	}
+}
+
+// watchGeoIP logs each time the DB is reloaded or fails to load.
+func watchGeoIP(name string, db *freegeoip.DB) {
+	for {
+		select {
+		case file, ok := <-db.NotifyOpen():
+			if !ok {
+				return
+			}
+			log.Info("GEOIP %s DB loaded from %s", name, file)
+		case err, ok := <-db.NotifyError():
+			if !ok {
+				return
+			}
+			log.Error(3, "GEOIP %s DB error. %s", name, err)
+		}
+	}
+}
+
+func lookupLocation(ip net.IP) (*probeLocation, error) {
+	if geoipDB == nil {
+		return nil, errGeoIPUnavailable
+	}
+	var query freegeoip.DefaultQuery
+	if err := geoipDB.Lookup(ip, &query); err != nil {
+		return nil, err
+	}
+	location := &probeLocation{
+		Latitude:  query.Location.Latitude,
+		Longitude: query.Location.Longitude,
+		Country:   query.Country.ISOCode,
+		City:      query.City.Names["en"],
+	}
+	if asnDB != nil {
+		var asn asnQuery
+		if err := asnDB.Lookup(ip, &asn); err != nil {
+			log.Debug("unable to get ASN of %s. %s", ip, err)
+		} else {
+			location.Asn = int64(asn.Number)
+			location.AsnOrg = asn.Org
+		}
+	}
+	return location, nil
+}
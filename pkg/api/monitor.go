@@ -7,6 +7,7 @@ import (
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/raintank/worldping-api/pkg/middleware"
 	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/management"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
 )
 
@@ -63,7 +64,7 @@ func V1DeleteMonitor(c *middleware.Context) {
 		}
 	}
 	endpoint.Checks = newChecks
-	err = sqlstore.UpdateEndpoint(endpoint)
+	err = management.UpdateEndpoint(endpoint)
 	if err != nil {
 		handleError(c, err)
 		return
@@ -133,15 +134,10 @@ func V1AddMonitor(c *middleware.Context, cmd m.AddMonitorCommand) {
 		Route:          route,
 		Settings:       m.MonitorSettingsDTO(cmd.Settings).ToV2Setting(m.MonitorTypeToCheckTypeMap[cmd.MonitorTypeId-1]),
 	}
-	err = sqlstore.ValidateCheckRoute(&check)
-	if err != nil {
-		handleError(c, err)
-		return
-	}
 	endpoint.Checks = append(endpoint.Checks, check)
 
 	//Update endpoint
-	err = sqlstore.UpdateEndpoint(endpoint)
+	err = management.UpdateEndpoint(endpoint)
 	if err != nil {
 		handleError(c, err)
 		return
@@ -235,13 +231,7 @@ func V1UpdateMonitor(c *middleware.Context, cmd m.UpdateMonitorCommand) {
 	endpoint.Checks[checkPos].Route = route
 	endpoint.Checks[checkPos].Settings = m.MonitorSettingsDTO(cmd.Settings).ToV2Setting(m.MonitorTypeToCheckTypeMap[cmd.MonitorTypeId-1])
 
-	err = sqlstore.ValidateCheckRoute(&endpoint.Checks[checkPos])
-	if err != nil {
-		handleError(c, err)
-		return
-	}
-
-	err = sqlstore.UpdateEndpoint(endpoint)
+	err = management.UpdateEndpoint(endpoint)
 	if err != nil {
 		handleError(c, err)
 		return
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raintank/worldping-api/pkg/api/rbody"
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	"github.com/raintank/worldping-api/pkg/setting"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+// parityResponse sends the request and returns the status code and error
+// message of the response. v2 responses are always sent with a 200, so they
+// are read from the meta of the response body. The message of successful
+// responses is empty, as the versions return different bodies.
+func parityResponse(r *macaron.Macaron, method, url string, body interface{}) (int, string) {
+	payload, err := json.Marshal(body)
+	So(err, ShouldBeNil)
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	So(err, ShouldBeNil)
+	addAuthHeader(req)
+	addContentTypeHeader(req)
+	r.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		message := ""
+		json.Unmarshal(resp.Body.Bytes(), &message)
+		return resp.Code, message
+	}
+	response := rbody.ApiResponse{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &response); err != nil || response.Meta == nil || response.Meta.Code == 200 {
+		return resp.Code, ""
+	}
+	return response.Meta.Code, response.Meta.Message
+}
+
+// shouldMatch asserts that both API versions got the expected status code and
+// the same error message.
+func shouldMatch(code int, v1Code int, v1Message string, v2Code int, v2Message string) {
+	So(v1Code, ShouldEqual, code)
+	So(v2Code, ShouldEqual, code)
+	So(v1Message, ShouldEqual, v2Message)
+}
+
+// checkToMonitor converts a check to the equivalent v1 monitor.
+func checkToMonitor(check m.Check) *m.AddMonitorCommand {
+	mon := &m.AddMonitorCommand{
+		EndpointId:     -1,
+		MonitorTypeId:  checkTypeToId(check.Type),
+		Frequency:      check.Frequency,
+		Enabled:        check.Enabled,
+		HealthSettings: check.HealthSettings,
+		Settings:       checkSettingToMonitorSetting(check.Settings),
+	}
+	switch check.Route.Type {
+	case m.RouteByTags:
+		mon.CollectorTags = check.Route.Config["tags"].([]string)
+	case m.RouteByIds:
+		mon.CollectorIds = check.Route.Config["ids"].([]int64)
+	}
+	return mon
+}
+
+func parityCheck(checkType m.CheckType, frequency int64, enabled bool, route *m.CheckRoute, settings map[string]interface{}) m.Check {
+	return m.Check{
+		Type:      checkType,
+		Frequency: frequency,
+		Enabled:   enabled,
+		Route:     route,
+		Settings:  settings,
+		HealthSettings: &m.CheckHealthSettings{
+			NumProbes: 1,
+			Steps:     3,
+		},
+	}
+}
+
+func byTags(tags ...string) *m.CheckRoute {
+	return &m.CheckRoute{Type: m.RouteByTags, Config: map[string]interface{}{"tags": tags}}
+}
+
+func byIds(ids ...int64) *m.CheckRoute {
+	return &m.CheckRoute{Type: m.RouteByIds, Config: map[string]interface{}{"ids": ids}}
+}
+
+var checkParityCases = []struct {
+	name  string
+	check m.Check
+	code  int
+}{
+	{
+		name: "valid http check",
+		check: parityCheck(m.HTTP_CHECK, 60, true, byTags("test"), map[string]interface{}{
+			"host": "www.google.com", "path": "/", "port": 80, "timeout": 5,
+		}),
+		code: 200,
+	},
+	{
+		name: "invalid frequency",
+		check: parityCheck(m.HTTP_CHECK, 45, true, byTags("test"), map[string]interface{}{
+			"host": "www.google.com", "path": "/", "port": 80, "timeout": 5,
+		}),
+		code: 400,
+	},
+	{
+		name: "missing host",
+		check: parityCheck(m.HTTP_CHECK, 60, true, byTags("test"), map[string]interface{}{
+			"path": "/", "port": 80, "timeout": 5,
+		}),
+		code: 400,
+	},
+	{
+		name: "timeout out of range",
+		check: parityCheck(m.HTTP_CHECK, 60, true, byTags("test"), map[string]interface{}{
+			"host": "www.google.com", "path": "/", "port": 80, "timeout": 20,
+		}),
+		code: 400,
+	},
+	{
+		name: "port out of range",
+		check: parityCheck(m.HTTP_CHECK, 60, true, byTags("test"), map[string]interface{}{
+			"host": "www.google.com", "path": "/", "port": 70000, "timeout": 5,
+		}),
+		code: 400,
+	},
+	{
+		name: "disabled checks only need a route and frequency",
+		check: parityCheck(m.HTTP_CHECK, 60, false, byTags("test"), map[string]interface{}{
+			"path": "/",
+		}),
+		code: 200,
+	},
+	{
+		name: "disabled check with invalid frequency",
+		check: parityCheck(m.HTTP_CHECK, 45, false, byTags("test"), map[string]interface{}{
+			"path": "/",
+		}),
+		code: 400,
+	},
+	{
+		name: "valid ping check",
+		check: parityCheck(m.PING_CHECK, 60, true, byIds(1, 2), map[string]interface{}{
+			"hostname": "www.google.com", "timeout": 5,
+		}),
+		code: 200,
+	},
+	{
+		name: "missing hostname",
+		check: parityCheck(m.PING_CHECK, 60, true, byIds(1, 2), map[string]interface{}{
+			"timeout": 5,
+		}),
+		code: 400,
+	},
+	{
+		name: "route to unknown probe",
+		check: parityCheck(m.PING_CHECK, 60, true, byIds(999), map[string]interface{}{
+			"hostname": "www.google.com", "timeout": 5,
+		}),
+		code: 400,
+	},
+}
+
+func TestEndpointApiParity(t *testing.T) {
+	InitTestDB(t)
+	r := macaron.Classic()
+	setting.AdminKey = "test"
+	setting.Quota = setting.QuotaSettings{
+		Enabled: true,
+		Org: &setting.OrgQuota{
+			Endpoint:      100,
+			Probe:         100,
+			DownloadLimit: 102400,
+		},
+		Global: &setting.GlobalQuota{
+			Endpoint: -1,
+			Probe:    -1,
+		},
+	}
+	Register(r)
+	populateCollectors(t)
+	populateEndpoints(t)
+
+	Convey("When creating an endpoint with each API version", t, func() {
+		for i, c := range checkParityCases {
+			Convey(c.name+" should get the same response", func() {
+				v1Code, v1Message := parityResponse(r, "PUT", "/api/endpoints", &m.AddEndpointCommand{
+					Name:     fmt.Sprintf("v1-%d.google.com", i),
+					Monitors: []*m.AddMonitorCommand{checkToMonitor(c.check)},
+				})
+				v2Code, v2Message := parityResponse(r, "POST", "/api/v2/endpoints", &m.EndpointDTO{
+					Name:   fmt.Sprintf("v2-%d.google.com", i),
+					Checks: []m.Check{c.check},
+				})
+				shouldMatch(c.code, v1Code, v1Message, v2Code, v2Message)
+			})
+		}
+	})
+
+	Convey("When updating a check with each API version", t, func() {
+		for _, c := range checkParityCases {
+			Convey(c.name+" should get the same response", func() {
+				endpoint, err := sqlstore.GetEndpointById(1, 1)
+				So(err, ShouldBeNil)
+				pos := -1
+				for j := range endpoint.Checks {
+					if endpoint.Checks[j].Type == c.check.Type {
+						pos = j
+					}
+				}
+				So(pos, ShouldNotEqual, -1)
+
+				mon := checkToMonitor(c.check)
+				v1Code, v1Message := parityResponse(r, "POST", "/api/monitors", &m.UpdateMonitorCommand{
+					Id:             endpoint.Checks[pos].Id,
+					EndpointId:     endpoint.Id,
+					MonitorTypeId:  mon.MonitorTypeId,
+					CollectorIds:   mon.CollectorIds,
+					CollectorTags:  mon.CollectorTags,
+					Settings:       mon.Settings,
+					HealthSettings: mon.HealthSettings,
+					Frequency:      mon.Frequency,
+					Enabled:        mon.Enabled,
+				})
+
+				check := c.check
+				check.Id = endpoint.Checks[pos].Id
+				check.EndpointId = endpoint.Id
+				endpoint.Checks[pos] = check
+				v2Code, v2Message := parityResponse(r, "PUT", "/api/v2/endpoints", endpoint)
+				shouldMatch(c.code, v1Code, v1Message, v2Code, v2Message)
+			})
+		}
+	})
+}
+
+func TestProbeApiParity(t *testing.T) {
+	InitTestDB(t)
+	r := macaron.Classic()
+	setting.AdminKey = "test"
+	setting.Quota = setting.QuotaSettings{
+		Enabled: true,
+		Org: &setting.OrgQuota{
+			Endpoint: 100,
+			Probe:    100,
+		},
+		Global: &setting.GlobalQuota{
+			Endpoint: -1,
+			Probe:    -1,
+		},
+	}
+	Register(r)
+	populateCollectors(t)
+
+	Convey("When creating a probe with each API version", t, func() {
+		cases := []struct {
+			name  string
+			probe m.ProbeDTO
+			code  int
+		}{
+			{name: "valid probe", probe: m.ProbeDTO{Name: "parity"}, code: 200},
+			{name: "missing name", probe: m.ProbeDTO{}, code: 400},
+			{name: "id already set", probe: m.ProbeDTO{Id: 1, Name: "parity"}, code: 400},
+			{
+				name:  "invalid webhook",
+				probe: m.ProbeDTO{Name: "parity", Notifications: &m.ProbeNotificationSettings{Webhook: "ftp://example.com"}},
+				code:  400,
+			},
+			{
+				name:  "negative grace period",
+				probe: m.ProbeDTO{Name: "parity", Notifications: &m.ProbeNotificationSettings{GracePeriod: -1}},
+				code:  400,
+			},
+		}
+		for i, c := range cases {
+			Convey(c.name+" should get the same response", func() {
+				probe := c.probe
+				if probe.Name != "" {
+					probe.Name = fmt.Sprintf("%s-v1-%d", c.probe.Name, i)
+				}
+				v1Code, v1Message := parityResponse(r, "PUT", "/api/collectors", &probe)
+				probe = c.probe
+				if probe.Name != "" {
+					probe.Name = fmt.Sprintf("%s-v2-%d", c.probe.Name, i)
+				}
+				v2Code, v2Message := parityResponse(r, "POST", "/api/v2/probes", &probe)
+				shouldMatch(c.code, v1Code, v1Message, v2Code, v2Message)
+			})
+		}
+	})
+
+	Convey("When updating a probe with each API version", t, func() {
+		cases := []struct {
+			name  string
+			probe m.ProbeDTO
+			code  int
+		}{
+			{name: "valid probe", probe: m.ProbeDTO{Id: 1, Name: "test1", Enabled: true}, code: 200},
+			{name: "missing name", probe: m.ProbeDTO{Id: 1, Enabled: true}, code: 400},
+			{name: "unknown probe", probe: m.ProbeDTO{Id: 999, Name: "test999"}, code: 404},
+			{
+				name:  "invalid webhook",
+				probe: m.ProbeDTO{Id: 1, Name: "test1", Notifications: &m.ProbeNotificationSettings{Webhook: "not a url"}},
+				code:  400,
+			},
+			{
+				name:  "tagging a public probe of another org",
+				probe: m.ProbeDTO{Id: 4, Name: "public1", Public: true, Tags: []string{"parity"}},
+				code:  200,
+			},
+		}
+		for _, c := range cases {
+			Convey(c.name+" should get the same response", func() {
+				v1Code, v1Message := parityResponse(r, "POST", "/api/collectors", &c.probe)
+				v2Code, v2Message := parityResponse(r, "PUT", "/api/v2/probes", &c.probe)
+				shouldMatch(c.code, v1Code, v1Message, v2Code, v2Message)
+			})
+		}
+	})
+}
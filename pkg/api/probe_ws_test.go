@@ -0,0 +1,92 @@
+package api
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raintank/worldping-api/pkg/api/sockets"
+	"github.com/raintank/worldping-api/pkg/events"
+	"github.com/raintank/worldping-api/pkg/setting"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func TestProbeWebSocket(t *testing.T) {
+	setting.AdminKey = "test"
+	InitTestDB(t)
+
+	events.Init()
+	InitCollectorController(&mockPublisher{})
+	r := macaron.Classic()
+	Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	serverAddr, _ := url.Parse(srv.URL)
+
+	Convey("When connecting with an unsupported protocol version", t, func() {
+		addr := fmt.Sprintf("ws://%s/probe/v1?protocol=99&version=1.0.0&apiKey=test&name=ws", serverAddr.Host)
+		_, _, err := websocket.DefaultDialer.Dial(addr, nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When connecting with an invalid apiKey", t, func() {
+		addr := fmt.Sprintf("ws://%s/probe/v1?protocol=1&version=1.0.0&apiKey=badpass&name=ws", serverAddr.Host)
+		conn, _, err := websocket.DefaultDialer.Dial(addr, nil)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		msg := sockets.Message{}
+		err = conn.ReadJSON(&msg)
+		So(err, ShouldBeNil)
+		So(msg.Type, ShouldEqual, "error")
+		So(string(msg.Payload), ShouldContainSubstring, "invalid")
+	})
+
+	Convey("When connecting with a valid apiKey", t, func() {
+		addr := fmt.Sprintf("ws://%s/probe/v1?protocol=1&version=1.0.0&apiKey=test&name=ws", serverAddr.Host)
+		conn, _, err := websocket.DefaultDialer.Dial(addr, nil)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		messages := make(chan sockets.Message, 10)
+		go func() {
+			for {
+				msg := sockets.Message{}
+				if err := conn.ReadJSON(&msg); err != nil {
+					close(messages)
+					return
+				}
+				messages <- msg
+			}
+		}()
+		waitFor := func(msgType string) *sockets.Message {
+			timer := time.NewTimer(time.Second * 5)
+			defer timer.Stop()
+			for {
+				select {
+				case msg, ok := <-messages:
+					if !ok {
+						return nil
+					}
+					if msg.Type == msgType {
+						return &msg
+					}
+				case <-timer.C:
+					return nil
+				}
+			}
+		}
+
+		So(waitFor("ready"), ShouldNotBeNil)
+		So(waitFor("refresh"), ShouldNotBeNil)
+
+		err = conn.WriteJSON(sockets.Message{Version: sockets.ProtocolVersion, Type: "heartbeat", Seq: 5})
+		So(err, ShouldBeNil)
+		ack := waitFor("ack")
+		So(ack, ShouldNotBeNil)
+		So(ack.Seq, ShouldEqual, 5)
+	})
+}
@@ -27,9 +27,10 @@ type ApiResponse struct {
 }
 
 type ResponseMeta struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-	Type    string `json:"type"`
+	Code     int      `json:"code"`
+	Message  string   `json:"message"`
+	Type     string   `json:"type"`
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 func (r *ApiResponse) Error() error {
@@ -55,6 +56,16 @@ func OkResp(t string, body interface{}) *ApiResponse {
 	return resp
 }
 
+// OkRespWithWarnings is a successful response that also informs the user of
+// issues that did not prevent the request from being completed.
+func OkRespWithWarnings(t string, body interface{}, warnings []string) *ApiResponse {
+	resp := OkResp(t, body)
+	if resp.Meta.Code == 200 && len(warnings) > 0 {
+		resp.Meta.Warnings = warnings
+	}
+	return resp
+}
+
 func ErrResp(err error) *ApiResponse {
 	code := 500
 	message := err.Error()
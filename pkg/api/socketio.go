@@ -1,13 +1,19 @@
 package api
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/fiorix/freegeoip"
 	socketio "github.com/googollee/go-socket.io"
 	"github.com/grafana/metrictank/stats"
 	"github.com/hashicorp/go-version"
@@ -24,7 +30,6 @@ import (
 )
 
 var server *socketio.Server
-var geoipDB *freegeoip.DB
 
 var heartbeatInterval = time.Second * 30
 
@@ -44,12 +49,35 @@ func authenticate(keyString string) (*auth.User, error) {
 	return nil, auth.ErrInvalidCredentials
 }
 
-func register(so socketio.Socket) (*sockets.ProbeSocket, error) {
+// authenticateProbeToken validates a probe registration token. The returned
+// user belongs to the org owning the probe and has no other privileges.
+func authenticateProbeToken(keyString string) (*auth.User, *m.ProbeToken, error) {
+	token, err := sqlstore.GetProbeTokenByToken(keyString)
+	if err == m.ErrProbeTokenNotFound {
+		return nil, nil, auth.ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &auth.User{ID: int(token.OrgId)}, token, nil
+}
+
+func register(so sockets.Transport) (*sockets.ProbeSocket, error) {
+	if sockets.ShuttingDown() {
+		return nil, sockets.ErrShuttingDown
+	}
 	req := so.Request()
 	req.ParseForm()
 	keyString := req.Form.Get("apiKey")
 
-	user, err := authenticate(keyString)
+	var user *auth.User
+	var token *m.ProbeToken
+	var err error
+	if strings.HasPrefix(keyString, m.ProbeTokenPrefix) {
+		user, token, err = authenticateProbeToken(keyString)
+	} else {
+		user, err = authenticate(keyString)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -70,17 +98,47 @@ func register(so socketio.Socket) (*sockets.ProbeSocket, error) {
 		return nil, err
 	}
 
-	//--------- set required version of probe.------------//
-	minVersion, _ := version.NewVersion("0.1.4")
-	if v.LessThan(minVersion) {
-		return nil, errors.New("invalid probe version. Please upgrade")
+	policy := sockets.Policy()
+	if err := policy.Allowed(v); err != nil {
+		return nil, err
+	}
+
+	capabilities, err := m.ParseProbeCapabilities(req.Form.Get("checkTypes"), req.Form.Get("ipVersions"), req.Form.Get("features"))
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := 0.0
+	if capacityStr := req.Form.Get("capacity"); capacityStr != "" {
+		capacity, err = strconv.ParseFloat(capacityStr, 64)
+		if err != nil || !(capacity >= 0) || math.IsInf(capacity, 0) {
+			return nil, errors.New("invalid capacity. Expected a positive number of checks per second")
+		}
+	}
+
+	// the revision of checks the probe has from a previous session.
+	var revision int64
+	if revisionStr := req.Form.Get("revision"); revisionStr != "" {
+		revision, err = strconv.ParseInt(revisionStr, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid revision")
+		}
 	}
 
 	log.Info("probe %s with version %s connected", name, v.String())
 
 	// lookup collector
-	probe, err := sqlstore.GetProbeByName(name, int64(user.ID))
-	if err == m.ErrProbeNotFound {
+	var probe *m.ProbeDTO
+	if token != nil {
+		// tokens are bound to a single probe, and cant be used to create new ones.
+		probe, err = sqlstore.GetProbeById(token.ProbeId, token.OrgId)
+		if err == nil && (probe.OrgId != token.OrgId || probe.Name != name) {
+			return nil, errors.New("probe token is not valid for this probe")
+		}
+	} else {
+		probe, err = sqlstore.GetProbeByName(name, int64(user.ID))
+	}
+	if err == m.ErrProbeNotFound && token == nil {
 		//check quotas
 		ctx := &middleware.Context{
 			User: user,
@@ -110,34 +168,55 @@ func register(so socketio.Socket) (*sockets.ProbeSocket, error) {
 		return nil, err
 	}
 	remoteIp := net.ParseIP(util.GetRemoteIp(so.Request()))
+	var location *probeLocation
 	if remoteIp == nil {
 		log.Error(3, "unable to lookup remote IP address of probeId=%d", probe.Id)
 		remoteIp = net.ParseIP("0.0.0.0")
-	} else if probe.Latitude == 0 || probe.Longitude == 0 {
-		var location freegeoip.DefaultQuery
-		err := geoipDB.Lookup(remoteIp, &location)
+	} else {
+		location, err = lookupLocation(remoteIp)
 		if err != nil {
 			log.Error(3, "unable to get location from IP.", err)
-		} else {
-			probe.Latitude = location.Location.Latitude
-			probe.Longitude = location.Location.Longitude
-			log.Debug("probe %s is located at lat:%f, long:%f", probe.Name, location.Location.Latitude, location.Location.Longitude)
-			log.Info("updating location data for probeId=%d,  lat:%f, long:%f", probe.Id, location.Location.Latitude, location.Location.Longitude)
-			if err := sqlstore.UpdateProbe(probe); err != nil {
-				log.Error(3, "could not save Probe location to DB.", err)
-				return nil, err
-			}
 		}
 	}
+	// manually set locations are never replaced by the lookup.
+	if location != nil && !probe.LocationOverride && (probe.Latitude == 0 || probe.Longitude == 0) {
+		probe.Latitude = location.Latitude
+		probe.Longitude = location.Longitude
+		log.Debug("probe %s is located at lat:%f, long:%f", probe.Name, location.Latitude, location.Longitude)
+		log.Info("updating location data for probeId=%d,  lat:%f, long:%f", probe.Id, location.Latitude, location.Longitude)
+		if err := sqlstore.UpdateProbeLocation(probe.Id, location.Latitude, location.Longitude); err != nil {
+			log.Error(3, "could not save Probe location to DB.", err)
+			return nil, err
+		}
+	}
+	if !capabilities.Equal(probe.Capabilities) {
+		log.Info("updating capabilities of probeId=%d", probe.Id)
+		if err := sqlstore.UpdateProbeCapabilities(probe.Id, capabilities); err != nil {
+			return nil, err
+		}
+		probe.Capabilities = capabilities
+	}
 	sess := &m.ProbeSession{
-		OrgId:      int64(user.ID),
-		ProbeId:    probe.Id,
-		SocketId:   so.Id(),
-		Version:    versionStr,
-		InstanceId: setting.InstanceId,
-		RemoteIp:   remoteIp.String(),
+		OrgId:        int64(user.ID),
+		ProbeId:      probe.Id,
+		SocketId:     so.Id(),
+		Version:      versionStr,
+		InstanceId:   setting.InstanceId,
+		RemoteIp:     remoteIp.String(),
+		Capabilities: capabilities,
+		Capacity:     capacity,
+	}
+	if token != nil {
+		sess.TokenId = token.Id
+	}
+	if location != nil {
+		sess.Country = location.Country
+		sess.City = location.City
+		sess.Asn = location.Asn
+		sess.AsnOrg = location.AsnOrg
 	}
 	sock := sockets.NewProbeSocket(user, probe, so, sess, heartbeatInterval)
+	sock.RestoreRevision(revision)
 
 	log.Info("probe %s with probeId=%d owned by %d authenticated successfully from %s.", name, probe.Id, user.ID, remoteIp.String())
 	if lastSocketId != "" {
@@ -149,6 +228,17 @@ func register(so socketio.Socket) (*sockets.ProbeSocket, error) {
 		//allow time for our change to propagate.
 		time.Sleep(time.Second)
 	}
+	if policy.Deprecated(v) {
+		log.Info("probeId=%d connected with deprecated version %s", probe.Id, v.String())
+		// deployed probes only report messages sent as errors, newer probes
+		// handle warnings.
+		msg := fmt.Sprintf("probe version %s is deprecated. Please upgrade", v.String())
+		for _, event := range []string{"error", "warning"} {
+			if err := so.Emit(event, msg); err != nil {
+				log.Error(3, "failed to send deprecation %s to probeId=%d. %s", event, probe.Id, err)
+			}
+		}
+	}
 	return sock, nil
 }
 
@@ -159,21 +249,28 @@ func InitCollectorController(pub services.MetricsEventsPublisher) {
 
 	sockets.InitCache(pub)
 
+	policy, err := sockets.NewVersionPolicy(setting.ProbeVersions)
+	if err != nil {
+		log.Fatal(4, "failed to load probe version policy.", err)
+	}
+	sockets.SetPolicy(policy)
+
 	channel := make(chan events.RawEvent, 100)
 	events.Subscribe("Endpoint.created", channel)
 	events.Subscribe("Endpoint.updated", channel)
 	events.Subscribe("Endpoint.deleted", channel)
 	events.Subscribe("ProbeSession.created", channel)
 	events.Subscribe("ProbeSession.deleted", channel)
+	events.Subscribe("ProbeSession.disconnect", channel)
+	events.Subscribe("ProbeSession.drained", channel)
 	events.Subscribe("Probe.updated", channel)
+	events.Subscribe("Probe.grantsUpdated", channel)
+	events.Subscribe("ProbeGroup.updated", channel)
+	events.Subscribe("Check.testRequested", channel)
+	events.Subscribe("Check.testCompleted", channel)
 	go eventConsumer(channel)
 
-	// init GEOIP DB.
-	var err error
-	geoipDB, err = freegeoip.OpenURL(freegeoip.MaxMindDB, time.Hour, time.Hour*6)
-	if err != nil {
-		log.Error(3, "failed to load GEOIP DB. ", err)
-	}
+	initGeoIP()
 
 	server, err = socketio.NewServer([]string{"websocket"})
 	if err != nil {
@@ -181,16 +278,11 @@ func InitCollectorController(pub services.MetricsEventsPublisher) {
 		return
 	}
 	server.On("connection", func(so socketio.Socket) {
-		sock, err := register(so)
+		conn, _ := so.Request().Context().Value(socketIOConnKey).(*hijackedConn)
+		transport := &socketIOTransport{Socket: so, conn: conn}
+		sock, err := connect(transport)
 		if err != nil {
-			if err == auth.ErrInvalidCredentials {
-				log.Info("probe failed to authenticate.")
-			} else if err.Error() == "invalid probe version. Please upgrade." {
-				log.Info("probeId is wrong version")
-			} else {
-				log.Error(3, "Failed to initialize probe.", err)
-			}
-			so.Emit("error", err.Error())
+			transport.Disconnect()
 			return
 		}
 		sock.Start()
@@ -202,6 +294,28 @@ func InitCollectorController(pub services.MetricsEventsPublisher) {
 
 }
 
+// connect registers a new probe connection. If the probe cant be registered
+// it is sent an error event.
+func connect(so sockets.Transport) (*sockets.ProbeSocket, error) {
+	sock, err := register(so)
+	if err != nil {
+		if err == auth.ErrInvalidCredentials {
+			log.Info("probe failed to authenticate.")
+		} else if err == sockets.ErrProbeVersionTooOld {
+			log.Info("probeId is wrong version")
+		} else if err == sockets.ErrShuttingDown {
+			log.Info("rejected probe connection while shutting down.")
+		} else {
+			log.Error(3, "Failed to initialize probe.", err)
+		}
+		so.Emit("error", err.Error())
+		return nil, err
+	}
+	return sock, nil
+}
+
+// ShutdownController hands the connected probes off to other instances. It
+// returns once they have reconnected or the deadline has passed.
 func ShutdownController() {
 	log.Info("shutting down collectorController")
 	sockets.Shutdown()
@@ -213,7 +327,81 @@ func SocketIO(c *middleware.Context) {
 		log.Fatal(4, "socket.io server not initialized.", nil)
 	}
 
-	server.ServeHTTP(c.Resp, c.Req.Request)
+	// the connection is recorded when it is hijacked by the websocket
+	// upgrade, so that the socket can be closed.
+	conn := &hijackedConn{ResponseWriter: c.Resp}
+	req := c.Req.Request.WithContext(context.WithValue(c.Req.Request.Context(), socketIOConnKey, conn))
+	server.ServeHTTP(conn, req)
+}
+
+type contextKey string
+
+const socketIOConnKey = contextKey("socketIOConn")
+
+// hijackedConn records the connection hijacked from the ResponseWriter.
+type hijackedConn struct {
+	http.ResponseWriter
+	sync.Mutex
+	conn net.Conn
+}
+
+func (h *hijackedConn) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	h.Lock()
+	h.conn = conn
+	h.Unlock()
+	return conn, rw, nil
+}
+
+func (h *hijackedConn) Close() error {
+	h.Lock()
+	conn := h.conn
+	h.Unlock()
+	if conn == nil {
+		return errors.New("connection was not hijacked")
+	}
+	return conn.Close()
+}
+
+// socketIOTransport adds Disconnect to socket.io sockets, which can not be
+// closed through the socket.io api. Closing the connection causes socket.io
+// to emit the disconnection event.
+type socketIOTransport struct {
+	socketio.Socket
+	conn *hijackedConn
+}
+
+func (s *socketIOTransport) Disconnect() {
+	if s.conn == nil {
+		log.Error(3, "unable to close socket.io connection %s, it was not recorded", s.Id())
+		return
+	}
+	if err := s.conn.Close(); err != nil {
+		log.Error(3, "failed to close socket.io connection %s. %s", s.Id(), err)
+	}
+}
+
+// ProbeWebSocket serves the versioned probe protocol over a plain websocket.
+func ProbeWebSocket(c *middleware.Context) {
+	ws, err := sockets.UpgradeWebSocket(c.Resp, c.Req.Request, heartbeatInterval)
+	if err != nil {
+		log.Info("failed to upgrade probe websocket. %s", err)
+		return
+	}
+	sock, err := connect(ws)
+	if err != nil {
+		ws.Disconnect()
+		return
+	}
+	sock.Start()
+	ws.Serve()
 }
 
 func HandleEndpointUpdated(event *events.EndpointUpdated) error {
@@ -252,7 +440,7 @@ func HandleEndpointUpdated(event *events.EndpointUpdated) error {
 		for _, probe := range probeIds {
 			seenProbes[probe] = struct{}{}
 			log.Debug("notifying probeId=%d about updated %s check for %s", probe, check.Type, event.Payload.Current.Slug)
-			if err := EmitCheckEvent(probe, check.Id, "updated", m.CheckWithSlug{Check: check, Slug: event.Payload.Current.Slug}); err != nil {
+			if err := EmitCheckEvent(probe, "updated", m.CheckWithSlug{Check: check, Slug: event.Payload.Current.Slug}); err != nil {
 				return err
 			}
 		}
@@ -264,7 +452,7 @@ func HandleEndpointUpdated(event *events.EndpointUpdated) error {
 		for _, probe := range oldProbes {
 			if _, ok := seenProbes[probe]; !ok {
 				log.Debug("%s check for %s should no longer be running on probeId=%d", check.Type, event.Payload.Current.Slug, probe)
-				if err := EmitCheckEvent(probe, check.Id, "removed", m.CheckWithSlug{Check: check, Slug: event.Payload.Last.Slug}); err != nil {
+				if err := EmitCheckEvent(probe, "removed", m.CheckWithSlug{Check: check, Slug: event.Payload.Last.Slug}); err != nil {
 					return err
 				}
 			}
@@ -278,7 +466,7 @@ func HandleEndpointUpdated(event *events.EndpointUpdated) error {
 		}
 		for _, probe := range probeIds {
 			log.Debug("notifying probeId=%d about new %s check for %s", probe, check.Type, event.Payload.Current.Slug)
-			if err := EmitCheckEvent(probe, check.Id, "created", m.CheckWithSlug{Check: check, Slug: event.Payload.Current.Slug}); err != nil {
+			if err := EmitCheckEvent(probe, "created", m.CheckWithSlug{Check: check, Slug: event.Payload.Current.Slug}); err != nil {
 				return err
 			}
 		}
@@ -292,7 +480,7 @@ func HandleEndpointUpdated(event *events.EndpointUpdated) error {
 			}
 			for _, probe := range oldProbes {
 				log.Debug("%s check for %s should no longer be running on probeId=%d", check.Type, event.Payload.Current.Slug, probe)
-				if err := EmitCheckEvent(probe, check.Id, "removed", m.CheckWithSlug{Check: check, Slug: event.Payload.Last.Slug}); err != nil {
+				if err := EmitCheckEvent(probe, "removed", m.CheckWithSlug{Check: check, Slug: event.Payload.Last.Slug}); err != nil {
 					return err
 				}
 			}
@@ -314,7 +502,7 @@ func HandleEndpointCreated(event *events.EndpointCreated) error {
 		}
 		for _, probe := range probeIds {
 			log.Debug("notifying probeId=%d about new %s check for %s", probe, check.Type, event.Payload.Slug)
-			if err := EmitCheckEvent(probe, check.Id, "created", m.CheckWithSlug{Check: check, Slug: event.Payload.Slug}); err != nil {
+			if err := EmitCheckEvent(probe, "created", m.CheckWithSlug{Check: check, Slug: event.Payload.Slug}); err != nil {
 				return err
 			}
 		}
@@ -335,7 +523,7 @@ func HandleEndpointDeleted(event *events.EndpointDeleted) error {
 		}
 		for _, probe := range probeIds {
 			log.Debug("notifying probeId=%d about deleted %s check for %s", probe, check.Type, event.Payload.Slug)
-			if err := EmitCheckEvent(probe, check.Id, "removed", m.CheckWithSlug{Check: check, Slug: event.Payload.Slug}); err != nil {
+			if err := EmitCheckEvent(probe, "removed", m.CheckWithSlug{Check: check, Slug: event.Payload.Slug}); err != nil {
 				return err
 			}
 		}
@@ -343,7 +531,7 @@ func HandleEndpointDeleted(event *events.EndpointDeleted) error {
 	return nil
 }
 
-func EmitCheckEvent(probeId int64, checkId int64, eventName string, event interface{}) error {
+func EmitCheckEvent(probeId int64, eventName string, check m.CheckWithSlug) error {
 	sessions, err := sqlstore.GetProbeSessions(probeId, "", time.Now().Add(-2*heartbeatInterval))
 	if err != nil {
 		log.Error(3, "failed to get list of probeSessions.", err)
@@ -354,21 +542,22 @@ func EmitCheckEvent(probeId int64, checkId int64, eventName string, event interf
 		return nil
 	}
 
-	log.Info(fmt.Sprintf("emitting %s event for CheckId %d to probeId:%d totalSessions: %d", eventName, checkId, probeId, totalSessions))
-	pos := checkId % totalSessions
-	if sessions[pos].InstanceId == setting.InstanceId {
-		v, _ := version.NewVersion(sessions[pos].Version)
-		newVer, _ := version.NewVersion("0.9.1")
-		if v.LessThan(newVer) {
-			if check, ok := event.(m.CheckWithSlug); ok {
-				monitor := m.MonitorDTOFromCheckWithSlug(check)
-				socketId := sessions[pos].SocketId
-				sockets.Emit(socketId, eventName, monitor)
-				return nil
-			}
+	log.Info(fmt.Sprintf("emitting %s event for CheckId %d to probeId:%d totalSessions: %d", eventName, check.Id, probeId, totalSessions))
+	sess, err := sockets.AssignedSession(probeId, check, sessions)
+	if err != nil {
+		log.Error(3, "failed to find the session of probeId:%d for CheckId %d. %s", probeId, check.Id, err)
+		return err
+	}
+	if sess == nil {
+		log.Debug("no session of probeId:%d can run CheckId %d", probeId, check.Id)
+		return nil
+	}
+	if sess.InstanceId == setting.InstanceId {
+		if !sockets.VersionHasFeature(sess.Version, sockets.FeatureCheckPayload) {
+			sockets.Emit(sess.SocketId, eventName, m.MonitorDTOFromCheckWithSlug(check))
+			return nil
 		}
-		socketId := sessions[pos].SocketId
-		sockets.Emit(socketId, eventName, event)
+		sockets.Emit(sess.SocketId, eventName, check)
 	}
 	return nil
 }
@@ -381,10 +570,116 @@ func HandleProbeSessionCreated(event *events.ProbeSessionCreated) error {
 
 func HandleProbeSessionDeleted(event *events.ProbeSessionDeleted) error {
 	log.Info("ProbeSessionDeleted from %s: ProbeId=%d", event.Payload.InstanceId, event.Payload.ProbeId)
+	if event.Payload.InstanceId == setting.InstanceId {
+		// sessions swept while the probe is still connected, eg. after the
+		// DB was unavailable, are closed so that the probe reconnects.
+		sockets.Disconnect(event.Payload.SocketId, "session expired")
+	}
 	sockets.Refresh(event.Payload.ProbeId)
 	return nil
 }
 
+func HandleProbeSessionDisconnect(event *events.ProbeSessionDisconnect) error {
+	if event.Payload.InstanceId != setting.InstanceId {
+		return nil
+	}
+	log.Info("ProbeSessionDisconnect: ProbeId=%d socketId=%s", event.Payload.ProbeId, event.Payload.SocketId)
+	sockets.Disconnect(event.Payload.SocketId, "session terminated by administrator")
+	return nil
+}
+
+func HandleProbeSessionDrained(event *events.ProbeSessionDrained) error {
+	log.Info("ProbeSessionDrained on %s: ProbeId=%d socketId=%s", event.Payload.InstanceId, event.Payload.ProbeId, event.Payload.SocketId)
+	if event.Payload.InstanceId == setting.InstanceId {
+		sockets.Drain(event.Payload.SocketId)
+	}
+	// move the checks of the drained session to its siblings.
+	sockets.Refresh(event.Payload.ProbeId)
+	return nil
+}
+
+func HandleCheckTestRequested(event *events.CheckTestRequested) error {
+	sockets.TestCheck(event.Payload.SocketId, event.Payload)
+	return nil
+}
+
+func HandleCheckTestCompleted(event *events.CheckTestCompleted) error {
+	checkTests.deliver(event.Payload)
+	return nil
+}
+
+// HandleProbeGrantsUpdated refreshes the sessions of a probe when the orgs
+// it is granted to change, as checks may have to be added or removed.
+func HandleProbeGrantsUpdated(event *events.ProbeGrantsUpdated) error {
+	log.Info("ProbeGrantsUpdated: ProbeId=%d orgId=%d", event.Payload.ProbeId, event.Payload.OrgId)
+	sockets.Refresh(event.Payload.ProbeId)
+	return nil
+}
+
+// HandleProbeGroupUpdated moves the checks routed to a group when its members
+// change. Probes that joined the group are sent the checks as created, and
+// probes that left are sent them as removed unless another route still
+// includes them.
+func HandleProbeGroupUpdated(event *events.ProbeGroupUpdated) error {
+	log.Debug("processing ProbeGroupUpdated event. GroupId: %d", event.Payload.Current.Id)
+	lastProbes := make(map[int64]struct{})
+	for _, id := range event.Payload.Last.Probes {
+		lastProbes[id] = struct{}{}
+	}
+	currentProbes := make(map[int64]struct{})
+	added := make([]int64, 0)
+	for _, id := range event.Payload.Current.Probes {
+		currentProbes[id] = struct{}{}
+		if _, ok := lastProbes[id]; !ok {
+			added = append(added, id)
+		}
+	}
+	removed := make([]int64, 0)
+	for id := range lastProbes {
+		if _, ok := currentProbes[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	checks, err := sqlstore.GetChecksForProbeGroup(event.Payload.Current.Id)
+	if err != nil {
+		return err
+	}
+	for _, check := range checks {
+		probeIds, err := sqlstore.GetProbesForCheck(&check.Check)
+		if err != nil {
+			return err
+		}
+		routed := make(map[int64]struct{})
+		for _, id := range probeIds {
+			routed[id] = struct{}{}
+		}
+		for _, probe := range added {
+			// probes the check can not run on are filtered out of the route.
+			if _, ok := routed[probe]; !ok {
+				continue
+			}
+			log.Debug("notifying probeId=%d about new %s check for %s", probe, check.Type, check.Slug)
+			if err := EmitCheckEvent(probe, "created", check); err != nil {
+				return err
+			}
+		}
+		for _, probe := range removed {
+			if _, ok := routed[probe]; ok {
+				continue
+			}
+			log.Debug("%s check for %s should no longer be running on probeId=%d", check.Type, check.Slug, probe)
+			if err := EmitCheckEvent(probe, "removed", check); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func HandleProbeUpdated(event *events.ProbeUpdated) error {
 	sockets.UpdateProbe(event.Payload.Current)
 
@@ -454,6 +749,26 @@ func eventConsumer(channel chan events.RawEvent) {
 					log.Error(3, "failed to emit ProbeSessionDeleted event.", err)
 				}
 				break
+			case "ProbeSession.disconnect":
+				event := events.ProbeSessionDisconnect{}
+				if err := json.Unmarshal(e.Body, &event.Payload); err != nil {
+					log.Error(3, "unable to unmarshal payload into ProbeSessionDisconnect event.", err)
+					break
+				}
+				if err := HandleProbeSessionDisconnect(&event); err != nil {
+					log.Error(3, "failed to handle ProbeSessionDisconnect event.", err)
+				}
+				break
+			case "ProbeSession.drained":
+				event := events.ProbeSessionDrained{}
+				if err := json.Unmarshal(e.Body, &event.Payload); err != nil {
+					log.Error(3, "unable to unmarshal payload into ProbeSessionDrained event.", err)
+					break
+				}
+				if err := HandleProbeSessionDrained(&event); err != nil {
+					log.Error(3, "failed to handle ProbeSessionDrained event.", err)
+				}
+				break
 			case "Probe.updated":
 				event := events.ProbeUpdated{}
 				if err := json.Unmarshal(e.Body, &event.Payload); err != nil {
@@ -464,6 +779,48 @@ func eventConsumer(channel chan events.RawEvent) {
 					log.Error(3, "failed to emit ProbeUpdated event.", err)
 				}
 				break
+			case "Probe.grantsUpdated":
+				event := events.ProbeGrantsUpdated{}
+				if err := json.Unmarshal(e.Body, &event.Payload); err != nil {
+					log.Error(3, "unable to unmarshal payload into ProbeGrantsUpdated event.", err)
+					break
+				}
+				if err := HandleProbeGrantsUpdated(&event); err != nil {
+					log.Error(3, "failed to handle ProbeGrantsUpdated event.", err)
+				}
+				break
+			case "ProbeGroup.updated":
+				event := events.ProbeGroupUpdated{}
+				if err := json.Unmarshal(e.Body, &event.Payload); err != nil {
+					log.Error(3, "unable to unmarshal payload into ProbeGroupUpdated event.", err)
+					break
+				}
+				UpdatesRecv.Inc()
+				if err := HandleProbeGroupUpdated(&event); err != nil {
+					log.Error(3, "failed to handle ProbeGroupUpdated event.", err)
+					// probes refresh every 5minutes, so the changes will still propagate.
+				}
+				break
+			case "Check.testRequested":
+				event := events.CheckTestRequested{}
+				if err := json.Unmarshal(e.Body, &event.Payload); err != nil {
+					log.Error(3, "unable to unmarshal payload into CheckTestRequested event.", err)
+					break
+				}
+				if err := HandleCheckTestRequested(&event); err != nil {
+					log.Error(3, "failed to handle CheckTestRequested event.", err)
+				}
+				break
+			case "Check.testCompleted":
+				event := events.CheckTestCompleted{}
+				if err := json.Unmarshal(e.Body, &event.Payload); err != nil {
+					log.Error(3, "unable to unmarshal payload into CheckTestCompleted event.", err)
+					break
+				}
+				if err := HandleCheckTestCompleted(&event); err != nil {
+					log.Error(3, "failed to handle CheckTestCompleted event.", err)
+				}
+				break
 			}
 		}(msg)
 	}
@@ -0,0 +1,224 @@
+package sockets
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sort"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+)
+
+// SessionForTest returns the session of a probe that runs a one-off test of a
+// check. Tested checks are not assigned to a session, so the session is chosen
+// by ranking the sessions for the given key. If all sessions are draining, nil
+// is returned.
+func SessionForTest(key int64, sessions []m.ProbeSession) *m.ProbeSession {
+	ranked := rankSessions(key, sessions)
+	if len(ranked) == 0 {
+		return nil
+	}
+	return ranked[0]
+}
+
+// AssignedSession returns the session of the probe that AssignChecks assigns
+// the check to, so that created, updated and removed events are sent to the
+// session that runs the check after the next refresh. Removed checks are
+// placed as if they were still enabled, to find the session that ran them.
+//
+// Checks only move between sessions when a session is over its capacity, so
+// the other checks of the probe are only loaded when sessions report their
+// capacity.
+func AssignedSession(probeId int64, check m.CheckWithSlug, sessions []m.ProbeSession) (*m.ProbeSession, error) {
+	var checks []m.CheckWithSlug
+	for _, sess := range sessions {
+		if sess.Capacity <= 0 {
+			continue
+		}
+		probe, err := sqlstore.GetProbeById(probeId, check.OrgId)
+		if err != nil {
+			return nil, err
+		}
+		checks, err = sqlstore.GetProbeCheckVersions(probe)
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	return sessionForCheck(check, checks, sessions), nil
+}
+
+// sessionForCheck returns the session the check is assigned to when it is
+// assigned along with the other checks of the probe.
+func sessionForCheck(check m.CheckWithSlug, checks []m.CheckWithSlug, sessions []m.ProbeSession) *m.ProbeSession {
+	check.Enabled = true
+	all := make([]m.CheckWithSlug, 0, len(checks)+1)
+	for _, c := range checks {
+		if c.Check.Id != check.Check.Id {
+			all = append(all, c)
+		}
+	}
+	all = append(all, check)
+	assignments := AssignChecks(all, sessions)
+	for i := range sessions {
+		for _, c := range assignments[sessions[i].SocketId].Checks {
+			if c.Check.Id == check.Check.Id {
+				return &sessions[i]
+			}
+		}
+	}
+	return nil
+}
+
+// rankSessions returns the sessions that are not draining, ordered from the
+// most to the least preferred session to run the check. Sessions are ranked
+// using rendezvous hashing, so when a session is added or removed only the
+// checks preferring that session move. When every session has reported its
+// capacity, scores are weighted by capacity so that each session is preferred
+// for a share of the checks proportional to its capacity.
+func rankSessions(checkId int64, sessions []m.ProbeSession) []*m.ProbeSession {
+	weighted := len(sessions) > 0
+	for _, sess := range sessions {
+		if sess.Draining {
+			continue
+		}
+		if sess.Capacity <= 0 {
+			weighted = false
+			break
+		}
+	}
+	ranked := make([]*m.ProbeSession, 0, len(sessions))
+	scores := make(map[*m.ProbeSession]float64, len(sessions))
+	for i := range sessions {
+		if sessions[i].Draining {
+			continue
+		}
+		weight := 1.0
+		if weighted {
+			weight = sessions[i].Capacity
+		}
+		ranked = append(ranked, &sessions[i])
+		scores[&sessions[i]] = sessionScore(checkId, sessions[i].SocketId, weight)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		return scores[ranked[i]] > scores[ranked[j]]
+	})
+	return ranked
+}
+
+// sessionScore returns the weighted rendezvous score of the session for the
+// check. For equal weights, the ordering of scores matches the ordering of the
+// hashes.
+func sessionScore(checkId int64, socketId string, weight float64) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(socketId))
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(checkId))
+	h.Write(b)
+	// map the hash to a float in the open interval (0,1)
+	u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// SessionAssignment is the set of checks assigned to a session.
+type SessionAssignment struct {
+	Checks []m.CheckWithSlug
+	// the number of checks executed per second.
+	Load float64
+}
+
+// CapableSessions returns the sessions that advertised the capabilities needed
+// to run the check.
+func CapableSessions(check *m.Check, sessions []m.ProbeSession) []m.ProbeSession {
+	capable := make([]m.ProbeSession, 0, len(sessions))
+	for _, sess := range sessions {
+		if sess.Capabilities.Supports(check) {
+			capable = append(capable, sess)
+		}
+	}
+	return capable
+}
+
+// AssignChecks splits the checks of a probe between its sessions. Each check
+// is only assigned to the sessions capable of running it, and is placed on
+// its most preferred session, so that the placement of a check does not depend
+// on the other checks. The load of a check is the number of times it is
+// executed per second. When the load placed on a session exceeds its reported
+// capacity, its least preferred checks spill to their next preferred session,
+// as long as that session has room for them. Checks never move further than
+// one session. The returned map is keyed by socketId.
+func AssignChecks(checks []m.CheckWithSlug, sessions []m.ProbeSession) map[string]*SessionAssignment {
+	type placement struct {
+		check  m.CheckWithSlug
+		ranked []*m.ProbeSession
+		load   float64
+		// index in ranked of the session the check is assigned to.
+		rank int
+	}
+
+	// every session assigns the checks itself, so they must be assigned in
+	// the same order each time.
+	sorted := make([]m.CheckWithSlug, len(checks))
+	copy(sorted, checks)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Check.Id < sorted[j].Check.Id
+	})
+	placements := make([]*placement, 0, len(sorted))
+	loads := make(map[string]float64)
+	for _, check := range sorted {
+		if !check.Enabled {
+			continue
+		}
+		ranked := rankSessions(check.Check.Id, CapableSessions(&check.Check, sessions))
+		if len(ranked) == 0 {
+			continue
+		}
+		p := &placement{check: check, ranked: ranked, load: checkLoad(&check.Check)}
+		loads[ranked[0].SocketId] += p.load
+		placements = append(placements, p)
+	}
+
+	// spill the least preferred checks of each session first.
+	spill := make([]*placement, len(placements))
+	copy(spill, placements)
+	sort.SliceStable(spill, func(i, j int) bool {
+		a, b := spill[i].ranked[0].SocketId, spill[j].ranked[0].SocketId
+		if a != b {
+			return a < b
+		}
+		return sessionScore(spill[i].check.Check.Id, a, 1) < sessionScore(spill[j].check.Check.Id, b, 1)
+	})
+	for _, p := range spill {
+		home := p.ranked[0]
+		if home.Capacity <= 0 || loads[home.SocketId] <= home.Capacity || len(p.ranked) < 2 {
+			continue
+		}
+		next := p.ranked[1]
+		if next.Capacity > 0 && loads[next.SocketId]+p.load > next.Capacity {
+			continue
+		}
+		loads[home.SocketId] -= p.load
+		loads[next.SocketId] += p.load
+		p.rank = 1
+	}
+
+	assignments := make(map[string]*SessionAssignment)
+	for _, sess := range sessions {
+		assignments[sess.SocketId] = &SessionAssignment{Checks: make([]m.CheckWithSlug, 0)}
+	}
+	for _, p := range placements {
+		a := assignments[p.ranked[p.rank].SocketId]
+		a.Checks = append(a.Checks, p.check)
+		a.Load += p.load
+	}
+	return assignments
+}
+
+// checkLoad returns the number of times the check is executed per second.
+func checkLoad(check *m.Check) float64 {
+	if check.Frequency <= 0 {
+		return 0
+	}
+	return 1 / float64(check.Frequency)
+}
@@ -0,0 +1,218 @@
+package sockets
+
+import (
+	"fmt"
+	"testing"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRendezvousAssignment(t *testing.T) {
+	sessions := make([]m.ProbeSession, 0)
+	for i := 0; i < 4; i++ {
+		sessions = append(sessions, m.ProbeSession{SocketId: fmt.Sprintf("socket%d", i)})
+	}
+	numChecks := int64(1000)
+	checks := make([]m.CheckWithSlug, 0, numChecks)
+	for id := int64(1); id <= numChecks; id++ {
+		checks = append(checks, m.CheckWithSlug{Check: m.Check{Id: id, Type: m.PING_CHECK, Frequency: 60, Enabled: true}})
+	}
+	assign := func(sessions []m.ProbeSession) map[int64]string {
+		assigned := make(map[int64]string)
+		for socketId, a := range AssignChecks(checks, sessions) {
+			for _, c := range a.Checks {
+				assigned[c.Id] = socketId
+			}
+		}
+		return assigned
+	}
+
+	Convey("When assigning checks to sessions", t, func() {
+		before := assign(sessions)
+		Convey("every session should be assigned checks", func() {
+			counts := make(map[string]int)
+			for _, socketId := range before {
+				counts[socketId]++
+			}
+			So(len(counts), ShouldEqual, len(sessions))
+		})
+		Convey("the order of sessions should not matter", func() {
+			reversed := make([]m.ProbeSession, len(sessions))
+			for i, s := range sessions {
+				reversed[len(sessions)-1-i] = s
+			}
+			So(assign(reversed), ShouldResemble, before)
+		})
+		Convey("removing a session should only move its checks", func() {
+			after := assign(sessions[1:])
+			for id, socketId := range before {
+				if socketId != "socket0" {
+					So(after[id], ShouldEqual, socketId)
+				}
+			}
+		})
+		Convey("adding a session should only move checks to the new session", func() {
+			after := assign(append(sessions, m.ProbeSession{SocketId: "socket4"}))
+			moved := 0
+			for id, socketId := range before {
+				if after[id] != socketId {
+					So(after[id], ShouldEqual, "socket4")
+					moved++
+				}
+			}
+			So(moved, ShouldBeLessThan, numChecks/3)
+		})
+	})
+	Convey("When there are no sessions", t, func() {
+		So(SessionForTest(1, nil), ShouldBeNil)
+		So(sessionForCheck(checks[0], checks, nil), ShouldBeNil)
+	})
+}
+
+func TestSessionForCheck(t *testing.T) {
+	Convey("When sessions report different capabilities and capacities", t, func() {
+		sessions := []m.ProbeSession{
+			{SocketId: "a", Capacity: 0.5, Capabilities: &m.ProbeCapabilities{CheckTypes: []m.CheckType{m.PING_CHECK}}},
+			{SocketId: "b", Capacity: 0.5},
+			{SocketId: "c", Capacity: 5},
+		}
+		checks := make([]m.CheckWithSlug, 0)
+		for i := int64(1); i <= 100; i++ {
+			checkType := m.PING_CHECK
+			if i%3 == 0 {
+				checkType = m.HTTP_CHECK
+			}
+			checks = append(checks, m.CheckWithSlug{Check: m.Check{Id: i, Type: checkType, Frequency: 10, Enabled: true}})
+		}
+		assignments := AssignChecks(checks, sessions)
+		Convey("events should be sent to the session a refresh assigns the check to", func() {
+			for socketId, a := range assignments {
+				for _, c := range a.Checks {
+					So(sessionForCheck(c, checks, sessions).SocketId, ShouldEqual, socketId)
+				}
+			}
+		})
+		Convey("removed checks should be sent to the session that ran them", func() {
+			removed := checks[0]
+			removed.Enabled = false
+			sess := sessionForCheck(removed, checks[1:], sessions)
+			So(sess, ShouldNotBeNil)
+			found := false
+			for _, c := range assignments[sess.SocketId].Checks {
+				found = found || c.Id == removed.Id
+			}
+			So(found, ShouldBeTrue)
+		})
+	})
+}
+
+func TestAssignChecks(t *testing.T) {
+	Convey("When sessions of a probe advertise different capabilities", t, func() {
+		sessions := []m.ProbeSession{
+			{SocketId: "ping", Capabilities: &m.ProbeCapabilities{CheckTypes: []m.CheckType{m.PING_CHECK}}},
+			{SocketId: "http", Capabilities: &m.ProbeCapabilities{CheckTypes: []m.CheckType{m.HTTP_CHECK}}},
+		}
+		checks := make([]m.CheckWithSlug, 0)
+		for i := int64(1); i <= 20; i++ {
+			checkType := m.PING_CHECK
+			if i%2 == 0 {
+				checkType = m.HTTP_CHECK
+			}
+			checks = append(checks, m.CheckWithSlug{Check: m.Check{Id: i, Type: checkType, Frequency: 60, Enabled: true}})
+		}
+		checks = append(checks, m.CheckWithSlug{Check: m.Check{Id: 21, Type: m.DNS_CHECK, Frequency: 60, Enabled: true}})
+
+		assignments := AssignChecks(checks, sessions)
+		Convey("each check should only be assigned to a capable session", func() {
+			So(len(assignments["ping"].Checks), ShouldEqual, 10)
+			for _, c := range assignments["ping"].Checks {
+				So(c.Type, ShouldEqual, m.PING_CHECK)
+			}
+			So(len(assignments["http"].Checks), ShouldEqual, 10)
+			for _, c := range assignments["http"].Checks {
+				So(c.Type, ShouldEqual, m.HTTP_CHECK)
+			}
+		})
+	})
+}
+
+func TestAssignChecksCapacity(t *testing.T) {
+	checks := func(count int, frequency int64) []m.CheckWithSlug {
+		result := make([]m.CheckWithSlug, 0, count)
+		for i := 1; i <= count; i++ {
+			result = append(result, m.CheckWithSlug{Check: m.Check{Id: int64(i), Type: m.PING_CHECK, Frequency: frequency, Enabled: true}})
+		}
+		return result
+	}
+	Convey("When sessions report their capacity", t, func() {
+		sessions := []m.ProbeSession{
+			{SocketId: "small", Capacity: 0.25},
+			{SocketId: "large", Capacity: 10},
+		}
+		assignments := AssignChecks(checks(60, 10), sessions)
+		Convey("no session should be assigned more than its capacity", func() {
+			So(assignments["small"].Load, ShouldBeLessThanOrEqualTo, 0.25)
+			So(len(assignments["small"].Checks)+len(assignments["large"].Checks), ShouldEqual, 60)
+		})
+		Convey("the load should be the number of checks per second", func() {
+			So(assignments["large"].Load, ShouldAlmostEqual, float64(len(assignments["large"].Checks))/10, 0.0001)
+		})
+		Convey("the order of the checks should not matter", func() {
+			reversed := checks(60, 10)
+			for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+				reversed[i], reversed[j] = reversed[j], reversed[i]
+			}
+			So(AssignChecks(reversed, sessions)["small"].Checks, ShouldResemble, assignments["small"].Checks)
+		})
+	})
+	Convey("When the checks exceed the capacity of every session", t, func() {
+		sessions := []m.ProbeSession{
+			{SocketId: "a", Capacity: 0.1},
+			{SocketId: "b", Capacity: 0.1},
+		}
+		assignments := AssignChecks(checks(10, 10), sessions)
+		Convey("every check should stay on its preferred session", func() {
+			So(len(assignments["a"].Checks)+len(assignments["b"].Checks), ShouldEqual, 10)
+			for socketId, a := range assignments {
+				for _, c := range a.Checks {
+					So(rankSessions(c.Id, sessions)[0].SocketId, ShouldEqual, socketId)
+				}
+			}
+		})
+	})
+	Convey("When a session is over its capacity", t, func() {
+		sessions := []m.ProbeSession{
+			{SocketId: "a", Capacity: 1},
+			{SocketId: "b", Capacity: 1},
+			{SocketId: "c", Capacity: 10},
+		}
+		assignments := AssignChecks(checks(100, 10), sessions)
+		Convey("checks should only spill to their next preferred session", func() {
+			for socketId, a := range assignments {
+				for _, c := range a.Checks {
+					ranked := rankSessions(c.Id, sessions)
+					So(socketId, ShouldBeIn, []string{ranked[0].SocketId, ranked[1].SocketId})
+				}
+			}
+		})
+		Convey("adding a session should only move its share of the checks", func() {
+			after := AssignChecks(checks(100, 10), append(sessions, m.ProbeSession{SocketId: "d", Capacity: 10}))
+			before := make(map[int64]string)
+			for socketId, a := range assignments {
+				for _, c := range a.Checks {
+					before[c.Id] = socketId
+				}
+			}
+			moved := 0
+			for socketId, a := range after {
+				for _, c := range a.Checks {
+					if before[c.Id] != socketId {
+						moved++
+					}
+				}
+			}
+			So(moved, ShouldBeLessThan, 60)
+		})
+	})
+}
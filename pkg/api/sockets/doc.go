@@ -0,0 +1,39 @@
+// Package sockets manages the connections of probes, and the checks and
+// results exchanged with them over socket.io or the versioned probe protocol.
+//
+// # Probe protocol
+//
+// Every frame is a JSON encoded Message. Probes connect with the same query
+// parameters used for socket.io (apiKey, name, version, ...) plus
+// protocol=1. The messages exchanged are:
+//
+//   - handshake: "ready" is sent once the probe is registered, or "error"
+//     followed by the connection being closed. When the probe version is
+//     deprecated, the message is sent before "ready" as both an "error", for
+//     probes that predate warnings, and a "warning". The connection stays
+//     open, and the probe should only report the message.
+//   - check sync: "refresh", "sync", "created", "updated" and "removed" are
+//     sent by the server, "syncAck" by the probe. Probes with incremental
+//     refreshes are only sent "sync", and can connect with the revision=
+//     parameter set to the last revision they applied to only be sent the
+//     changes since then.
+//   - results: "results" carries metrics from the probe. "resultBatch" carries
+//     metrics with a sequence number that is acknowledged with "resultAck"
+//     once accepted by the publisher. "pause" and "resume" tell the probe to
+//     stop and restart sending results while the server is backed up, or
+//     while the session is over its result rate limit.
+//   - health: "health" carries the runtime stats of the probe, and should be
+//     sent every 10 seconds.
+//   - events: "event" carries probe events, "testCheck" and "testCheckResult"
+//     one-off check executions, and "drained" tells the probe it can exit.
+//   - shutdown: "reconnect" asks the probe to close the connection and
+//     reconnect, to the given url if set, after waiting the given backoff. It
+//     is only sent to versions with the reconnect feature.
+//   - acks: every probe message with a non zero Seq is acknowledged with an
+//     "ack" message carrying the same Seq once it has been processed.
+//     Messages are processed in the order they are sent.
+//   - heartbeats: "heartbeat" messages are sent by the probe at least every
+//     heartbeat interval and echoed by the server as soon as they are read,
+//     while other messages are still being processed. Connections that are
+//     idle for 3 heartbeat intervals are closed.
+package sockets
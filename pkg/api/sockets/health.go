@@ -0,0 +1,129 @@
+package sockets
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	"github.com/raintank/worldping-api/pkg/setting"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	healthReports     = stats.NewCounter32("api.probes.health.reports")
+	sessionsDegraded  = stats.NewCounter32("api.probes.health.degraded")
+	sessionsRecovered = stats.NewCounter32("api.probes.health.recovered")
+)
+
+// probes are expected to report their health at this interval, in seconds.
+const healthInterval = 10
+
+// OnHealth stores the health reported by the probe as the latest snapshot of
+// the session, and publishes it as metrics in the org owning the probe. The
+// session is degraded while the health exceeds any configured threshold.
+func (p *ProbeSocket) OnHealth(health *m.ProbeHealth) {
+	if health == nil || p.isClosed() {
+		return
+	}
+	healthReports.Inc()
+	now := time.Now()
+	if health.Timestamp.IsZero() {
+		health.Timestamp = now
+	}
+	reasons := degradedReasons(health)
+
+	p.Lock()
+	wasDegraded := p.Session.Degraded
+	p.Session.Health = health
+	p.Session.Degraded = len(reasons) > 0
+	p.Session.DegradedReasons = reasons
+	if !p.Session.Degraded {
+		p.Session.DegradedSince = time.Time{}
+	} else if !wasDegraded {
+		p.Session.DegradedSince = now
+	}
+	session := *p.Session
+	p.Unlock()
+
+	if session.Degraded && !wasDegraded {
+		sessionsDegraded.Inc()
+		log.Info("probeId=%d socketId=%s is degraded. %s", p.Probe.Id, session.SocketId, strings.Join(reasons, ", "))
+	} else if !session.Degraded && wasDegraded {
+		sessionsRecovered.Inc()
+		log.Info("probeId=%d socketId=%s is no longer degraded", p.Probe.Id, session.SocketId)
+	}
+	if err := sqlstore.UpdateProbeSessionHealth(&session); err != nil {
+		log.Error(3, "failed to store health of probeId=%d socketId=%s err=%s", p.Probe.Id, session.SocketId, err)
+	}
+	results.add(&queuedResults{metrics: p.healthMetrics(health, session.Degraded, now)}, 0)
+}
+
+// degradedReasons returns the thresholds exceeded by the health.
+func degradedReasons(health *m.ProbeHealth) []string {
+	t := setting.ProbeHealth
+	reasons := make([]string, 0)
+	if t.MaxCheckLag > 0 && health.CheckLag > t.MaxCheckLag.Seconds() {
+		reasons = append(reasons, fmt.Sprintf("check lag %.1fs exceeds %s", health.CheckLag, t.MaxCheckLag))
+	}
+	if t.MaxQueueDepth > 0 && health.QueueDepth > t.MaxQueueDepth {
+		reasons = append(reasons, fmt.Sprintf("queue depth %d exceeds %d", health.QueueDepth, t.MaxQueueDepth))
+	}
+	if t.MaxCpu > 0 && health.Cpu > t.MaxCpu {
+		reasons = append(reasons, fmt.Sprintf("cpu %.1f%% exceeds %.1f%%", health.Cpu, t.MaxCpu))
+	}
+	if t.MaxMemory > 0 && health.Memory > t.MaxMemory {
+		reasons = append(reasons, fmt.Sprintf("memory %dMB exceeds %dMB", health.Memory/1024/1024, t.MaxMemory/1024/1024))
+	}
+	if t.MaxFailedChecks > 0 {
+		var failed int64
+		for _, count := range health.FailedChecks {
+			failed += count
+		}
+		if failed > t.MaxFailedChecks {
+			reasons = append(reasons, fmt.Sprintf("%d failed checks exceeds %d", failed, t.MaxFailedChecks))
+		}
+	}
+	return reasons
+}
+
+// healthMetrics converts the health to metrics named
+// worldping.probes.<probe slug>.health.<metric>. Metrics are timestamped with
+// the server clock so that they are not affected by clock drift of the probe.
+func (p *ProbeSocket) healthMetrics(health *m.ProbeHealth, degraded bool, now time.Time) []*schema.MetricData {
+	values := map[string]float64{
+		"checkLag":   health.CheckLag,
+		"queueDepth": float64(health.QueueDepth),
+		"cpu":        health.Cpu,
+		"memory":     float64(health.Memory),
+		"degraded":   0,
+	}
+	if degraded {
+		values["degraded"] = 1
+	}
+	for checkType, count := range health.FailedChecks {
+		if _, ok := checkMetrics[checkType]; !ok {
+			continue
+		}
+		values["failedChecks."+strings.ToLower(string(checkType))] = float64(count)
+	}
+	metrics := make([]*schema.MetricData, 0, len(values))
+	for name, value := range values {
+		metric := &schema.MetricData{
+			Name:     fmt.Sprintf("worldping.probes.%s.health.%s", p.Probe.Slug, name),
+			Metric:   fmt.Sprintf("worldping.probes.%s.health.%s", p.Probe.Slug, name),
+			Interval: healthInterval,
+			OrgId:    int(p.Probe.OrgId),
+			Value:    value,
+			Time:     now.Unix(),
+			Mtype:    "gauge",
+			Tags:     []string{"probe:" + p.Probe.Slug},
+		}
+		metric.SetId()
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
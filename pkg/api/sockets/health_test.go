@@ -0,0 +1,66 @@
+package sockets
+
+import (
+	"testing"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/setting"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDegradedReasons(t *testing.T) {
+	saved := setting.ProbeHealth
+	defer func() { setting.ProbeHealth = saved }()
+	setting.ProbeHealth.MaxCheckLag = time.Second * 30
+	setting.ProbeHealth.MaxQueueDepth = 100
+	setting.ProbeHealth.MaxCpu = 90
+	setting.ProbeHealth.MaxMemory = 0
+	setting.ProbeHealth.MaxFailedChecks = 10
+
+	Convey("Given the health of a probe", t, func() {
+		health := &m.ProbeHealth{
+			CheckLag:     1,
+			QueueDepth:   10,
+			Cpu:          50,
+			Memory:       1024 * 1024 * 1024 * 10,
+			FailedChecks: map[m.CheckType]int64{m.HTTP_CHECK: 2, m.PING_CHECK: 3},
+		}
+		Convey("within the thresholds it should not be degraded", func() {
+			So(degradedReasons(health), ShouldBeEmpty)
+		})
+		Convey("exceeding thresholds it should be degraded", func() {
+			health.CheckLag = 45
+			health.Cpu = 95
+			So(len(degradedReasons(health)), ShouldEqual, 2)
+		})
+		Convey("failed checks of all types should be added up", func() {
+			health.FailedChecks[m.DNS_CHECK] = 6
+			So(len(degradedReasons(health)), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestHealthMetrics(t *testing.T) {
+	Convey("Given the health of a probe", t, func() {
+		sock := NewProbeSocket(nil, &m.ProbeDTO{Id: 1, OrgId: 3, Slug: "probe1"}, &mockTransport{}, &m.ProbeSession{SocketId: "mock"}, time.Second)
+		health := &m.ProbeHealth{
+			CheckLag:     1,
+			FailedChecks: map[m.CheckType]int64{m.HTTP_CHECK: 2, "bogus": 3},
+		}
+		metrics := sock.healthMetrics(health, true, time.Now())
+		byName := make(map[string]float64)
+		for _, metric := range metrics {
+			So(metric.OrgId, ShouldEqual, 3)
+			byName[metric.Name] = metric.Value
+		}
+		Convey("metrics should be named after the probe", func() {
+			So(byName["worldping.probes.probe1.health.checkLag"], ShouldEqual, 1)
+			So(byName["worldping.probes.probe1.health.degraded"], ShouldEqual, 1)
+			So(byName["worldping.probes.probe1.health.failedChecks.http"], ShouldEqual, 2)
+		})
+		Convey("unknown check types should be ignored", func() {
+			So(len(metrics), ShouldEqual, 6)
+		})
+	})
+}
@@ -2,17 +2,18 @@ package sockets
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
-	socketio "github.com/googollee/go-socket.io"
 	"github.com/grafana/metrictank/stats"
-	"github.com/hashicorp/go-version"
 	"github.com/raintank/tsdb-gw/auth"
+	"github.com/raintank/worldping-api/pkg/events"
 	"github.com/raintank/worldping-api/pkg/log"
 	m "github.com/raintank/worldping-api/pkg/models"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	"github.com/raintank/worldping-api/pkg/setting"
 	"github.com/raintank/worldping-api/pkg/util"
 	schemaV0 "gopkg.in/raintank/schema.v0"
 	"gopkg.in/raintank/schema.v1"
@@ -23,20 +24,57 @@ var (
 	metricsRecvd    = stats.NewCounter32("api.probes.metrics-recv")
 )
 
+// Transport is the connection between a ProbeSocket and the probe. It is
+// implemented by socket.io sockets and by WebSocket.
+type Transport interface {
+	Id() string
+	Request() *http.Request
+	On(event string, f interface{}) error
+	Emit(event string, args ...interface{}) error
+	// Disconnect closes the connection to the probe.
+	Disconnect()
+}
+
 type ProbeSocket struct {
 	sync.Mutex
 	*auth.User
-	Probe             *m.ProbeDTO
-	Socket            socketio.Socket
-	Session           *m.ProbeSession
-	closed            bool
-	done              chan struct{}
-	lastRefresh       time.Time
-	refreshing        bool
+	Probe       *m.ProbeDTO
+	Socket      Transport
+	Session     *m.ProbeSession
+	closed      bool
+	done        chan struct{}
+	lastRefresh time.Time
+	// closed when the running refresh completes. nil if no refresh is running.
+	refreshDone       chan struct{}
 	heartbeatInterval time.Duration
+
+	// state of incremental refreshes. syncRevision and syncChecks are the
+	// last revision sent, probeRevision the last revision the probe applied.
+	// syncChanges is the number of revisions stored as changes since the
+	// last revision stored with all checks, created at syncFullAt. syncLock
+	// serializes the syncs sent to the probe.
+	syncLock      sync.Mutex
+	syncRevision  int64
+	syncChecks    map[int64]m.SyncedCheck
+	syncChanges   int
+	syncFullAt    time.Time
+	probeRevision int64
+
+	// sequence numbers of result batches waiting to be published, and of
+	// the batches recently acked.
+	resultsPending map[int64]bool
+	resultsAcked   map[int64]bool
+	ackedSeqs      []int64
+
+	// checks the session accepts results for, keyed by org, endpoint slug
+	// and check type, and the state of the result rate limit.
+	assigned    map[string]*assignedCheck
+	rateWindow  time.Time
+	rateCount   int
+	rateLimited bool
 }
 
-func NewProbeSocket(user *auth.User, probe *m.ProbeDTO, so socketio.Socket, session *m.ProbeSession, heartbeatInterval time.Duration) *ProbeSocket {
+func NewProbeSocket(user *auth.User, probe *m.ProbeDTO, so Transport, session *m.ProbeSession, heartbeatInterval time.Duration) *ProbeSocket {
 	return &ProbeSocket{
 		User:              user,
 		Probe:             probe,
@@ -77,10 +115,12 @@ func (p *ProbeSocket) Remove() error {
 func (p *ProbeSocket) OnDisconnection() {
 	p.Lock()
 	defer p.Unlock()
-	if !p.closed {
-		p.closed = true
-		close(p.done)
+	if p.closed {
+		// the session was already removed by Disconnect.
+		return
 	}
+	p.closed = true
+	close(p.done)
 	log.Info("probeId=%d (%s) disconnected. socketId=%s", p.Probe.Id, p.Probe.Name, p.Session.SocketId)
 	Remove(p.Session.SocketId)
 	if err := p.Remove(); err != nil {
@@ -88,16 +128,103 @@ func (p *ProbeSocket) OnDisconnection() {
 	}
 }
 
+// Disconnect terminates the session. The probe is sent the reason as an error
+// event, then the connection is closed and the session removed without
+// waiting for the probe to disconnect.
+func (p *ProbeSocket) Disconnect(reason string) {
+	log.Info("disconnecting probeId=%d socketId=%s. %s", p.Probe.Id, p.Session.SocketId, reason)
+	if err := p.emit("error", reason); err != nil {
+		log.Error(3, "failed to send error event to probeId=%d socketId=%s err=%s", p.Probe.Id, p.Session.SocketId, err)
+	}
+	p.Socket.Disconnect()
+	p.OnDisconnection()
+}
+
+// Drain stops checks being assigned to the session. Once the session has been
+// refreshed with an empty list of checks, the probe is sent a drained event so
+// that it can exit cleanly.
+func (p *ProbeSocket) Drain() {
+	p.Lock()
+	p.Session.Draining = true
+	p.Unlock()
+	// a refresh that was already running may have assigned checks to the
+	// session before it was draining, so refresh again once it completes.
+	for running := p.refresh(); running != nil; running = p.refresh() {
+		<-running
+	}
+	log.Info("sending drained event to probeId=%d socketId=%s", p.Probe.Id, p.Session.SocketId)
+	if err := p.emit("drained", p.Session.SocketId); err != nil {
+		log.Error(3, "failed to send drained event to probeId=%d socketId=%s err=%s", p.Probe.Id, p.Session.SocketId, err)
+	}
+}
+
+// Reconnect asks the probe to connect to another instance. The session is
+// removed once the probe disconnects.
+func (p *ProbeSocket) Reconnect(r *Reconnect) error {
+	log.Info("sending reconnect to probeId=%d socketId=%s url=%s backoff=%.1fs", p.Probe.Id, p.Session.SocketId, r.Url, r.Backoff)
+	ReconnectsSent.Inc()
+	return p.emit("reconnect", r)
+}
+
+// TestCheck asks the probe to execute a check once.
+func (p *ProbeSocket) TestCheck(req *m.CheckTestRequest) error {
+	log.Info("sending testCheck request %s to probeId=%d socketId=%s", req.RequestId, p.Probe.Id, p.Session.SocketId)
+	return p.emit("testCheck", req)
+}
+
+// OnTestCheckResult publishes the result of a testCheck request so that it
+// reaches the instance waiting for it.
+func (p *ProbeSocket) OnTestCheckResult(result *m.CheckTestResult) {
+	if result == nil || p.isClosed() {
+		return
+	}
+	log.Debug("received testCheck result %s from probeId=%d", result.RequestId, p.Probe.Id)
+	result.ProbeId = p.Probe.Id
+	err := events.Publish(&events.CheckTestCompleted{
+		Ts:      time.Now(),
+		Payload: result,
+	}, 0)
+	if err != nil {
+		log.Error(3, "failed to publish testCheck result for probeId=%d err=%s", p.Probe.Id, err)
+	}
+}
+
+func (p *ProbeSocket) isClosed() bool {
+	p.Lock()
+	closed := p.closed
+	p.Unlock()
+	return closed
+}
+
 func (p *ProbeSocket) OnEvent(msg *schema.ProbeEvent) {
+	if msg == nil || p.isClosed() {
+		return
+	}
 	log.Debug("received event from probeId=%d", p.Probe.Id)
 	if !p.Probe.Public {
-		msg.OrgId = int64(p.User.ID)
+		msg.OrgId = p.eventOrgId(msg)
 	}
 	publisher.AddEvent(msg)
 }
 
-func (p *ProbeSocket) OnResults(results []*schemaV0.MetricData) {
-	metricsRecvd.Add(len(results))
+// OnResults queues results that dont need to be acknowledged. While the
+// result queue is full this blocks for up to the queue timeout, then drops
+// the results.
+func (p *ProbeSocket) OnResults(metrics []*schemaV0.MetricData) {
+	if p.isClosed() {
+		return
+	}
+	metricsRecvd.Add(len(metrics))
+	metrics = p.validateResults(metrics)
+	if len(metrics) == 0 {
+		return
+	}
+	if !results.add(&queuedResults{metrics: p.convertResults(metrics)}, setting.ProbeResults.QueueTimeout) {
+		log.Debug("result queue full, dropped %d results from probeId=%d", len(metrics), p.Probe.Id)
+	}
+}
+
+func (p *ProbeSocket) convertResults(results []*schemaV0.MetricData) []*schema.MetricData {
 	metrics := make([]*schema.MetricData, len(results))
 	for i, m := range results {
 		metrics[i] = &schema.MetricData{
@@ -112,35 +239,41 @@ func (p *ProbeSocket) OnResults(results []*schemaV0.MetricData) {
 			Tags:     m.Tags,
 		}
 		metrics[i].SetId()
-
-		if !p.Probe.Public {
-			metrics[i].OrgId = p.User.ID
-		}
 	}
-	publisher.Add(metrics)
+	return metrics
 }
 
 func (p *ProbeSocket) Refresh() {
+	p.refresh()
+}
+
+// refresh sends the checks to the probe, unless a refresh is already running.
+// In that case the returned channel is closed once the running refresh
+// completes, otherwise nil is returned.
+func (p *ProbeSocket) refresh() <-chan struct{} {
 	p.Lock()
 	if p.closed {
 		p.Unlock()
 		log.Info("Refresh called on closed session for probeId=%d socketId=%s.", p.Probe.Id, p.Session.SocketId)
-		return
+		return nil
 	}
 	pre := time.Now()
-	refreshInProgress := p.refreshing
-	if !refreshInProgress {
-		p.refreshing = true
+	running := p.refreshDone
+	if running == nil {
+		p.refreshDone = make(chan struct{})
 		p.lastRefresh = pre
+		// persisted with the next heartbeat.
+		p.Session.LastRefresh = pre
 	}
 	p.Unlock()
-	if refreshInProgress {
+	if running != nil {
 		log.Info("probeId=%d (%s) ignoring refresh request as one is already running", p.Probe.Id, p.Probe.Name)
-		return
+		return running
 	}
 	defer func() {
 		p.Lock()
-		p.refreshing = false
+		close(p.refreshDone)
+		p.refreshDone = nil
 		p.Unlock()
 	}()
 	log.Info("sending refresh to probe. probeId=%d socketId=%s", p.Probe.Id, p.Session.SocketId)
@@ -148,46 +281,50 @@ func (p *ProbeSocket) Refresh() {
 	sessions, err := sqlstore.GetProbeSessions(p.Probe.Id, "", time.Now().Add(-2*p.heartbeatInterval))
 	if err != nil {
 		log.Error(3, "failed to get list of probeSessions for probeId=%d err=%s", p.Probe.Id, err)
-		return
+		return nil
 	}
 
 	totalSessions := int64(len(sessions))
 	if totalSessions == 0 {
 		log.Error(3, "probeId=%d no probeSessions found when running refresh", p.Probe.Id)
-		return
+		return nil
 	}
 	log.Debug("probeId=%d has %d sessions", p.Probe.Id, totalSessions)
 	//step 2. for each session
-	for pos, sess := range sessions {
+	for _, sess := range sessions {
 		//we only need to refresh the 1 socket.
 		if sess.SocketId != p.Session.SocketId {
 			continue
 		}
-		//step 3. get list of checks configured for this collector.
-		checks, err := sqlstore.GetProbeChecksWithEndpointSlug(p.Probe)
+		//step 3. get list of checks configured for this collector. Sessions
+		// with incremental refreshes only load the checks that are sent.
+		incremental := p.incremental()
+		var checks []m.CheckWithSlug
+		if incremental {
+			checks, err = sqlstore.GetProbeCheckVersions(p.Probe)
+		} else {
+			checks, err = sqlstore.GetProbeChecksWithEndpointSlug(p.Probe)
+		}
 		if err != nil {
 			log.Error(3, "failed to get checks for probeId=%d err=%s", p.Probe.Id, err)
 			break
 		}
 
-		v, _ := version.NewVersion(p.Session.Version)
-		newVer, _ := version.NewVersion("0.9.1")
-		activeChecks := make([]m.CheckWithSlug, 0)
+		legacy := !VersionHasFeature(p.Session.Version, FeatureCheckPayload)
+		activeChecks := AssignChecks(checks, sessions)[sess.SocketId].Checks
+		p.assignChecks(activeChecks)
 		monitors := make([]m.MonitorDTO, 0)
-		for _, check := range checks {
-			if !check.Enabled {
-				continue
-			}
-			if check.Check.Id%totalSessions == int64(pos) {
-				if v.LessThan(newVer) {
-					monitors = append(monitors, m.MonitorDTOFromCheck(check.Check, check.Slug))
-				} else {
-					activeChecks = append(activeChecks, check)
-				}
+		if legacy {
+			for _, check := range activeChecks {
+				monitors = append(monitors, m.MonitorDTOFromCheck(check.Check, check.Slug))
 			}
 		}
 
-		if v.LessThan(newVer) {
+		if incremental {
+			if err := p.sync(activeChecks); err != nil {
+				log.Error(3, "failed to emit sync for probeId=%d socketId=%s err=%s", p.Probe.Id, sess.SocketId, err)
+			}
+		} else if legacy {
 			log.Info("sending refresh to socketId=%s probeId=%d checkCount=%d", sess.SocketId, sess.ProbeId, len(monitors))
 			err = p.emit("refresh", monitors)
 			if err != nil {
@@ -204,6 +341,7 @@ func (p *ProbeSocket) Refresh() {
 		break
 	}
 	RefreshDuration.Value(util.Since(pre))
+	return nil
 }
 
 func (p *ProbeSocket) Start() {
@@ -217,6 +355,10 @@ func (p *ProbeSocket) Start() {
 	log.Info("binding event handlers for probeId=%d socketId=%s", p.Probe.Id, p.Session.SocketId)
 	p.Socket.On("event", p.OnEvent)
 	p.Socket.On("results", p.OnResults)
+	p.Socket.On("testCheckResult", p.OnTestCheckResult)
+	p.Socket.On("syncAck", p.OnSyncAck)
+	p.Socket.On("resultBatch", p.OnResultBatch)
+	p.Socket.On("health", p.OnHealth)
 	p.Socket.On("disconnection", p.OnDisconnection)
 
 	log.Info("saving probe session for probeId=%d to DB", p.Probe.Id)
@@ -229,6 +371,9 @@ func (p *ProbeSocket) Start() {
 		return
 	}
 	log.Info("saved session to DB for probeId=%d", p.Probe.Id)
+	if results.isPaused() {
+		p.emit("pause", nil)
+	}
 
 	// write heartbeats to the DB
 	go func() {
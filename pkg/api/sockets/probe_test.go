@@ -0,0 +1,44 @@
+package sockets
+
+import (
+	"testing"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDrain(t *testing.T) {
+	if err := sqlstore.MockEngine(); err != nil {
+		t.Fatalf("failed to init DB. %s", err)
+	}
+	Convey("Given a session with a refresh running", t, func() {
+		transport := &mockTransport{}
+		p := NewProbeSocket(nil, &m.ProbeDTO{Id: 1}, transport, &m.ProbeSession{SocketId: "mock"}, time.Second)
+		running := make(chan struct{})
+		p.refreshDone = running
+
+		drained := make(chan struct{})
+		go func() {
+			p.Drain()
+			close(drained)
+		}()
+
+		Convey("drained should not be sent until the running refresh completes", func() {
+			time.Sleep(time.Millisecond * 50)
+			So(sliceContains(transport.getEmitted(), "drained"), ShouldBeFalse)
+
+			p.Lock()
+			close(running)
+			p.refreshDone = nil
+			p.Unlock()
+			select {
+			case <-drained:
+			case <-time.After(time.Second * 5):
+			}
+			So(sliceContains(transport.getEmitted(), "drained"), ShouldBeTrue)
+			So(p.Session.Draining, ShouldBeTrue)
+		})
+	})
+}
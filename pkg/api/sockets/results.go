@@ -0,0 +1,254 @@
+package sockets
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	schemaV0 "gopkg.in/raintank/schema.v0"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	resultBatchesBuffered = stats.NewGauge32("api.probes.results.batches-buffered")
+	resultBatchesDropped  = stats.NewCounter32("api.probes.results.batches-dropped")
+	resultBatchesAcked    = stats.NewCounter32("api.probes.results.batches-acked")
+	resultsPaused         = stats.NewGauge32("api.probes.results.paused")
+)
+
+const (
+	defaultResultQueueSize = 1000
+	// probes are told to pause sending results when the queue is this full,
+	// and to resume once it has drained below resumeRatio.
+	pauseRatio  = 0.8
+	resumeRatio = 0.5
+	// number of acked sequence numbers remembered per session to detect
+	// batches resent after their ack was lost.
+	ackedSeqHistory = 1000
+)
+
+// ResultBatch is a batch of results that the probe wants acknowledged. Batches
+// that are not acknowledged should be resent with the same Seq.
+type ResultBatch struct {
+	Seq     int64                  `json:"seq"`
+	Metrics []*schemaV0.MetricData `json:"metrics"`
+}
+
+// ResultAck acknowledges that a ResultBatch was accepted by the publisher.
+type ResultAck struct {
+	Seq int64 `json:"seq"`
+}
+
+type queuedResults struct {
+	metrics []*schema.MetricData
+	// socket and seq are set for batches that need to be acknowledged.
+	socket *ProbeSocket
+	seq    int64
+}
+
+// resultQueue buffers results between the probe sockets and the publisher,
+// telling probes to pause when the publisher falls behind.
+type resultQueue struct {
+	sync.Mutex
+	queue  chan *queuedResults
+	paused bool
+}
+
+func newResultQueue(size int) *resultQueue {
+	if size <= 0 {
+		size = defaultResultQueueSize
+	}
+	return &resultQueue{queue: make(chan *queuedResults, size)}
+}
+
+// add queues results. When the queue is full add waits up to timeout for
+// space, then drops the results and returns false.
+func (q *resultQueue) add(r *queuedResults, timeout time.Duration) bool {
+	select {
+	case q.queue <- r:
+	default:
+		if !q.wait(r, timeout) {
+			resultBatchesDropped.Inc()
+			q.checkPressure()
+			return false
+		}
+	}
+	resultBatchesBuffered.Set(len(q.queue))
+	q.checkPressure()
+	return true
+}
+
+func (q *resultQueue) wait(r *queuedResults, timeout time.Duration) bool {
+	if timeout <= 0 {
+		return false
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case q.queue <- r:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// start starts the workers publishing the queued results. They exit once the
+// queue is closed.
+func (q *resultQueue) start(workers int) {
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.run()
+	}
+}
+
+// run publishes queued results. Batches are acked once the publisher has
+// accepted them. The publisher buffers metrics before sending them on, so an
+// ack does not mean the results were delivered, only that they will no longer
+// be lost by the queue filling up or a probe reconnecting.
+func (q *resultQueue) run() {
+	for r := range q.queue {
+		resultBatchesBuffered.Set(len(q.queue))
+		publisher.Add(r.metrics)
+		if r.socket != nil {
+			r.socket.ackResults(r.seq)
+			resultBatchesAcked.Inc()
+		}
+		q.checkPressure()
+	}
+}
+
+func (q *resultQueue) isPaused() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.paused
+}
+
+// checkPressure tells all local probes to pause or resume sending results
+// when the queue crosses the watermarks.
+func (q *resultQueue) checkPressure() {
+	fill := float64(len(q.queue)) / float64(cap(q.queue))
+	q.Lock()
+	var event string
+	if !q.paused && fill >= pauseRatio {
+		q.paused = true
+		resultsPaused.Set(1)
+		event = "pause"
+	} else if q.paused && fill <= resumeRatio {
+		q.paused = false
+		resultsPaused.Set(0)
+		event = "resume"
+	}
+	q.Unlock()
+	if event == "" {
+		return
+	}
+	log.Info("result queue is %.0f%% full, sending %s to probes", fill*100, event)
+	if socketCache != nil {
+		go socketCache.broadcast(event)
+	}
+}
+
+// OnResultBatch queues a batch of results. The batch is acknowledged once it
+// has been accepted by the publisher. If the queue is full, or the session is over its rate
+// limit, the batch is dropped without an ack so that the probe resends it.
+func (p *ProbeSocket) OnResultBatch(batch *ResultBatch) {
+	if batch == nil || p.isClosed() {
+		return
+	}
+	seq := batch.Seq
+	p.Lock()
+	if p.resultsPending == nil {
+		p.resultsPending = make(map[int64]bool)
+		p.resultsAcked = make(map[int64]bool)
+	}
+	pending := p.resultsPending[seq]
+	acked := p.resultsAcked[seq]
+	if !pending && !acked {
+		p.resultsPending[seq] = true
+	}
+	p.Unlock()
+	if pending {
+		// the first copy of this batch will be acked.
+		return
+	}
+	if acked {
+		// the ack was lost, so send it again.
+		p.emitResultAck(batch.Seq)
+		return
+	}
+
+	metricsRecvd.Add(len(batch.Metrics))
+	metrics, ok := p.validateBatch(batch.Metrics)
+	if !ok {
+		log.Debug("probeId=%d socketId=%s is over the result rate limit, dropped batch %d", p.Probe.Id, p.Session.SocketId, seq)
+		p.Lock()
+		delete(p.resultsPending, seq)
+		p.Unlock()
+		p.pauseRateLimited()
+		return
+	}
+	if len(metrics) == 0 {
+		// nothing to publish, but the probe must not resend the batch.
+		p.ackResults(seq)
+		return
+	}
+	if !results.add(&queuedResults{metrics: p.convertResults(metrics), socket: p, seq: seq}, 0) {
+		log.Debug("result queue full, dropped batch %d from probeId=%d", seq, p.Probe.Id)
+		p.Lock()
+		delete(p.resultsPending, seq)
+		p.Unlock()
+	}
+}
+
+// pauseRateLimited tells the probe to stop sending results until the rate
+// window of the session has ended.
+func (p *ProbeSocket) pauseRateLimited() {
+	p.Lock()
+	paused := p.rateLimited
+	p.rateLimited = true
+	p.Unlock()
+	if paused {
+		return
+	}
+	if err := p.emit("pause", nil); err != nil {
+		log.Error(3, "failed to send pause event to probeId=%d socketId=%s err=%s", p.Probe.Id, p.Session.SocketId, err)
+	}
+	time.AfterFunc(p.rateLimitWait(time.Now()), func() {
+		p.Lock()
+		p.rateLimited = false
+		closed := p.closed
+		p.Unlock()
+		// while the result queue is full the probe is resumed once it drains.
+		if closed || results.isPaused() {
+			return
+		}
+		if err := p.emit("resume", nil); err != nil {
+			log.Error(3, "failed to send resume event to probeId=%d socketId=%s err=%s", p.Probe.Id, p.Session.SocketId, err)
+		}
+	})
+}
+
+func (p *ProbeSocket) ackResults(seq int64) {
+	p.Lock()
+	delete(p.resultsPending, seq)
+	p.resultsAcked[seq] = true
+	p.ackedSeqs = append(p.ackedSeqs, seq)
+	if len(p.ackedSeqs) > ackedSeqHistory {
+		delete(p.resultsAcked, p.ackedSeqs[0])
+		p.ackedSeqs = p.ackedSeqs[1:]
+	}
+	closed := p.closed
+	p.Unlock()
+	if !closed {
+		p.emitResultAck(seq)
+	}
+}
+
+func (p *ProbeSocket) emitResultAck(seq int64) {
+	if err := p.emit("resultAck", &ResultAck{Seq: seq}); err != nil {
+		log.Error(3, "failed to ack results for probeId=%d socketId=%s err=%s", p.Probe.Id, p.Session.SocketId, err)
+	}
+}
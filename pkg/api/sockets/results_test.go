@@ -0,0 +1,161 @@
+package sockets
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/setting"
+	. "github.com/smartystreets/goconvey/convey"
+	schemaV0 "gopkg.in/raintank/schema.v0"
+	"gopkg.in/raintank/schema.v1"
+)
+
+type mockTransport struct {
+	sync.Mutex
+	emitted []string
+	acks    []int64
+}
+
+func (t *mockTransport) Id() string                           { return "mock" }
+func (t *mockTransport) Request() *http.Request               { return nil }
+func (t *mockTransport) On(event string, f interface{}) error { return nil }
+func (t *mockTransport) Disconnect()                          {}
+func (t *mockTransport) Emit(event string, args ...interface{}) error {
+	t.Lock()
+	t.emitted = append(t.emitted, event)
+	if ack, ok := args[0].(*ResultAck); ok {
+		t.acks = append(t.acks, ack.Seq)
+	}
+	t.Unlock()
+	return nil
+}
+
+func (t *mockTransport) getEmitted() []string {
+	t.Lock()
+	defer t.Unlock()
+	return append([]string{}, t.emitted...)
+}
+
+func (t *mockTransport) getAcks() []int64 {
+	t.Lock()
+	defer t.Unlock()
+	return append([]int64{}, t.acks...)
+}
+
+type blockingPublisher struct {
+	release chan struct{}
+}
+
+func (p *blockingPublisher) Add(metrics []*schema.MetricData) {
+	<-p.release
+}
+
+func (p *blockingPublisher) AddEvent(event *schema.ProbeEvent) {}
+
+func TestResultBatches(t *testing.T) {
+	savedPublisher, savedResults := publisher, results
+	pub := &blockingPublisher{release: make(chan struct{}, 100)}
+	publisher = pub
+	results = newResultQueue(10)
+	defer func() {
+		// stops the worker started by the test.
+		close(results.queue)
+		publisher, results = savedPublisher, savedResults
+	}()
+
+	transport := &mockTransport{}
+	sock := NewProbeSocket(nil, &m.ProbeDTO{Id: 1, Slug: "probe1", Public: true}, transport, &m.ProbeSession{SocketId: "mock"}, time.Second)
+	sock.assignChecks([]m.CheckWithSlug{{Check: m.Check{Id: 1, OrgId: 1, Type: m.PING_CHECK}, Slug: "test"}})
+	batch := func(seq int64) *ResultBatch {
+		name := "litmus.test.probe1.ping.mean"
+		return &ResultBatch{Seq: seq, Metrics: []*schemaV0.MetricData{{Name: name, Metric: name, OrgId: 1, Time: time.Now().Unix()}}}
+	}
+
+	Convey("When the publisher is slow", t, func() {
+		for seq := int64(1); seq <= 10; seq++ {
+			sock.OnResultBatch(batch(seq))
+		}
+		So(results.isPaused(), ShouldBeTrue)
+
+		Convey("batches should be dropped when the queue is full", func() {
+			sock.OnResultBatch(batch(11))
+			So(len(results.queue), ShouldEqual, 10)
+			So(len(transport.getAcks()), ShouldEqual, 0)
+
+			Convey("batches should be acked once published", func() {
+				go results.run()
+				for i := 0; i < 10; i++ {
+					pub.release <- struct{}{}
+				}
+				So(waitForAcks(transport, 10), ShouldBeTrue)
+				So(results.isPaused(), ShouldBeFalse)
+
+				Convey("resent batches should be acked again without being published", func() {
+					sock.OnResultBatch(batch(3))
+					So(waitForAcks(transport, 11), ShouldBeTrue)
+					So(transport.getAcks()[10], ShouldEqual, 3)
+					So(len(results.queue), ShouldEqual, 0)
+				})
+			})
+		})
+	})
+}
+
+func TestRateLimitedResultBatches(t *testing.T) {
+	saved := setting.ProbeResults
+	defer func() { setting.ProbeResults = saved }()
+	setting.ProbeResults.MaxAge = 0
+	setting.ProbeResults.MaxFuture = 0
+	setting.ProbeResults.RateLimit = 1
+	savedResults := results
+	defer func() { results = savedResults }()
+	results = newResultQueue(10)
+
+	transport := &mockTransport{}
+	sock := NewProbeSocket(nil, &m.ProbeDTO{Id: 1, Slug: "probe1", Public: true}, transport, &m.ProbeSession{SocketId: "mock"}, time.Second)
+	sock.assignChecks([]m.CheckWithSlug{{Check: m.Check{Id: 1, OrgId: 1, Type: m.PING_CHECK}, Slug: "test"}})
+	name := "litmus.test.probe1.ping.mean"
+	metric := &schemaV0.MetricData{Name: name, Metric: name, OrgId: 1, Time: time.Now().Unix()}
+
+	Convey("When a batch exceeds the rate limit of the session", t, func() {
+		sock.validateResults([]*schemaV0.MetricData{metric})
+		sock.OnResultBatch(&ResultBatch{Seq: 1, Metrics: []*schemaV0.MetricData{metric, metric}})
+
+		Convey("it should be dropped without an ack and the probe paused", func() {
+			So(len(transport.getAcks()), ShouldEqual, 0)
+			So(transport.getEmitted(), ShouldContain, "pause")
+			So(sock.resultsPending[1], ShouldBeFalse)
+		})
+
+		Convey("the probe should be resumed once the rate window has ended", func() {
+			deadline := time.Now().Add(time.Second * 2)
+			for time.Now().Before(deadline) && !sliceContains(transport.getEmitted(), "resume") {
+				time.Sleep(time.Millisecond * 10)
+			}
+			So(transport.getEmitted(), ShouldContain, "resume")
+		})
+	})
+}
+
+func sliceContains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func waitForAcks(transport *mockTransport, count int) bool {
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		if len(transport.getAcks()) >= count {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package sockets
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/raintank/worldping-api/pkg/setting"
+)
+
+var (
+	ReconnectsSent    = stats.NewCounter32("api.probes.reconnects-sent")
+	sessionsHandedOff = stats.NewCounter32("api.probes.shutdown.handed-off")
+	sessionsAbandoned = stats.NewCounter32("api.probes.shutdown.abandoned")
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+var (
+	shuttingDown         int32
+	shutdownPollInterval = time.Millisecond * 500
+)
+
+// Reconnect asks a probe to close its connection and reconnect after waiting
+// Backoff seconds. When Url is empty the probe reconnects to the url it is
+// configured with.
+type Reconnect struct {
+	Backoff float64 `json:"backoff"`
+	Url     string  `json:"url"`
+}
+
+// ShuttingDown returns true once Shutdown has been called. New probe
+// connections are rejected from then on.
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// reconnectPeers returns the peers probes can be sent to, excluding this
+// instance.
+func reconnectPeers(peers []string, self string) []string {
+	self = strings.TrimRight(self, "/")
+	result := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		if strings.TrimRight(peer, "/") == self {
+			continue
+		}
+		result = append(result, peer)
+	}
+	return result
+}
+
+// Shutdown hands the local sessions off to other instances. Every probe that
+// supports it is sent a reconnect event, spreading them across the configured
+// peers, and the probes are given until the deadline to disconnect. Sessions
+// that are still connected at the deadline are removed. The sessions of
+// probes that do not support reconnect events are removed straight away, as
+// they would only disconnect once this instance exits.
+func (c *Cache) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		return
+	}
+	close(c.done)
+
+	sessList := c.list()
+	peers := reconnectPeers(setting.ProbeShutdown.Peers, setting.AppUrl)
+	legacy := make([]*ProbeSocket, 0)
+	sent := 0
+	for _, sock := range sessList {
+		if !VersionHasFeature(sock.Session.Version, FeatureReconnect) {
+			legacy = append(legacy, sock)
+			continue
+		}
+		r := &Reconnect{}
+		if setting.ProbeShutdown.MaxBackoff > 0 {
+			r.Backoff = rand.Float64() * setting.ProbeShutdown.MaxBackoff.Seconds()
+		}
+		if len(peers) > 0 {
+			r.Url = peers[sent%len(peers)]
+		}
+		sent++
+		if err := sock.Reconnect(r); err != nil {
+			log.Error(3, "failed to send reconnect to probeId=%d socketId=%s err=%s", sock.Probe.Id, sock.Session.SocketId, err)
+		}
+	}
+	log.Info("asked %d probes to reconnect to another instance, removing %d sessions of probes that can not be asked to.", sent, len(legacy))
+	c.Lock()
+	for _, sock := range legacy {
+		delete(c.Sockets, sock.Session.SocketId)
+	}
+	c.Unlock()
+	for _, sock := range legacy {
+		sock.Remove()
+	}
+
+	deadline := time.Now().Add(setting.ProbeShutdown.Deadline)
+	for len(c.list()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(shutdownPollInterval)
+	}
+
+	c.Lock()
+	remaining := make([]*ProbeSocket, 0, len(c.Sockets))
+	for _, sock := range c.Sockets {
+		remaining = append(remaining, sock)
+	}
+	c.Sockets = make(map[string]*ProbeSocket)
+	c.Unlock()
+	sessionsHandedOff.Add(sent - len(remaining))
+	sessionsAbandoned.Add(len(legacy) + len(remaining))
+	log.Info("%d probes reconnected before the deadline, removing %d remaining sessions.", sent-len(remaining), len(remaining))
+	for _, sock := range remaining {
+		sock.Remove()
+	}
+}
+
+func (c *Cache) list() []*ProbeSocket {
+	c.RLock()
+	defer c.RUnlock()
+	sessList := make([]*ProbeSocket, 0, len(c.Sockets))
+	for _, sock := range c.Sockets {
+		sessList = append(sessList, sock)
+	}
+	return sessList
+}
@@ -0,0 +1,111 @@
+package sockets
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	"github.com/raintank/worldping-api/pkg/setting"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// reconnectingTransport disconnects from the cache when it is asked to
+// reconnect, like a probe would. Legacy transports ignore the request.
+type reconnectingTransport struct {
+	sync.Mutex
+	id         string
+	cache      *Cache
+	legacy     bool
+	reconnects []*Reconnect
+}
+
+func (t *reconnectingTransport) Id() string                           { return t.id }
+func (t *reconnectingTransport) Request() *http.Request               { return nil }
+func (t *reconnectingTransport) On(event string, f interface{}) error { return nil }
+func (t *reconnectingTransport) Disconnect()                          {}
+func (t *reconnectingTransport) Emit(event string, args ...interface{}) error {
+	if r, ok := args[0].(*Reconnect); ok {
+		t.Lock()
+		t.reconnects = append(t.reconnects, r)
+		t.Unlock()
+		if !t.legacy {
+			go t.cache.Remove(t.id)
+		}
+	}
+	return nil
+}
+
+func (t *reconnectingTransport) getReconnects() []*Reconnect {
+	t.Lock()
+	defer t.Unlock()
+	return append([]*Reconnect{}, t.reconnects...)
+}
+
+func TestReconnectPeers(t *testing.T) {
+	Convey("When choosing peers to reconnect to", t, func() {
+		peers := []string{"http://api-1/", "http://api-2/", "http://api-3"}
+		Convey("this instance should be excluded", func() {
+			So(reconnectPeers(peers, "http://api-2"), ShouldResemble, []string{"http://api-1/", "http://api-3"})
+		})
+		Convey("no peers should be returned when none are configured", func() {
+			So(reconnectPeers([]string{}, "http://api-2/"), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	if err := sqlstore.MockEngine(); err != nil {
+		t.Fatalf("failed to init DB. %s", err)
+	}
+	saved := setting.ProbeShutdown
+	defer func() { setting.ProbeShutdown = saved }()
+	setting.ProbeShutdown.Deadline = time.Second * 10
+	setting.ProbeShutdown.MaxBackoff = time.Second * 5
+	setting.ProbeShutdown.Peers = []string{"http://api-1/", "http://api-2/"}
+	shutdownPollInterval = time.Millisecond * 10
+
+	Convey("Given connected probes", t, func() {
+		atomic.StoreInt32(&shuttingDown, 0)
+		c := &Cache{
+			Sockets:     make(map[string]*ProbeSocket),
+			done:        make(chan struct{}),
+			refreshChan: make(chan int64),
+		}
+		transports := make([]*reconnectingTransport, 0)
+		for _, id := range []string{"a", "b", "c"} {
+			transport := &reconnectingTransport{id: id, cache: c}
+			transports = append(transports, transport)
+			c.Set(id, NewProbeSocket(nil, &m.ProbeDTO{Id: 1}, transport, &m.ProbeSession{SocketId: id, Version: "1.0.0"}, time.Second))
+		}
+		legacy := &reconnectingTransport{id: "legacy", cache: c, legacy: true}
+		c.Set(legacy.id, NewProbeSocket(nil, &m.ProbeDTO{Id: 1}, legacy, &m.ProbeSession{SocketId: legacy.id, Version: "0.9.1"}, time.Second))
+
+		start := time.Now()
+		c.Shutdown()
+		Convey("every probe should be asked to reconnect to a peer", func() {
+			urls := make(map[string]int)
+			for _, transport := range transports {
+				reconnects := transport.getReconnects()
+				So(len(reconnects), ShouldEqual, 1)
+				So(reconnects[0].Backoff, ShouldBeLessThanOrEqualTo, 5)
+				urls[reconnects[0].Url]++
+			}
+			So(urls["http://api-1/"]+urls["http://api-2/"], ShouldEqual, 3)
+		})
+		Convey("probes that do not support reconnect should not be asked to", func() {
+			So(legacy.getReconnects(), ShouldBeEmpty)
+		})
+		Convey("shutdown should not wait for the deadline once all probes reconnected", func() {
+			So(time.Since(start), ShouldBeLessThan, time.Second*10)
+			So(ShuttingDown(), ShouldBeTrue)
+			So(c.list(), ShouldBeEmpty)
+		})
+		Convey("refreshes should not block", func() {
+			c.Refresh(1)
+		})
+	})
+}
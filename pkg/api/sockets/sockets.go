@@ -9,6 +9,7 @@ import (
 	"github.com/raintank/worldping-api/pkg/log"
 	m "github.com/raintank/worldping-api/pkg/models"
 	"github.com/raintank/worldping-api/pkg/services"
+	"github.com/raintank/worldping-api/pkg/setting"
 )
 
 var (
@@ -19,6 +20,7 @@ var (
 
 	socketCache *Cache
 	publisher   services.MetricsEventsPublisher
+	results     *resultQueue
 )
 
 type Cache struct {
@@ -38,6 +40,8 @@ func InitCache(pub services.MetricsEventsPublisher) {
 		done:        make(chan struct{}),
 		refreshChan: make(chan int64, 100),
 	}
+	results = newResultQueue(setting.ProbeResults.QueueSize)
+	results.start(setting.ProbeResults.Publishers)
 
 	go socketCache.refreshLoop()
 	go socketCache.refreshQueue()
@@ -67,6 +71,22 @@ func UpdateProbe(probe *m.ProbeDTO) {
 	socketCache.UpdateProbe(probe)
 }
 
+func Disconnect(id string, reason string) {
+	socketCache.Disconnect(id, reason)
+}
+
+func Drain(id string) {
+	socketCache.Drain(id)
+}
+
+func TestCheck(id string, req *m.CheckTestRequest) {
+	socketCache.TestCheck(id, req)
+}
+
+func LastRefresh(id string) (time.Time, bool) {
+	return socketCache.LastRefresh(id)
+}
+
 func (c *Cache) Set(id string, sock *ProbeSocket) {
 	c.Lock()
 	c.Sockets[id] = sock
@@ -81,21 +101,6 @@ func (c *Cache) Remove(id string) {
 	ProbesConnected.Dec()
 }
 
-func (c *Cache) Shutdown() {
-	c.done <- struct{}{}
-	sessList := make([]*ProbeSocket, 0)
-	c.Lock()
-	for _, sock := range c.Sockets {
-		sessList = append(sessList, sock)
-	}
-	c.Sockets = make(map[string]*ProbeSocket)
-	c.Unlock()
-	for _, sock := range sessList {
-		sock.Remove()
-	}
-	return
-}
-
 func (c *Cache) Emit(id string, event string, payload interface{}) {
 	c.RLock()
 	socket, ok := c.Sockets[id]
@@ -105,7 +110,15 @@ func (c *Cache) Emit(id string, event string, payload interface{}) {
 		return
 	}
 	c.RUnlock()
-	socket.emit(event, payload)
+	if check, ok := payload.(m.CheckWithSlug); ok && socket.incremental() {
+		// the change is sent as a sync so that it is part of the revision
+		// of checks the probe has.
+		if err := socket.syncCheck(event, check); err != nil {
+			log.Error(3, "failed to send %s sync to probeId=%d socketId=%s err=%s", event, socket.Probe.Id, id, err)
+		}
+	} else {
+		socket.emit(event, payload)
+	}
 	switch event {
 	case "updated":
 		UpdatesSent.Inc()
@@ -113,11 +126,83 @@ func (c *Cache) Emit(id string, event string, payload interface{}) {
 		CreatesSent.Inc()
 	case "removed":
 		RemovesSent.Inc()
+	default:
+		return
+	}
+	socket.assignCheck(event, payload)
+}
+
+// broadcast sends an event without payload to all local sockets.
+func (c *Cache) broadcast(event string) {
+	c.RLock()
+	sessList := make([]*ProbeSocket, 0, len(c.Sockets))
+	for _, sock := range c.Sockets {
+		sessList = append(sessList, sock)
+	}
+	c.RUnlock()
+	for _, sock := range sessList {
+		if err := sock.emit(event, nil); err != nil {
+			log.Error(3, "failed to send %s event to probeId=%d socketId=%s err=%s", event, sock.Probe.Id, sock.Session.SocketId, err)
+		}
+	}
+}
+
+// Disconnect terminates the session of a local socket.
+func (c *Cache) Disconnect(id string, reason string) {
+	c.RLock()
+	socket, ok := c.Sockets[id]
+	c.RUnlock()
+	if !ok {
+		log.Debug("socket %s is not local.", id)
+		return
+	}
+	socket.Disconnect(reason)
+}
+
+// Drain removes all checks from a local socket and tells the probe it has
+// been drained.
+func (c *Cache) Drain(id string) {
+	c.RLock()
+	socket, ok := c.Sockets[id]
+	c.RUnlock()
+	if !ok {
+		log.Debug("socket %s is not local.", id)
+		return
+	}
+	socket.Drain()
+}
+
+// TestCheck sends a one-off check execution request to a local socket.
+func (c *Cache) TestCheck(id string, req *m.CheckTestRequest) {
+	c.RLock()
+	socket, ok := c.Sockets[id]
+	c.RUnlock()
+	if !ok {
+		log.Debug("socket %s is not local.", id)
+		return
+	}
+	if err := socket.TestCheck(req); err != nil {
+		log.Error(3, "failed to send testCheck request to socketId=%s err=%s", id, err)
 	}
 }
 
+// LastRefresh returns the time the last refresh was sent to a local socket.
+func (c *Cache) LastRefresh(id string) (time.Time, bool) {
+	c.RLock()
+	socket, ok := c.Sockets[id]
+	c.RUnlock()
+	if !ok {
+		return time.Time{}, false
+	}
+	return socket.LastRefresh(), true
+}
+
 func (c *Cache) Refresh(id int64) {
-	c.refreshChan <- id
+	select {
+	case c.refreshChan <- id:
+	case <-c.done:
+		// refreshQueue has stopped, sessions are being handed off.
+	}
 }
 
 func (c *Cache) refresh(id int64) {
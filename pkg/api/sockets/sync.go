@@ -0,0 +1,269 @@
+package sockets
+
+import (
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+)
+
+// revisions are stored with all checks after this many revisions stored as
+// changes, so that few changes need to be applied to load a revision.
+const maxRevisionChanges = 100
+
+var (
+	syncFull  = stats.NewCounter32("api.probes.sync.full")
+	syncDelta = stats.NewCounter32("api.probes.sync.delta")
+	syncNoop  = stats.NewCounter32("api.probes.sync.noop")
+)
+
+// nextRevision returns a new revision greater than last. Revisions are based
+// on the clock so that they keep increasing when a probe reconnects.
+func nextRevision(last int64) int64 {
+	rev := time.Now().UnixNano()
+	if rev <= last {
+		rev = last + 1
+	}
+	return rev
+}
+
+// diffChecks returns the sync payload that turns the checks sent at
+// a previous revision into the current checks.
+func diffChecks(previous map[int64]m.SyncedCheck, checks []m.CheckWithSlug) *m.CheckSyncPayload {
+	payload := &m.CheckSyncPayload{}
+	seen := make(map[int64]bool, len(checks))
+	for _, c := range checks {
+		seen[c.Id] = true
+		prev, ok := previous[c.Id]
+		if !ok {
+			payload.Created = append(payload.Created, c)
+		} else if !prev.Updated.Equal(c.Updated) || prev.Slug != c.Slug {
+			payload.Updated = append(payload.Updated, c)
+		}
+	}
+	for id := range previous {
+		if !seen[id] {
+			payload.Removed = append(payload.Removed, id)
+		}
+	}
+	return payload
+}
+
+// incremental returns true if the session is sent its checks with sync events.
+func (p *ProbeSocket) incremental() bool {
+	return VersionHasFeature(p.Session.Version, FeatureCheckPayload) && p.Session.Capabilities.HasFeature(m.ProbeFeatureIncrementalRefresh)
+}
+
+// sync sends the checks assigned to the session to a probe that supports
+// incremental refreshes. Only the changes are sent when the probe has
+// acknowledged the last revision sent, otherwise the full list is sent.
+//
+// checks only need the columns returned by sqlstore.GetProbeCheckVersions.
+// The checks that are sent are loaded in full.
+func (p *ProbeSocket) sync(checks []m.CheckWithSlug) error {
+	p.syncLock.Lock()
+	defer p.syncLock.Unlock()
+	p.Lock()
+	base := p.syncRevision
+	previous := p.syncChecks
+	acked := p.probeRevision
+	p.Unlock()
+
+	current := make(map[int64]m.SyncedCheck, len(checks))
+	for _, c := range checks {
+		current[c.Id] = m.SyncedCheck{Updated: c.Updated, Slug: c.Slug}
+	}
+
+	var payload *m.CheckSyncPayload
+	var err error
+	if previous != nil && base != 0 && acked == base {
+		payload = diffChecks(previous, checks)
+		if len(payload.Created) == 0 && len(payload.Updated) == 0 && len(payload.Removed) == 0 {
+			log.Debug("probeId=%d socketId=%s is up to date at revision %d", p.Probe.Id, p.Session.SocketId, base)
+			syncNoop.Inc()
+			return nil
+		}
+		if payload.Created, err = loadChecks(payload.Created, current, nil); err != nil {
+			return err
+		}
+		if payload.Updated, err = loadChecks(payload.Updated, current, &payload.Removed); err != nil {
+			return err
+		}
+		payload.BaseRevision = base
+		syncDelta.Inc()
+	} else {
+		payload = &m.CheckSyncPayload{Full: true}
+		if payload.Checks, err = loadChecks(checks, current, nil); err != nil {
+			return err
+		}
+		syncFull.Inc()
+	}
+	payload.Revision = nextRevision(base)
+
+	log.Info("sending sync to socketId=%s probeId=%d revision=%d full=%t checkCount=%d created=%d updated=%d removed=%d",
+		p.Session.SocketId, p.Probe.Id, payload.Revision, payload.Full, len(current), len(payload.Created), len(payload.Updated), len(payload.Removed))
+	if err := p.emit("sync", payload); err != nil {
+		return err
+	}
+	p.commitSync(payload, current)
+	return nil
+}
+
+// loadChecks returns the full versions of the checks. Checks that no longer
+// exist are removed from current, and added to removed if it is not nil.
+func loadChecks(checks []m.CheckWithSlug, current map[int64]m.SyncedCheck, removed *[]int64) ([]m.CheckWithSlug, error) {
+	if len(checks) == 0 {
+		return checks, nil
+	}
+	ids := make([]int64, len(checks))
+	for i, c := range checks {
+		ids[i] = c.Id
+	}
+	loaded, err := sqlstore.GetChecksWithEndpointSlug(ids)
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[int64]m.CheckWithSlug, len(loaded))
+	for _, c := range loaded {
+		byId[c.Id] = c
+	}
+	full := make([]m.CheckWithSlug, 0, len(checks))
+	for _, c := range checks {
+		check, ok := byId[c.Id]
+		if !ok {
+			delete(current, c.Id)
+			if removed != nil {
+				*removed = append(*removed, c.Id)
+			}
+			continue
+		}
+		current[c.Id] = m.SyncedCheck{Updated: check.Updated, Slug: check.Slug}
+		full = append(full, check)
+	}
+	return full, nil
+}
+
+// syncCheck sends a created, updated or removed check to a probe that
+// supports incremental refreshes as a sync, so that the change is part of the
+// revision of the probe. If the probe has not acknowledged the last revision
+// sent, a refresh is queued instead.
+func (p *ProbeSocket) syncCheck(event string, check m.CheckWithSlug) error {
+	p.syncLock.Lock()
+	defer p.syncLock.Unlock()
+	p.Lock()
+	base := p.syncRevision
+	previous := p.syncChecks
+	acked := p.probeRevision
+	p.Unlock()
+	if previous == nil || base == 0 || acked != base {
+		log.Debug("probeId=%d socketId=%s has not acknowledged revision %d, queuing refresh", p.Probe.Id, p.Session.SocketId, base)
+		Refresh(p.Probe.Id)
+		return nil
+	}
+
+	current := make(map[int64]m.SyncedCheck, len(previous)+1)
+	for id, c := range previous {
+		current[id] = c
+	}
+	payload := &m.CheckSyncPayload{BaseRevision: base}
+	_, synced := previous[check.Id]
+	if event == "removed" {
+		if !synced {
+			return nil
+		}
+		payload.Removed = []int64{check.Id}
+		delete(current, check.Id)
+	} else {
+		if synced {
+			payload.Updated = []m.CheckWithSlug{check}
+		} else {
+			payload.Created = []m.CheckWithSlug{check}
+		}
+		current[check.Id] = m.SyncedCheck{Updated: check.Updated, Slug: check.Slug}
+	}
+	payload.Revision = nextRevision(base)
+	syncDelta.Inc()
+
+	log.Info("sending sync to socketId=%s probeId=%d revision=%d for %s checkId=%d", p.Session.SocketId, p.Probe.Id, payload.Revision, event, check.Id)
+	if err := p.emit("sync", payload); err != nil {
+		return err
+	}
+	p.commitSync(payload, current)
+	return nil
+}
+
+// commitSync records the revision sent to the probe, and stores it so that
+// the probe is only sent the changes if it reconnects with the revision. Full
+// syncs are stored with all checks, other syncs only with their changes.
+func (p *ProbeSocket) commitSync(payload *m.CheckSyncPayload, checks map[int64]m.SyncedCheck) {
+	rev := &m.ProbeCheckRevision{
+		ProbeId:  p.Probe.Id,
+		Revision: payload.Revision,
+	}
+	p.Lock()
+	p.syncRevision = payload.Revision
+	p.syncChecks = checks
+	if payload.Full || p.syncChanges >= maxRevisionChanges || time.Since(p.syncFullAt) > sqlstore.ProbeCheckRevisionFullInterval {
+		rev.Checks = checks
+		p.syncChanges = 0
+		p.syncFullAt = time.Now()
+	} else {
+		rev.BaseRevision = payload.BaseRevision
+		rev.Checks = make(map[int64]m.SyncedCheck, len(payload.Created)+len(payload.Updated))
+		for _, changed := range [][]m.CheckWithSlug{payload.Created, payload.Updated} {
+			for _, c := range changed {
+				if synced, ok := checks[c.Id]; ok {
+					rev.Checks[c.Id] = synced
+				}
+			}
+		}
+		rev.Removed = payload.Removed
+		p.syncChanges++
+	}
+	p.Unlock()
+	if err := sqlstore.AddProbeCheckRevision(rev); err != nil {
+		log.Error(3, "failed to store revision %d of probeId=%d err=%s", payload.Revision, p.Probe.Id, err)
+		// later changes can not be applied without this revision.
+		p.Lock()
+		p.syncFullAt = time.Time{}
+		p.Unlock()
+	}
+}
+
+// RestoreRevision restores the revision of checks a reconnecting probe
+// already has, so that it is only sent the changes since then. Unknown
+// revisions are ignored, and the probe is sent all of its checks.
+func (p *ProbeSocket) RestoreRevision(revision int64) {
+	if revision == 0 || !p.incremental() {
+		return
+	}
+	rev, err := sqlstore.GetProbeCheckRevision(p.Probe.Id, revision)
+	if err != nil {
+		if err != m.ErrProbeCheckRevisionNotFound {
+			log.Error(3, "failed to get revision %d of probeId=%d err=%s", revision, p.Probe.Id, err)
+		}
+		return
+	}
+	log.Info("probeId=%d socketId=%s reconnected at revision %d", p.Probe.Id, p.Session.SocketId, revision)
+	p.Lock()
+	p.syncRevision = rev.Revision
+	p.syncChecks = rev.Checks
+	p.syncChanges = rev.Changes
+	p.syncFullAt = rev.FullCreated
+	p.probeRevision = rev.Revision
+	p.Unlock()
+}
+
+// OnSyncAck records the revision of checks the probe has applied.
+func (p *ProbeSocket) OnSyncAck(ack *m.CheckSyncAck) {
+	if ack == nil || p.isClosed() {
+		return
+	}
+	revision := ack.Revision
+	log.Debug("probeId=%d socketId=%s acknowledged revision %d", p.Probe.Id, p.Session.SocketId, revision)
+	p.Lock()
+	p.probeRevision = revision
+	p.Unlock()
+}
@@ -0,0 +1,97 @@
+package sockets
+
+import (
+	"testing"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiffChecks(t *testing.T) {
+	now := time.Now()
+	check := func(id int64, updated time.Time, slug string) m.CheckWithSlug {
+		return m.CheckWithSlug{Check: m.Check{Id: id, Updated: updated}, Slug: slug}
+	}
+	previous := map[int64]m.SyncedCheck{
+		1: {Updated: now, Slug: "a"},
+		2: {Updated: now, Slug: "a"},
+		3: {Updated: now, Slug: "a"},
+		4: {Updated: now, Slug: "a"},
+	}
+
+	Convey("When diffing the checks of a session", t, func() {
+		payload := diffChecks(previous, []m.CheckWithSlug{
+			check(1, now, "a"),
+			check(2, now.Add(time.Minute), "a"),
+			check(3, now, "b"),
+			check(5, now, "a"),
+		})
+		So(len(payload.Created), ShouldEqual, 1)
+		So(payload.Created[0].Id, ShouldEqual, 5)
+		So(len(payload.Updated), ShouldEqual, 2)
+		So(payload.Updated[0].Id, ShouldEqual, 2)
+		So(payload.Updated[1].Id, ShouldEqual, 3)
+		So(payload.Removed, ShouldResemble, []int64{4})
+	})
+	Convey("When nothing changed", t, func() {
+		payload := diffChecks(previous, []m.CheckWithSlug{
+			check(1, now, "a"),
+			check(2, now, "a"),
+			check(3, now, "a"),
+			check(4, now, "a"),
+		})
+		So(len(payload.Created)+len(payload.Updated)+len(payload.Removed), ShouldEqual, 0)
+	})
+	Convey("Revisions should always increase", t, func() {
+		last := time.Now().Add(time.Hour).UnixNano()
+		So(nextRevision(last), ShouldEqual, last+1)
+		So(nextRevision(0), ShouldBeGreaterThan, 0)
+	})
+}
+
+func TestCommitSync(t *testing.T) {
+	if err := sqlstore.MockEngine(); err != nil {
+		t.Fatalf("failed to init DB. %s", err)
+	}
+	now := time.Now().Truncate(time.Second)
+	Convey("When committing syncs of a session", t, func() {
+		p := NewProbeSocket(nil, &m.ProbeDTO{Id: 1}, &mockTransport{}, &m.ProbeSession{SocketId: "mock"}, time.Second)
+		full := nextRevision(0)
+		p.commitSync(&m.CheckSyncPayload{Full: true, Revision: full}, map[int64]m.SyncedCheck{
+			1: {Updated: now, Slug: "a"},
+			2: {Updated: now, Slug: "a"},
+		})
+		delta := &m.CheckSyncPayload{
+			BaseRevision: full,
+			Revision:     full + 1,
+			Created:      []m.CheckWithSlug{{Check: m.Check{Id: 3, Updated: now}, Slug: "b"}},
+			Removed:      []int64{1},
+		}
+		p.commitSync(delta, map[int64]m.SyncedCheck{
+			2: {Updated: now, Slug: "a"},
+			3: {Updated: now, Slug: "b"},
+		})
+
+		Convey("only the changes should be stored for incremental syncs", func() {
+			So(p.syncChanges, ShouldEqual, 1)
+			rev, err := sqlstore.GetProbeCheckRevision(1, full+1)
+			So(err, ShouldBeNil)
+			So(rev.Changes, ShouldEqual, 1)
+			So(rev.Checks, ShouldHaveLength, 2)
+			So(rev.Checks[3].Slug, ShouldEqual, "b")
+		})
+		Convey("all checks should be stored after too many changes", func() {
+			p.syncChanges = maxRevisionChanges
+			delta.BaseRevision = full + 1
+			delta.Revision = full + 2
+			p.commitSync(delta, p.syncChecks)
+			So(p.syncChanges, ShouldEqual, 0)
+			rev, err := sqlstore.GetProbeCheckRevision(1, full+2)
+			So(err, ShouldBeNil)
+			So(rev.Changes, ShouldEqual, 0)
+			So(rev.Checks, ShouldHaveLength, 2)
+		})
+	})
+}
@@ -0,0 +1,218 @@
+package sockets
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/setting"
+	schemaV0 "gopkg.in/raintank/schema.v0"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	resultsRejectedUnknownCheck = stats.NewCounter32("api.probes.results.rejected.unknown-check")
+	resultsRejectedInvalidName  = stats.NewCounter32("api.probes.results.rejected.invalid-name")
+	resultsRejectedStale        = stats.NewCounter32("api.probes.results.rejected.stale")
+	resultsRejectedFuture       = stats.NewCounter32("api.probes.results.rejected.future")
+	resultsRejectedRateLimited  = stats.NewCounter32("api.probes.results.rejected.rate-limited")
+)
+
+// results of checks removed from a session are still accepted for this long,
+// so that results already in flight are not rejected.
+const removedCheckGracePeriod = time.Minute * 5
+
+// checkMetrics are the metrics reported for each check type. Metric names are
+// litmus.<endpoint slug>.<probe slug>.<check type>.<metric>
+var checkMetrics = map[m.CheckType]map[string]bool{
+	m.HTTP_CHECK:  httpMetrics,
+	m.HTTPS_CHECK: httpMetrics,
+	m.DNS_CHECK: {
+		"time": true, "ttl": true, "answers": true, "default": true,
+		"ok_state": true, "error_state": true,
+	},
+	m.PING_CHECK: {
+		"min": true, "max": true, "median": true, "mean": true, "mdev": true, "loss": true, "default": true,
+		"ok_state": true, "error_state": true,
+	},
+}
+
+var httpMetrics = map[string]bool{
+	"dns": true, "connect": true, "send": true, "wait": true, "recv": true, "total": true, "default": true,
+	"throughput": true, "dataLength": true, "statusCode": true,
+	"ok_state": true, "error_state": true,
+}
+
+type assignedCheck struct {
+	id        int64
+	orgId     int64
+	checkType m.CheckType
+	// zero while the check is assigned to the session.
+	expires time.Time
+}
+
+// checkKey identifies a check by its org, endpoint slug and type. Endpoint
+// slugs are only unique within an org, so public probes and probes granted to
+// other orgs can run checks of different orgs with the same slug.
+func checkKey(orgId int64, slug string, checkType m.CheckType) string {
+	return fmt.Sprintf("%d.%s.%s", orgId, slug, strings.ToLower(string(checkType)))
+}
+
+// assignChecks replaces the checks the session accepts results for.
+func (p *ProbeSocket) assignChecks(checks []m.CheckWithSlug) {
+	p.Lock()
+	defer p.Unlock()
+	previous := p.assigned
+	p.assigned = make(map[string]*assignedCheck, len(checks))
+	for _, c := range checks {
+		p.assigned[checkKey(c.OrgId, c.Slug, c.Type)] = &assignedCheck{id: c.Id, orgId: c.OrgId, checkType: c.Type}
+	}
+	expires := time.Now().Add(removedCheckGracePeriod)
+	for key, c := range previous {
+		if _, ok := p.assigned[key]; ok {
+			continue
+		}
+		if c.expires.IsZero() {
+			c.expires = expires
+		}
+		p.assigned[key] = c
+	}
+}
+
+// assignCheck adds or removes a single check after a created, updated or
+// removed event has been sent to the probe.
+func (p *ProbeSocket) assignCheck(event string, payload interface{}) {
+	var check *assignedCheck
+	var key string
+	switch c := payload.(type) {
+	case m.CheckWithSlug:
+		check = &assignedCheck{id: c.Id, orgId: c.OrgId, checkType: c.Type}
+		key = checkKey(c.OrgId, c.Slug, c.Type)
+	case m.MonitorDTO:
+		check = &assignedCheck{id: c.Id, orgId: c.OrgId, checkType: m.CheckType(c.MonitorTypeName)}
+		key = checkKey(c.OrgId, c.EndpointSlug, check.checkType)
+	default:
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.assigned == nil {
+		p.assigned = make(map[string]*assignedCheck)
+	}
+	expires := time.Now().Add(removedCheckGracePeriod)
+	// the endpoint slug of an updated check may have changed.
+	for k, c := range p.assigned {
+		if c.id == check.id && k != key && c.expires.IsZero() {
+			c.expires = expires
+		}
+	}
+	if event == "removed" {
+		check.expires = expires
+	}
+	p.assigned[key] = check
+}
+
+// eventOrgId returns the org an event of a private probe belongs to. Events
+// that carry the OrgId of a check assigned to the session are stored in that
+// org, so that the owner and the orgs the probe is granted to can use the same
+// endpoint slugs. All other events are stored in the org owning the probe.
+func (p *ProbeSocket) eventOrgId(msg *schema.ProbeEvent) int64 {
+	p.Lock()
+	defer p.Unlock()
+	check, ok := p.assigned[checkKey(msg.OrgId, msg.Tags["endpoint"], m.CheckType(msg.Tags["monitor_type"]))]
+	if !ok {
+		return int64(p.User.ID)
+	}
+	return check.orgId
+}
+
+// validateResults returns the metrics that belong to checks assigned to the
+// session. Metrics must carry the OrgId of their check, so that the results of
+// checks of other orgs with the same endpoint slug can not be stored in the
+// wrong org. Metrics over the rate limit and other rejected metrics are
+// counted per reason.
+func (p *ProbeSocket) validateResults(metrics []*schemaV0.MetricData) []*schemaV0.MetricData {
+	now := time.Now()
+	p.Lock()
+	defer p.Unlock()
+	return p.filterResults(metrics, now, true)
+}
+
+// validateBatch is validateResults for a batch that is acked. A batch is
+// either accepted or rejected by the rate limit as a whole, so that acked
+// batches are never partially dropped. false is returned when the batch was
+// rejected by the rate limit.
+func (p *ProbeSocket) validateBatch(metrics []*schemaV0.MetricData) ([]*schemaV0.MetricData, bool) {
+	now := time.Now()
+	p.Lock()
+	defer p.Unlock()
+	if !p.allowResults(now, len(metrics)) {
+		resultsRejectedRateLimited.Add(len(metrics))
+		return nil, false
+	}
+	return p.filterResults(metrics, now, false), true
+}
+
+// filterResults returns the valid metrics. p must be locked.
+func (p *ProbeSocket) filterResults(metrics []*schemaV0.MetricData, now time.Time, rateLimit bool) []*schemaV0.MetricData {
+	valid := make([]*schemaV0.MetricData, 0, len(metrics))
+	for _, metric := range metrics {
+		if rateLimit && !p.allowResults(now, 1) {
+			resultsRejectedRateLimited.Inc()
+			continue
+		}
+		ts := time.Unix(metric.Time, 0)
+		if setting.ProbeResults.MaxAge > 0 && ts.Before(now.Add(-setting.ProbeResults.MaxAge)) {
+			resultsRejectedStale.Inc()
+			continue
+		}
+		if setting.ProbeResults.MaxFuture > 0 && ts.After(now.Add(setting.ProbeResults.MaxFuture)) {
+			resultsRejectedFuture.Inc()
+			continue
+		}
+		parts := strings.Split(metric.Name, ".")
+		if len(parts) != 5 || parts[0] != "litmus" || parts[2] != p.Probe.Slug || metric.Metric != metric.Name {
+			resultsRejectedInvalidName.Inc()
+			continue
+		}
+		check, ok := p.assigned[checkKey(int64(metric.OrgId), parts[1], m.CheckType(parts[3]))]
+		if !ok || (!check.expires.IsZero() && now.After(check.expires)) {
+			resultsRejectedUnknownCheck.Inc()
+			continue
+		}
+		if !checkMetrics[check.checkType][parts[4]] {
+			resultsRejectedInvalidName.Inc()
+			continue
+		}
+		valid = append(valid, metric)
+	}
+	return valid
+}
+
+// allowResults enforces the per session rate limit for count results. Batches
+// larger than the limit are only allowed at the start of a rate window, so
+// that they are not rejected forever. p must be locked.
+func (p *ProbeSocket) allowResults(now time.Time, count int) bool {
+	if setting.ProbeResults.RateLimit <= 0 {
+		return true
+	}
+	if now.Sub(p.rateWindow) >= time.Second {
+		p.rateWindow = now
+		p.rateCount = 0
+	}
+	if p.rateCount > 0 && p.rateCount+count > setting.ProbeResults.RateLimit {
+		return false
+	}
+	p.rateCount += count
+	return true
+}
+
+// rateLimitWait returns how long until the current rate window ends.
+func (p *ProbeSocket) rateLimitWait(now time.Time) time.Duration {
+	p.Lock()
+	defer p.Unlock()
+	return p.rateWindow.Add(time.Second).Sub(now)
+}
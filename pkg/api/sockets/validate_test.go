@@ -0,0 +1,193 @@
+package sockets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raintank/tsdb-gw/auth"
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/setting"
+	. "github.com/smartystreets/goconvey/convey"
+	schemaV0 "gopkg.in/raintank/schema.v0"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestValidateResults(t *testing.T) {
+	saved := setting.ProbeResults
+	defer func() { setting.ProbeResults = saved }()
+	setting.ProbeResults.MaxAge = time.Hour
+	setting.ProbeResults.MaxFuture = time.Minute
+	setting.ProbeResults.RateLimit = 0
+
+	now := time.Now().Unix()
+	metric := func(name string, ts int64) *schemaV0.MetricData {
+		return &schemaV0.MetricData{Name: name, Metric: name, OrgId: 1, Time: ts}
+	}
+
+	Convey("Given a session with assigned checks", t, func() {
+		sock := NewProbeSocket(nil, &m.ProbeDTO{Id: 1, Slug: "probe1", Public: true}, &mockTransport{}, &m.ProbeSession{SocketId: "mock"}, time.Second)
+		sock.assignChecks([]m.CheckWithSlug{
+			{Check: m.Check{Id: 1, OrgId: 1, Type: m.HTTP_CHECK}, Slug: "www_google_com"},
+			{Check: m.Check{Id: 2, OrgId: 1, Type: m.PING_CHECK}, Slug: "www_google_com"},
+		})
+
+		Convey("metrics of assigned checks should be accepted", func() {
+			valid := sock.validateResults([]*schemaV0.MetricData{
+				metric("litmus.www_google_com.probe1.http.total", now),
+				metric("litmus.www_google_com.probe1.ping.loss", now),
+			})
+			So(len(valid), ShouldEqual, 2)
+			So(valid[0].OrgId, ShouldEqual, 1)
+		})
+
+		Convey("metrics with the OrgId of another org should be rejected", func() {
+			other := metric("litmus.www_google_com.probe1.http.total", now)
+			other.OrgId = 2
+			valid := sock.validateResults([]*schemaV0.MetricData{other})
+			So(len(valid), ShouldEqual, 0)
+		})
+
+		Convey("metrics of checks of two orgs with the same slug should be kept in their own org", func() {
+			sock.assignCheck("created", m.CheckWithSlug{Check: m.Check{Id: 3, OrgId: 2, Type: m.PING_CHECK}, Slug: "www_google_com"})
+			org2 := metric("litmus.www_google_com.probe1.ping.loss", now)
+			org2.OrgId = 2
+			valid := sock.validateResults([]*schemaV0.MetricData{
+				metric("litmus.www_google_com.probe1.ping.loss", now),
+				org2,
+			})
+			So(len(valid), ShouldEqual, 2)
+			So(valid[0].OrgId, ShouldEqual, 1)
+			So(valid[1].OrgId, ShouldEqual, 2)
+
+			sock.assignCheck("removed", m.CheckWithSlug{Check: m.Check{Id: 2, OrgId: 1, Type: m.PING_CHECK}, Slug: "www_google_com"})
+			sock.assigned[checkKey(1, "www_google_com", m.PING_CHECK)].expires = time.Now().Add(-time.Second)
+			valid = sock.validateResults([]*schemaV0.MetricData{
+				metric("litmus.www_google_com.probe1.ping.loss", now),
+				org2,
+			})
+			So(len(valid), ShouldEqual, 1)
+			So(valid[0].OrgId, ShouldEqual, 2)
+		})
+
+		Convey("metrics with unknown names should be rejected", func() {
+			valid := sock.validateResults([]*schemaV0.MetricData{
+				metric("litmus.www_google_com.probe1.http.bogus", now),
+				metric("litmus.www_google_com.probe2.http.total", now),
+				metric("litmus.www_google_com.probe1.http", now),
+				metric("some.other.metric", now),
+			})
+			So(len(valid), ShouldEqual, 0)
+		})
+
+		Convey("metrics of checks not assigned to the session should be rejected", func() {
+			valid := sock.validateResults([]*schemaV0.MetricData{
+				metric("litmus.www_google_com.probe1.dns.time", now),
+				metric("litmus.other.probe1.http.total", now),
+			})
+			So(len(valid), ShouldEqual, 0)
+		})
+
+		Convey("stale and future metrics should be rejected", func() {
+			valid := sock.validateResults([]*schemaV0.MetricData{
+				metric("litmus.www_google_com.probe1.http.total", now-7200),
+				metric("litmus.www_google_com.probe1.http.total", now+600),
+			})
+			So(len(valid), ShouldEqual, 0)
+		})
+
+		Convey("removed checks should be accepted during the grace period", func() {
+			sock.assignCheck("removed", m.CheckWithSlug{Check: m.Check{Id: 2, OrgId: 1, Type: m.PING_CHECK}, Slug: "www_google_com"})
+			valid := sock.validateResults([]*schemaV0.MetricData{metric("litmus.www_google_com.probe1.ping.loss", now)})
+			So(len(valid), ShouldEqual, 1)
+
+			sock.assigned[checkKey(1, "www_google_com", m.PING_CHECK)].expires = time.Now().Add(-time.Second)
+			valid = sock.validateResults([]*schemaV0.MetricData{metric("litmus.www_google_com.probe1.ping.loss", now)})
+			So(len(valid), ShouldEqual, 0)
+		})
+
+		Convey("created checks should be accepted", func() {
+			sock.assignCheck("created", m.MonitorDTO{Id: 3, OrgId: 1, EndpointSlug: "other", MonitorTypeName: "dns"})
+			valid := sock.validateResults([]*schemaV0.MetricData{metric("litmus.other.probe1.dns.time", now)})
+			So(len(valid), ShouldEqual, 1)
+		})
+
+		Convey("metrics over the rate limit should be rejected", func() {
+			setting.ProbeResults.RateLimit = 2
+			valid := sock.validateResults([]*schemaV0.MetricData{
+				metric("litmus.www_google_com.probe1.http.total", now),
+				metric("litmus.www_google_com.probe1.http.dns", now),
+				metric("litmus.www_google_com.probe1.http.wait", now),
+			})
+			setting.ProbeResults.RateLimit = 0
+			So(len(valid), ShouldEqual, 2)
+		})
+
+		Convey("batches over the rate limit should be rejected as a whole", func() {
+			setting.ProbeResults.RateLimit = 2
+			valid, ok := sock.validateBatch([]*schemaV0.MetricData{metric("litmus.www_google_com.probe1.http.total", now)})
+			So(ok, ShouldBeTrue)
+			So(len(valid), ShouldEqual, 1)
+			valid, ok = sock.validateBatch([]*schemaV0.MetricData{
+				metric("litmus.www_google_com.probe1.http.dns", now),
+				metric("litmus.www_google_com.probe1.http.wait", now),
+			})
+			setting.ProbeResults.RateLimit = 0
+			So(ok, ShouldBeFalse)
+			So(len(valid), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestGrantedChecks(t *testing.T) {
+	saved := setting.ProbeResults
+	defer func() { setting.ProbeResults = saved }()
+	setting.ProbeResults.MaxAge = 0
+	setting.ProbeResults.MaxFuture = 0
+	setting.ProbeResults.RateLimit = 0
+
+	now := time.Now().Unix()
+	Convey("Given a private probe granted to another org with the same endpoint slug", t, func() {
+		// the probe is owned by org 1 and granted to org 2.
+		sock := NewProbeSocket(&auth.User{ID: 1}, &m.ProbeDTO{Id: 1, OrgId: 1, Slug: "probe1"}, &mockTransport{}, &m.ProbeSession{SocketId: "mock"}, time.Second)
+		sock.assignChecks([]m.CheckWithSlug{
+			{Check: m.Check{Id: 1, OrgId: 1, Type: m.PING_CHECK}, Slug: "www_google_com"},
+			{Check: m.Check{Id: 2, OrgId: 2, Type: m.PING_CHECK}, Slug: "www_google_com"},
+			{Check: m.Check{Id: 3, OrgId: 2, Type: m.HTTP_CHECK}, Slug: "www_google_com"},
+		})
+		event := func(orgId int64, checkType string) *schema.ProbeEvent {
+			return &schema.ProbeEvent{
+				OrgId: orgId,
+				Tags:  map[string]string{"endpoint": "www_google_com", "monitor_type": checkType},
+			}
+		}
+
+		Convey("events should be stored in the org of their check", func() {
+			So(sock.eventOrgId(event(1, "ping")), ShouldEqual, 1)
+			So(sock.eventOrgId(event(2, "ping")), ShouldEqual, 2)
+			So(sock.eventOrgId(event(2, "http")), ShouldEqual, 2)
+		})
+
+		Convey("events of checks not assigned to the org should be stored in the org of the probe", func() {
+			So(sock.eventOrgId(event(1, "http")), ShouldEqual, 1)
+			So(sock.eventOrgId(event(3, "ping")), ShouldEqual, 1)
+		})
+
+		Convey("results should only be accepted for checks of their own org", func() {
+			metric := func(orgId int, checkType, name string) *schemaV0.MetricData {
+				n := "litmus.www_google_com.probe1." + checkType + "." + name
+				return &schemaV0.MetricData{Name: n, Metric: n, OrgId: orgId, Time: now}
+			}
+			valid := sock.validateResults([]*schemaV0.MetricData{
+				metric(1, "ping", "loss"),
+				metric(2, "ping", "loss"),
+				metric(2, "http", "total"),
+				metric(1, "http", "total"),
+				metric(3, "ping", "loss"),
+			})
+			So(len(valid), ShouldEqual, 3)
+			So(valid[0].OrgId, ShouldEqual, 1)
+			So(valid[1].OrgId, ShouldEqual, 2)
+			So(valid[2].OrgId, ShouldEqual, 2)
+		})
+	})
+}
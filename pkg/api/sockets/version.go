@@ -0,0 +1,107 @@
+package sockets
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+	"github.com/raintank/worldping-api/pkg/setting"
+)
+
+// FeatureCheckPayload is used by probes that accept checks instead of the
+// legacy MonitorDTO payload.
+const FeatureCheckPayload = "check_payload"
+
+// FeatureReconnect is used by probes that handle the "reconnect" event sent
+// when the server shuts down.
+const FeatureReconnect = "reconnect"
+
+var ErrProbeVersionTooOld = errors.New("invalid probe version. Please upgrade")
+
+// VersionPolicy decides which probe versions are allowed to connect, which
+// are deprecated and which features each version supports.
+type VersionPolicy struct {
+	minVersion *version.Version
+	deprecated version.Constraints
+	features   map[string]*version.Version
+}
+
+func NewVersionPolicy(s setting.ProbeVersionSettings) (*VersionPolicy, error) {
+	p := &VersionPolicy{features: make(map[string]*version.Version)}
+	var err error
+	if s.MinVersion != "" {
+		p.minVersion, err = version.NewVersion(s.MinVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe min_version %q. %s", s.MinVersion, err)
+		}
+	}
+	if s.Deprecated != "" {
+		p.deprecated, err = version.NewConstraint(s.Deprecated)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe deprecated constraint %q. %s", s.Deprecated, err)
+		}
+	}
+	for feature, v := range s.Features {
+		p.features[feature], err = version.NewVersion(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q for probe feature %s. %s", v, feature, err)
+		}
+	}
+	return p, nil
+}
+
+// Allowed returns ErrProbeVersionTooOld if the version is below the minimum.
+func (p *VersionPolicy) Allowed(v *version.Version) error {
+	if p.minVersion != nil && v.LessThan(p.minVersion) {
+		return ErrProbeVersionTooOld
+	}
+	return nil
+}
+
+func (p *VersionPolicy) Deprecated(v *version.Version) bool {
+	return p.deprecated != nil && p.deprecated.Check(v)
+}
+
+// HasFeature returns true if the version supports the feature. Features
+// without a configured version are supported by all versions.
+func (p *VersionPolicy) HasFeature(v *version.Version, feature string) bool {
+	min, ok := p.features[feature]
+	if !ok {
+		return true
+	}
+	return !v.LessThan(min)
+}
+
+// VersionHasFeature parses the version reported by a probe session and checks
+// it against the current policy. Unparsable versions support no gated features.
+func VersionHasFeature(versionStr string, feature string) bool {
+	v, err := version.NewVersion(versionStr)
+	if err != nil {
+		return false
+	}
+	return Policy().HasFeature(v, feature)
+}
+
+var (
+	policyLock sync.RWMutex
+	policy     = &VersionPolicy{
+		minVersion: version.Must(version.NewVersion("0.1.4")),
+		features: map[string]*version.Version{
+			FeatureCheckPayload: version.Must(version.NewVersion("0.9.1")),
+			FeatureReconnect:    version.Must(version.NewVersion("1.0.0")),
+		},
+	}
+)
+
+func Policy() *VersionPolicy {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	return policy
+}
+
+func SetPolicy(p *VersionPolicy) {
+	policyLock.Lock()
+	policy = p
+	policyLock.Unlock()
+}
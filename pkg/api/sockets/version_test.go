@@ -0,0 +1,42 @@
+package sockets
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/raintank/worldping-api/pkg/setting"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVersionPolicy(t *testing.T) {
+	Convey("When creating a version policy", t, func() {
+		policy, err := NewVersionPolicy(setting.ProbeVersionSettings{
+			MinVersion: "0.5.0",
+			Deprecated: "< 0.9.1",
+			Features: map[string]string{
+				FeatureCheckPayload: "0.9.1",
+			},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("old versions should be refused", func() {
+			So(policy.Allowed(version.Must(version.NewVersion("0.4.9"))), ShouldEqual, ErrProbeVersionTooOld)
+			So(policy.Allowed(version.Must(version.NewVersion("0.5.0"))), ShouldBeNil)
+		})
+		Convey("versions in the deprecated range should be deprecated", func() {
+			So(policy.Deprecated(version.Must(version.NewVersion("0.9.0"))), ShouldBeTrue)
+			So(policy.Deprecated(version.Must(version.NewVersion("0.9.1"))), ShouldBeFalse)
+		})
+		Convey("features should be gated by version", func() {
+			So(policy.HasFeature(version.Must(version.NewVersion("0.9.0")), FeatureCheckPayload), ShouldBeFalse)
+			So(policy.HasFeature(version.Must(version.NewVersion("1.0.0")), FeatureCheckPayload), ShouldBeTrue)
+			So(policy.HasFeature(version.Must(version.NewVersion("0.5.0")), "unknown"), ShouldBeTrue)
+		})
+	})
+	Convey("When the policy settings are invalid", t, func() {
+		_, err := NewVersionPolicy(setting.ProbeVersionSettings{MinVersion: "abc"})
+		So(err, ShouldNotBeNil)
+		_, err = NewVersionPolicy(setting.ProbeVersionSettings{Deprecated: "<<"})
+		So(err, ShouldNotBeNil)
+	})
+}
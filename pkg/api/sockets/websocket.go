@@ -0,0 +1,225 @@
+package sockets
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// ProtocolVersion is the version of the probe protocol served by WebSocket.
+// The protocol is described in the package documentation.
+const ProtocolVersion = 1
+
+var errUnsupportedProtocol = errors.New("unsupported probe protocol version")
+
+// number of messages that can be waiting to be handled before reading from
+// the connection blocks.
+const messageQueueSize = 100
+
+// Message is a single frame of the probe protocol.
+type Message struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Seq     int64           `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// probes are not browsers.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocket is a Transport using the versioned probe protocol over a plain
+// websocket connection.
+type WebSocket struct {
+	id                string
+	conn              *websocket.Conn
+	req               *http.Request
+	heartbeatInterval time.Duration
+
+	writeLock sync.Mutex
+	sync.RWMutex
+	handlers map[string]reflect.Value
+	closed   bool
+}
+
+// UpgradeWebSocket upgrades a HTTP request to a probe protocol connection.
+func UpgradeWebSocket(w http.ResponseWriter, req *http.Request, heartbeatInterval time.Duration) (*WebSocket, error) {
+	req.ParseForm()
+	proto := req.Form.Get("protocol")
+	if proto != fmt.Sprintf("%d", ProtocolVersion) {
+		http.Error(w, errUnsupportedProtocol.Error(), http.StatusBadRequest)
+		return nil, errUnsupportedProtocol
+	}
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocket{
+		id:                "ws-" + hex.EncodeToString(b),
+		conn:              conn,
+		req:               req,
+		heartbeatInterval: heartbeatInterval,
+		handlers:          make(map[string]reflect.Value),
+	}, nil
+}
+
+func (s *WebSocket) Id() string {
+	return s.id
+}
+
+func (s *WebSocket) Request() *http.Request {
+	return s.req
+}
+
+// On registers the handler for a message type. Handlers take no arguments or
+// a single argument the payload is decoded into.
+func (s *WebSocket) On(event string, f interface{}) error {
+	fn := reflect.ValueOf(f)
+	if fn.Kind() != reflect.Func || fn.Type().NumIn() > 1 {
+		return fmt.Errorf("invalid handler for %s", event)
+	}
+	s.Lock()
+	s.handlers[event] = fn
+	s.Unlock()
+	return nil
+}
+
+func (s *WebSocket) Emit(event string, args ...interface{}) error {
+	msg := Message{Version: ProtocolVersion, Type: event}
+	if len(args) > 0 {
+		payload, err := json.Marshal(args[0])
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+	}
+	return s.write(&msg)
+}
+
+func (s *WebSocket) write(msg *Message) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.heartbeatInterval))
+	return s.conn.WriteJSON(msg)
+}
+
+// Disconnect closes the connection. The "disconnection" handler is called
+// once Serve returns.
+func (s *WebSocket) Disconnect() {
+	s.Lock()
+	closed := s.closed
+	s.closed = true
+	s.Unlock()
+	if !closed {
+		s.conn.Close()
+	}
+}
+
+// Serve reads messages from the probe until the connection is closed.
+// Heartbeats are answered as they are read, other messages are queued for
+// handleMessages so that slow handlers do not stop heartbeats being read.
+func (s *WebSocket) Serve() {
+	queue := make(chan Message, messageQueueSize)
+	handled := make(chan struct{})
+	go s.handleMessages(queue, handled)
+	defer func() {
+		s.Disconnect()
+		close(queue)
+		<-handled
+		s.dispatch("disconnection", nil)
+	}()
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(3 * s.heartbeatInterval))
+		msg := Message{}
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			log.Debug("probe websocket %s closed. %s", s.id, err)
+			return
+		}
+		if msg.Version != ProtocolVersion {
+			s.Emit("error", errUnsupportedProtocol.Error())
+			return
+		}
+		if msg.Type != "heartbeat" {
+			queue <- msg
+			continue
+		}
+		if err := s.write(&Message{Version: ProtocolVersion, Type: "heartbeat"}); err != nil {
+			return
+		}
+		if msg.Seq != 0 {
+			if err := s.write(&Message{Version: ProtocolVersion, Type: "ack", Seq: msg.Seq}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleMessages calls the handlers of the queued messages in the order they
+// were received, and acknowledges them once handled. The connection is closed
+// if a message can not be handled.
+func (s *WebSocket) handleMessages(queue chan Message, handled chan struct{}) {
+	defer close(handled)
+	failed := false
+	for msg := range queue {
+		if failed {
+			continue
+		}
+		if err := s.dispatch(msg.Type, msg.Payload); err != nil {
+			log.Error(3, "probe websocket %s failed to handle %s message. %s", s.id, msg.Type, err)
+			s.Emit("error", err.Error())
+			s.Disconnect()
+			failed = true
+			continue
+		}
+		if msg.Seq != 0 {
+			if err := s.write(&Message{Version: ProtocolVersion, Type: "ack", Seq: msg.Seq}); err != nil {
+				s.Disconnect()
+				failed = true
+			}
+		}
+	}
+}
+
+func (s *WebSocket) dispatch(event string, payload json.RawMessage) error {
+	s.RLock()
+	fn, ok := s.handlers[event]
+	s.RUnlock()
+	if !ok {
+		log.Debug("probe websocket %s has no handler for %s messages", s.id, event)
+		return nil
+	}
+	if fn.Type().NumIn() == 0 {
+		fn.Call(nil)
+		return nil
+	}
+	arg := reflect.New(fn.Type().In(0))
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, arg.Interface()); err != nil {
+			return fmt.Errorf("invalid %s payload. %s", event, err)
+		}
+	}
+	// handlers taking a pointer must not be passed nil when the payload is
+	// missing or null.
+	if arg.Elem().Kind() == reflect.Ptr && arg.Elem().IsNil() {
+		return fmt.Errorf("missing %s payload", event)
+	}
+	fn.Call([]reflect.Value{arg.Elem()})
+	return nil
+}
@@ -0,0 +1,74 @@
+package sockets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebSocketDispatch(t *testing.T) {
+	Convey("Given a websocket with a handler taking a pointer", t, func() {
+		s := &WebSocket{id: "ws-test", handlers: make(map[string]reflect.Value)}
+		var received *ResultBatch
+		s.On("resultBatch", func(batch *ResultBatch) { received = batch })
+
+		Convey("messages with a payload should be passed to the handler", func() {
+			err := s.dispatch("resultBatch", json.RawMessage(`{"seq": 3}`))
+			So(err, ShouldBeNil)
+			So(received, ShouldNotBeNil)
+			So(received.Seq, ShouldEqual, 3)
+		})
+
+		Convey("messages without a payload should be rejected", func() {
+			So(s.dispatch("resultBatch", nil), ShouldNotBeNil)
+			So(s.dispatch("resultBatch", json.RawMessage(`null`)), ShouldNotBeNil)
+			So(received, ShouldBeNil)
+		})
+	})
+}
+
+func TestWebSocketSlowHandler(t *testing.T) {
+	Convey("Given a websocket with a slow handler", t, func() {
+		release := make(chan struct{})
+		handled := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, err := UpgradeWebSocket(w, r, time.Second)
+			if err != nil {
+				return
+			}
+			s.On("slow", func() {
+				<-release
+				close(handled)
+			})
+			s.Serve()
+		}))
+		defer server.Close()
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?protocol=1", nil)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		So(conn.WriteJSON(Message{Version: ProtocolVersion, Type: "slow", Seq: 1}), ShouldBeNil)
+		So(conn.WriteJSON(Message{Version: ProtocolVersion, Type: "heartbeat"}), ShouldBeNil)
+
+		Convey("heartbeats should be answered while the handler runs", func() {
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			msg := Message{}
+			So(conn.ReadJSON(&msg), ShouldBeNil)
+			So(msg.Type, ShouldEqual, "heartbeat")
+
+			close(release)
+			So(conn.ReadJSON(&msg), ShouldBeNil)
+			So(msg.Type, ShouldEqual, "ack")
+			So(msg.Seq, ShouldEqual, 1)
+			<-handled
+		})
+	})
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/alerting"
+	"github.com/raintank/worldping-api/pkg/api/rbody"
+	"github.com/raintank/worldping-api/pkg/api/sockets"
+	"github.com/raintank/worldping-api/pkg/events"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/raintank/worldping-api/pkg/middleware"
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+)
+
+func EvaluateCheck(c *middleware.Context, cmd m.EvaluateCheckCmd) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	check, err := sqlstore.GetCheckById(int64(c.User.ID), id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	endpoint, err := sqlstore.GetEndpointById(int64(c.User.ID), check.EndpointId)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	healthSettings := check.HealthSettings
+	if cmd.HealthSettings != nil {
+		healthSettings = cmd.HealthSettings
+	}
+	if healthSettings == nil {
+		return rbody.ErrResp(m.NewValidationError("check has no healthSettings defined."))
+	}
+	if healthSettings.Steps < 1 || healthSettings.NumProbes < 1 {
+		return rbody.ErrResp(m.NewValidationError("healthSettings steps and num_collectors must be greater than 0."))
+	}
+
+	ts := time.Now()
+	if cmd.Timestamp > 0 {
+		ts = time.Unix(cmd.Timestamp, 0)
+	}
+
+	checkForAlert := &m.CheckForAlertDTO{
+		Id:             check.Id,
+		OrgId:          check.OrgId,
+		EndpointId:     check.EndpointId,
+		Slug:           endpoint.Slug,
+		Name:           endpoint.Name,
+		Type:           string(check.Type),
+		Offset:         check.Offset,
+		Frequency:      check.Frequency,
+		Enabled:        check.Enabled,
+		State:          check.State,
+		StateChange:    check.StateChange,
+		StateCheck:     check.StateCheck,
+		Settings:       check.Settings,
+		HealthSettings: healthSettings,
+		Created:        check.Created,
+		Updated:        check.Updated,
+	}
+
+	evaluation, err := alerting.Evaluate(checkForAlert, healthSettings, ts)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	return rbody.OkResp("evaluation", evaluation)
+}
+
+const (
+	defaultCheckTestTimeout = 10
+	maxCheckTestTimeout     = 60
+)
+
+// checkTests tracks the testCheck requests waiting for results on this instance.
+var checkTests = &checkTestRegistry{pending: make(map[string]chan *m.CheckTestResult)}
+
+type checkTestRegistry struct {
+	sync.Mutex
+	pending map[string]chan *m.CheckTestResult
+}
+
+func (r *checkTestRegistry) add(requestId string, size int) chan *m.CheckTestResult {
+	ch := make(chan *m.CheckTestResult, size)
+	r.Lock()
+	r.pending[requestId] = ch
+	r.Unlock()
+	return ch
+}
+
+func (r *checkTestRegistry) remove(requestId string) {
+	r.Lock()
+	delete(r.pending, requestId)
+	r.Unlock()
+}
+
+// deliver passes a result to the request waiting for it. Results for unknown
+// requests, or for requests on other instances, are ignored.
+func (r *checkTestRegistry) deliver(result *m.CheckTestResult) {
+	r.Lock()
+	defer r.Unlock()
+	ch, ok := r.pending[result.RequestId]
+	if !ok {
+		return
+	}
+	select {
+	case ch <- result:
+	default:
+		log.Debug("dropping unexpected testCheck result %s from probeId=%d", result.RequestId, result.ProbeId)
+	}
+}
+
+func newCheckTestId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkTestKey returns the id used to choose the session that runs a test.
+// Tested checks are not stored, so they have no id of their own, and the
+// request id is used to spread the tests between the sessions of a probe.
+func checkTestKey(requestId string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(requestId))
+	return int64(h.Sum64())
+}
+
+// TestCheck executes a check once on each of the requested probes and returns
+// the results. The check is not stored.
+func TestCheck(c *middleware.Context, cmd m.TestCheckCmd) *rbody.ApiResponse {
+	check := cmd.Check
+	check.Id = 0
+	check.OrgId = int64(c.User.ID)
+	check.Enabled = true
+	check.Route = &m.CheckRoute{
+		Type:   m.RouteByIds,
+		Config: map[string]interface{}{"ids": cmd.Probes},
+	}
+
+	quotas, err := sqlstore.GetOrgQuotas(int64(c.User.ID))
+	if err != nil {
+		return rbody.ErrResp(m.NewValidationError("Error checking quota"))
+	}
+	if err := check.Validate(quotas); err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	timeout := cmd.Timeout
+	if timeout <= 0 {
+		timeout = defaultCheckTestTimeout
+	}
+	if timeout > maxCheckTestTimeout {
+		return rbody.ErrResp(m.NewValidationError("timeout must not be more than 60 seconds."))
+	}
+
+	slug := "test"
+	if check.EndpointId != 0 {
+		endpoint, err := sqlstore.GetEndpointById(int64(c.User.ID), check.EndpointId)
+		if err != nil {
+			return rbody.ErrResp(err)
+		}
+		slug = endpoint.Slug
+	}
+
+	requestId, err := newCheckTestId()
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	results := make(map[int64]*m.CheckTestResult)
+	probeIds := make([]int64, 0, len(cmd.Probes))
+	for _, id := range cmd.Probes {
+		if _, ok := results[id]; ok {
+			continue
+		}
+		probeIds = append(probeIds, id)
+		results[id] = &m.CheckTestResult{RequestId: requestId, ProbeId: id}
+	}
+
+	resultsChan := checkTests.add(requestId, len(probeIds))
+	defer checkTests.remove(requestId)
+
+	waiting := make(map[int64]bool)
+	for _, id := range probeIds {
+		probe, err := sqlstore.GetProbeById(id, int64(c.User.ID))
+		if err != nil {
+			if err == m.ErrProbeNotFound {
+				results[id].Error = "probe not found"
+				continue
+			}
+			return rbody.ErrResp(err)
+		}
+		sessions, err := sqlstore.GetProbeSessions(probe.Id, "", time.Now().Add(-2*heartbeatInterval))
+		if err != nil {
+			return rbody.ErrResp(err)
+		}
+		capable := sockets.CapableSessions(&check, sessions)
+		if len(capable) == 0 && (len(sessions) > 0 || !probe.Capabilities.Supports(&check)) {
+			results[id].Error = "probe does not support this check"
+			continue
+		}
+		sess := sockets.SessionForTest(checkTestKey(requestId), capable)
+		if sess == nil {
+			results[id].Error = "probe is not connected"
+			continue
+		}
+		err = events.Publish(&events.CheckTestRequested{
+			Ts: time.Now(),
+			Payload: &m.CheckTestRequest{
+				RequestId: requestId,
+				ProbeId:   id,
+				SocketId:  sess.SocketId,
+				Check:     m.CheckWithSlug{Check: check, Slug: slug},
+			},
+		}, 0)
+		if err != nil {
+			log.Error(3, "failed to publish testCheck request for probeId=%d. %s", id, err)
+			results[id].Error = "failed to send request to probe"
+			continue
+		}
+		waiting[id] = true
+	}
+
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+WAIT:
+	for len(waiting) > 0 {
+		select {
+		case res := <-resultsChan:
+			if !waiting[res.ProbeId] {
+				continue
+			}
+			delete(waiting, res.ProbeId)
+			results[res.ProbeId] = res
+		case <-timer.C:
+			break WAIT
+		}
+	}
+	for id := range waiting {
+		results[id].Error = "timed out waiting for result"
+	}
+
+	resp := make([]*m.CheckTestResult, len(probeIds))
+	for i, id := range probeIds {
+		resp[i] = results[id]
+	}
+	return rbody.OkResp("checkTest", resp)
+}
@@ -1,10 +1,14 @@
 package api
 
 import (
+	"fmt"
+
 	"github.com/raintank/worldping-api/pkg/api/rbody"
+	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/raintank/worldping-api/pkg/middleware"
 	m "github.com/raintank/worldping-api/pkg/models"
 	"github.com/raintank/worldping-api/pkg/services/endpointdiscovery"
+	"github.com/raintank/worldping-api/pkg/services/management"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
 )
 
@@ -43,69 +47,24 @@ func DeleteEndpoint(c *middleware.Context) *rbody.ApiResponse {
 
 func AddEndpoint(c *middleware.Context, endpoint m.EndpointDTO) *rbody.ApiResponse {
 	endpoint.OrgId = int64(c.User.ID)
-	if endpoint.Name == "" {
-		return rbody.ErrResp(m.NewValidationError("Endpoint name not set."))
-	}
-
-	quotas, err := sqlstore.GetOrgQuotas(int64(c.User.ID))
-	if err != nil {
-		return rbody.ErrResp(m.NewValidationError("Error checking quota"))
-	}
-
-	for i := range endpoint.Checks {
-		check := endpoint.Checks[i]
-		check.OrgId = int64(c.User.ID)
-		if !check.Enabled {
-			continue
-		}
-		if err := check.Validate(quotas); err != nil {
-			return rbody.ErrResp(err)
-		}
 
-		err := sqlstore.ValidateCheckRoute(&check)
-		if err != nil {
-			return rbody.ErrResp(err)
-		}
-	}
-
-	err = sqlstore.AddEndpoint(&endpoint)
+	err := management.AddEndpoint(&endpoint)
 	if err != nil {
 		return rbody.ErrResp(err)
 	}
 
-	return rbody.OkResp("endpoint", endpoint)
+	return rbody.OkRespWithWarnings("endpoint", endpoint, routeWarnings(&endpoint))
 }
 
 func UpdateEndpoint(c *middleware.Context, endpoint m.EndpointDTO) *rbody.ApiResponse {
 	endpoint.OrgId = int64(c.User.ID)
-	if endpoint.Name == "" {
-		return rbody.ErrResp(m.NewValidationError("Endpoint name not set."))
-	}
-	if endpoint.Id == 0 {
-		return rbody.ErrResp(m.NewValidationError("Endpoint id not set."))
-	}
-
-	quotas, err := sqlstore.GetOrgQuotas(int64(c.User.ID))
-	if err != nil {
-		return rbody.ErrResp(m.NewValidationError("Error checking quota"))
-	}
-
-	for i := range endpoint.Checks {
-		check := endpoint.Checks[i]
-		if !check.Enabled {
-			continue
-		}
-		if err := check.Validate(quotas); err != nil {
-			return rbody.ErrResp(err)
-		}
-	}
 
-	err = sqlstore.UpdateEndpoint(&endpoint)
+	err := management.UpdateEndpoint(&endpoint)
 	if err != nil {
 		return rbody.ErrResp(err)
 	}
 
-	return rbody.OkResp("endpoint", endpoint)
+	return rbody.OkRespWithWarnings("endpoint", endpoint, routeWarnings(&endpoint))
 }
 
 func DiscoverEndpoint(c *middleware.Context, cmd m.DiscoverEndpointCmd) *rbody.ApiResponse {
@@ -137,7 +96,7 @@ func DisableEndpoints(c *middleware.Context) *rbody.ApiResponse {
 				disabledChecks[e.Slug] = append(disabledChecks[e.Slug], string(c.Type))
 			}
 		}
-		err := sqlstore.UpdateEndpoint(e)
+		err := management.UpdateEndpoint(e)
 		if err != nil {
 			return rbody.ErrResp(err)
 		}
@@ -145,3 +104,94 @@ func DisableEndpoints(c *middleware.Context) *rbody.ApiResponse {
 
 	return rbody.OkResp("disabledChecks", disabledChecks)
 }
+
+func GetEndpointChecks(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	endpoint, err := sqlstore.GetEndpointById(int64(c.User.ID), id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	return rbody.OkResp("checks", endpoint.Checks)
+}
+
+func GetEndpointCheck(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+	checkId := c.ParamsInt64(":checkId")
+
+	endpoint, err := sqlstore.GetEndpointById(int64(c.User.ID), id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	for _, check := range endpoint.Checks {
+		if check.Id == checkId {
+			return rbody.OkResp("check", check)
+		}
+	}
+
+	return rbody.ErrResp(m.NewNotFoundError("check not found"))
+}
+
+// AddEndpointCheck adds a check to the endpoint without changing the rest of
+// the endpoint.
+func AddEndpointCheck(c *middleware.Context, check m.Check) *rbody.ApiResponse {
+	check.OrgId = int64(c.User.ID)
+	check.EndpointId = c.ParamsInt64(":id")
+	if check.Id != 0 {
+		return rbody.ErrResp(m.NewValidationError("Id already set. Try update instead of create."))
+	}
+
+	if err := management.AddCheck(&check); err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	return rbody.OkRespWithWarnings("check", check, routeWarnings(&m.EndpointDTO{OrgId: check.OrgId, Checks: []m.Check{check}}))
+}
+
+// UpdateEndpointCheck replaces a single check of the endpoint.
+func UpdateEndpointCheck(c *middleware.Context, check m.Check) *rbody.ApiResponse {
+	check.OrgId = int64(c.User.ID)
+	check.EndpointId = c.ParamsInt64(":id")
+	check.Id = c.ParamsInt64(":checkId")
+
+	if err := management.UpdateCheck(&check); err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	return rbody.OkRespWithWarnings("check", check, routeWarnings(&m.EndpointDTO{OrgId: check.OrgId, Checks: []m.Check{check}}))
+}
+
+func DeleteEndpointCheck(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+	checkId := c.ParamsInt64(":checkId")
+
+	err := management.DeleteCheck(int64(c.User.ID), id, checkId)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	return rbody.OkResp("check", nil)
+}
+
+// routeWarnings returns a warning for each enabled check of the endpoint that
+// is not routed to any probe capable of running it.
+func routeWarnings(endpoint *m.EndpointDTO) []string {
+	warnings := make([]string, 0)
+	for i := range endpoint.Checks {
+		check := endpoint.Checks[i]
+		if !check.Enabled {
+			continue
+		}
+		check.OrgId = endpoint.OrgId
+		probes, err := sqlstore.GetProbesForCheck(&check)
+		if err != nil {
+			log.Error(3, "failed to get probes for checkId=%d. %s", check.Id, err)
+			continue
+		}
+		if len(probes) == 0 {
+			warnings = append(warnings, fmt.Sprintf("no probes capable of running the %s check are in its route.", check.Type))
+		}
+	}
+	return warnings
+}
@@ -1,9 +1,14 @@
 package api
 
 import (
+	"time"
+
 	"github.com/raintank/worldping-api/pkg/api/rbody"
+	"github.com/raintank/worldping-api/pkg/api/sockets"
+	"github.com/raintank/worldping-api/pkg/events"
 	"github.com/raintank/worldping-api/pkg/middleware"
 	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/management"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
 )
 
@@ -42,34 +47,312 @@ func DeleteProbe(c *middleware.Context) *rbody.ApiResponse {
 
 func AddProbe(c *middleware.Context, probe m.ProbeDTO) *rbody.ApiResponse {
 	probe.OrgId = int64(c.User.ID)
-	if probe.Id != 0 {
-		return rbody.ErrResp(m.NewValidationError("Id already set. Try update instead of create."))
+
+	if err := management.AddProbe(&probe, c.IsAdmin); err != nil {
+		return rbody.ErrResp(err)
 	}
-	if probe.Name == "" {
-		return rbody.ErrResp(m.NewValidationError("Probe name not set."))
+
+	return rbody.OkResp("probe", probe)
+}
+
+func UpdateProbe(c *middleware.Context, probe m.ProbeDTO) *rbody.ApiResponse {
+	probe.OrgId = int64(c.User.ID)
+
+	if err := management.UpdateProbe(&probe, c.IsAdmin); err != nil {
+		return rbody.ErrResp(err)
 	}
-	if probe.Public {
-		if !c.IsAdmin {
-			return rbody.ErrResp(m.NewValidationError("Only admins can make public probes."))
+
+	return rbody.OkResp("probe", probe)
+}
+
+func GetProbeSessions(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	probe, err := getOwnedProbe(c, id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	sessions, err := sqlstore.GetProbeSessions(probe.Id, "", time.Now().Add(-2*heartbeatInterval))
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	result, err := probeSessionDTOs(probe, sessions)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	return rbody.OkResp("probeSessions", result)
+}
+
+// GetProbeHealth returns the latest health reported by each session of the
+// probe.
+func GetProbeHealth(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	probe, err := getOwnedProbe(c, id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	sessions, err := sqlstore.GetProbeSessions(probe.Id, "", time.Now().Add(-2*heartbeatInterval))
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	result := m.ProbeHealthDTO{
+		ProbeId:  probe.Id,
+		Sessions: make([]m.ProbeSessionHealthDTO, len(sessions)),
+	}
+	for i, sess := range sessions {
+		result.Sessions[i] = m.ProbeSessionHealthDTO{
+			SocketId:        sess.SocketId,
+			InstanceId:      sess.InstanceId,
+			Updated:         sess.Updated,
+			Degraded:        sess.Degraded,
+			DegradedReasons: sess.DegradedReasons,
+			Health:          sess.Health,
+		}
+		if sess.Degraded {
+			since := sess.DegradedSince
+			result.Sessions[i].DegradedSince = &since
+			result.Degraded = true
+		}
+		if result.Sessions[i].DegradedReasons == nil {
+			result.Sessions[i].DegradedReasons = make([]string, 0)
 		}
 	}
 
-	if err := sqlstore.AddProbe(&probe); err != nil {
+	return rbody.OkResp("probeHealth", result)
+}
+
+// DrainProbe stops checks being sent to one or all sessions of a probe. The
+// checks are moved to the remaining sessions and the drained sessions are
+// told they can exit.
+func DrainProbe(c *middleware.Context, cmd m.DrainProbeCmd) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	probe, err := getOwnedProbe(c, id)
+	if err != nil {
 		return rbody.ErrResp(err)
 	}
 
-	return rbody.OkResp("probe", probe)
+	sessions, err := sqlstore.GetProbeSessions(probe.Id, "", time.Now().Add(-2*heartbeatInterval))
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	drained := 0
+	for i := range sessions {
+		if cmd.SocketId != "" && sessions[i].SocketId != cmd.SocketId {
+			continue
+		}
+		drained++
+		if sessions[i].Draining {
+			continue
+		}
+		if err := sqlstore.DrainProbeSession(&sessions[i]); err != nil {
+			return rbody.ErrResp(err)
+		}
+	}
+	if drained == 0 {
+		return rbody.ErrResp(m.ErrProbeSessionNotFound)
+	}
+
+	result, err := probeSessionDTOs(probe, sessions)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeSessions", result)
 }
 
-func UpdateProbe(c *middleware.Context, probe m.ProbeDTO) *rbody.ApiResponse {
-	probe.OrgId = int64(c.User.ID)
-	if probe.Name == "" {
-		return rbody.ErrResp(m.NewValidationError("Probe name not set."))
+// getOwnedProbe returns the probe if it is owned by the user's org. Admins
+// can access any probe.
+func getOwnedProbe(c *middleware.Context, id int64) (*m.ProbeDTO, error) {
+	probe, err := sqlstore.GetProbeById(id, int64(c.User.ID))
+	if err != nil {
+		return nil, err
+	}
+	if probe.OrgId != int64(c.User.ID) && !c.IsAdmin {
+		return nil, m.ErrProbeNotFound
 	}
+	return probe, nil
+}
+
+func probeSessionDTOs(probe *m.ProbeDTO, sessions []m.ProbeSession) ([]m.ProbeSessionDTO, error) {
+	checks, err := sqlstore.GetProbeChecksWithEndpointSlug(probe)
+	if err != nil {
+		return nil, err
+	}
+	assignments := sockets.AssignChecks(checks, sessions)
+
+	result := make([]m.ProbeSessionDTO, len(sessions))
+	for i, sess := range sessions {
+		result[i] = m.ProbeSessionDTO{
+			Id:          sess.Id,
+			SocketId:    sess.SocketId,
+			Version:     sess.Version,
+			InstanceId:  sess.InstanceId,
+			RemoteIp:    sess.RemoteIp,
+			Updated:     sess.Updated,
+			Capacity:    sess.Capacity,
+			Checks:      len(assignments[sess.SocketId].Checks),
+			Load:        assignments[sess.SocketId].Load,
+			LastRefresh: sess.LastRefresh,
+			Draining:    sess.Draining,
+			Country:     sess.Country,
+			City:        sess.City,
+			Asn:         sess.Asn,
+			AsnOrg:      sess.AsnOrg,
+		}
+		// local sockets know when they were last refreshed, others are
+		// only updated in the DB with each heartbeat.
+		if lastRefresh, ok := sockets.LastRefresh(sess.SocketId); ok {
+			result[i].LastRefresh = lastRefresh
+		}
+	}
+	return result, nil
+}
 
-	if err := sqlstore.UpdateProbe(&probe); err != nil {
+// DisconnectProbeSession forcibly terminates a probe session. The session
+// may be connected to any instance, so the disconnect is published as an event.
+func DisconnectProbeSession(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+	socketId := c.Params(":socketId")
+
+	sessions, err := sqlstore.GetProbeSessions(id, "", time.Time{})
+	if err != nil {
 		return rbody.ErrResp(err)
 	}
+	for i := range sessions {
+		if sessions[i].SocketId != socketId {
+			continue
+		}
+		// the instance holding a stale session is gone, so remove it directly.
+		if sessions[i].Updated.Before(time.Now().Add(-2 * heartbeatInterval)) {
+			if err := sqlstore.DeleteProbeSession(&sessions[i]); err != nil {
+				return rbody.ErrResp(err)
+			}
+			return rbody.OkResp("probeSession", nil)
+		}
+		err := events.Publish(&events.ProbeSessionDisconnect{
+			Ts:      time.Now(),
+			Payload: &sessions[i],
+		}, 0)
+		if err != nil {
+			return rbody.ErrResp(err)
+		}
+		return rbody.OkResp("probeSession", nil)
+	}
+	return rbody.ErrResp(m.ErrProbeSessionNotFound)
+}
 
-	return rbody.OkResp("probe", probe)
+func GetProbeTokens(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	probe, err := getOwnedProbe(c, id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	tokens, err := sqlstore.GetProbeTokens(probe.Id, probe.OrgId)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeTokens", tokens)
+}
+
+// AddProbeToken creates a registration token that can only be used to connect
+// the probe. The token is only returned in this response.
+func AddProbeToken(c *middleware.Context, cmd m.AddProbeTokenCmd) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	probe, err := getOwnedProbe(c, id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	token, err := sqlstore.AddProbeToken(probe.Id, probe.OrgId, cmd.Name)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeToken", token)
+}
+
+// DeleteProbeToken revokes a registration token and disconnects the sessions
+// that were authenticated with it.
+func DeleteProbeToken(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+	tokenId := c.ParamsInt64(":tokenId")
+
+	probe, err := getOwnedProbe(c, id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	if err := sqlstore.DeleteProbeToken(probe.Id, probe.OrgId, tokenId); err != nil {
+		return rbody.ErrResp(err)
+	}
+
+	sessions, err := sqlstore.GetProbeSessions(probe.Id, "", time.Time{})
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	for i := range sessions {
+		if sessions[i].TokenId != tokenId {
+			continue
+		}
+		err := events.Publish(&events.ProbeSessionDisconnect{
+			Ts:      time.Now(),
+			Payload: &sessions[i],
+		}, 0)
+		if err != nil {
+			return rbody.ErrResp(err)
+		}
+	}
+	return rbody.OkResp("probeToken", nil)
+}
+
+// GetProbeGrants lists the orgs that can route checks to the probe.
+func GetProbeGrants(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	probe, err := getOwnedProbe(c, id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	grants, err := sqlstore.GetProbeGrants(probe.Id, probe.OrgId)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeGrants", grants)
+}
+
+// AddProbeGrant allows another org to route checks to a private probe.
+func AddProbeGrant(c *middleware.Context, cmd m.AddProbeGrantCmd) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	probe, err := getOwnedProbe(c, id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	if probe.Public {
+		return rbody.ErrResp(m.NewValidationError("public probes can be used by all orgs"))
+	}
+	grant, err := sqlstore.AddProbeGrant(probe.Id, probe.OrgId, cmd.OrgId)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeGrant", grant)
+}
+
+// DeleteProbeGrant revokes the access of an org to the probe. Checks of the
+// org are no longer sent to the probe.
+func DeleteProbeGrant(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+	orgId := c.ParamsInt64(":orgId")
+
+	probe, err := getOwnedProbe(c, id)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	if err := sqlstore.DeleteProbeGrant(probe.Id, probe.OrgId, orgId); err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeGrant", nil)
 }
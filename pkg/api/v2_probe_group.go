@@ -0,0 +1,55 @@
+package api
+
+import (
+	"github.com/raintank/worldping-api/pkg/api/rbody"
+	"github.com/raintank/worldping-api/pkg/middleware"
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+)
+
+func GetProbeGroups(c *middleware.Context) *rbody.ApiResponse {
+	groups, err := sqlstore.GetProbeGroups(int64(c.User.ID))
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeGroups", groups)
+}
+
+func GetProbeGroupById(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	group, err := sqlstore.GetProbeGroupById(id, int64(c.User.ID))
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeGroup", group)
+}
+
+func AddProbeGroup(c *middleware.Context, cmd m.AddProbeGroupCmd) *rbody.ApiResponse {
+	group, err := sqlstore.AddProbeGroup(int64(c.User.ID), &cmd)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeGroup", group)
+}
+
+// UpdateProbeGroup replaces the name and members of a group. Checks routed to
+// the group are moved to the new members.
+func UpdateProbeGroup(c *middleware.Context, cmd m.UpdateProbeGroupCmd) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	group, err := sqlstore.UpdateProbeGroup(id, int64(c.User.ID), &cmd)
+	if err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeGroup", group)
+}
+
+func DeleteProbeGroup(c *middleware.Context) *rbody.ApiResponse {
+	id := c.ParamsInt64(":id")
+
+	if err := sqlstore.DeleteProbeGroup(id, int64(c.User.ID)); err != nil {
+		return rbody.ErrResp(err)
+	}
+	return rbody.OkResp("probeGroup", nil)
+}
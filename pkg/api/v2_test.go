@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/raintank/worldping-api/pkg/api/rbody"
+	"github.com/raintank/worldping-api/pkg/api/sockets"
 	m "github.com/raintank/worldping-api/pkg/models"
 	"github.com/raintank/worldping-api/pkg/services/sqlstore"
 	"github.com/raintank/worldping-api/pkg/setting"
@@ -775,3 +776,327 @@ func TestEndpointV2Api(t *testing.T) {
 		})
 	})
 }
+
+func TestProbeSessionsV2Api(t *testing.T) {
+	InitTestDB(t)
+	r := macaron.Classic()
+	setting.AdminKey = "test"
+	Register(r)
+	sockets.InitCache(&mockPublisher{})
+	populateCollectors(t)
+	session := &m.ProbeSession{
+		OrgId:      1,
+		ProbeId:    1,
+		SocketId:   "sid1",
+		Version:    "1.0.0",
+		InstanceId: "default",
+		RemoteIp:   "127.0.0.1",
+		Capacity:   10,
+	}
+	if err := sqlstore.AddProbeSession(session); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("When listing probe sessions", t, func() {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/api/v2/probes/1/sessions", nil)
+		So(err, ShouldBeNil)
+		addAuthHeader(req)
+
+		r.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 200)
+		response := rbody.ApiResponse{}
+		err = json.Unmarshal(resp.Body.Bytes(), &response)
+		So(err, ShouldBeNil)
+		So(response.Meta.Type, ShouldEqual, "probeSessions")
+
+		sessions := make([]m.ProbeSessionDTO, 0)
+		err = json.Unmarshal(response.Body, &sessions)
+		So(err, ShouldBeNil)
+		So(len(sessions), ShouldEqual, 1)
+		So(sessions[0].SocketId, ShouldEqual, "sid1")
+		So(sessions[0].Version, ShouldEqual, "1.0.0")
+		So(sessions[0].InstanceId, ShouldEqual, "default")
+		So(sessions[0].RemoteIp, ShouldEqual, "127.0.0.1")
+		So(sessions[0].Capacity, ShouldEqual, 10)
+		So(sessions[0].Checks, ShouldEqual, 0)
+	})
+
+	Convey("When disconnecting an unknown probe session", t, func() {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("DELETE", "/api/v2/admin/probes/1/sessions/unknown", nil)
+		So(err, ShouldBeNil)
+		addAuthHeader(req)
+
+		r.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 200)
+		response := rbody.ApiResponse{}
+		err = json.Unmarshal(resp.Body.Bytes(), &response)
+		So(err, ShouldBeNil)
+		So(response.Meta.Code, ShouldEqual, 404)
+	})
+
+	Convey("When draining a probe session", t, func() {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/api/v2/probes/1/drain", bytes.NewReader([]byte(`{"socketId": "sid1"}`)))
+		So(err, ShouldBeNil)
+		addAuthHeader(req)
+		addContentTypeHeader(req)
+
+		r.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 200)
+		response := rbody.ApiResponse{}
+		err = json.Unmarshal(resp.Body.Bytes(), &response)
+		So(err, ShouldBeNil)
+		So(response.Meta.Code, ShouldEqual, 200)
+
+		sessions := make([]m.ProbeSessionDTO, 0)
+		err = json.Unmarshal(response.Body, &sessions)
+		So(err, ShouldBeNil)
+		So(len(sessions), ShouldEqual, 1)
+		So(sessions[0].Draining, ShouldBeTrue)
+		Convey("the session should be draining in the DB", func() {
+			sessions, err := sqlstore.GetProbeSessions(1, "", time.Time{})
+			So(err, ShouldBeNil)
+			So(len(sessions), ShouldEqual, 1)
+			So(sessions[0].Draining, ShouldBeTrue)
+		})
+	})
+
+	Convey("When disconnecting a stale probe session", t, func() {
+		session.Updated = time.Now().Add(-time.Hour)
+		err := sqlstore.UpdateProbeSession(session)
+		So(err, ShouldBeNil)
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("DELETE", "/api/v2/admin/probes/1/sessions/sid1", nil)
+		So(err, ShouldBeNil)
+		addAuthHeader(req)
+
+		r.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 200)
+		response := rbody.ApiResponse{}
+		err = json.Unmarshal(resp.Body.Bytes(), &response)
+		So(err, ShouldBeNil)
+		So(response.Meta.Code, ShouldEqual, 200)
+		Convey("the session should be removed", func() {
+			sessions, err := sqlstore.GetProbeSessions(1, "", time.Time{})
+			So(err, ShouldBeNil)
+			So(len(sessions), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestCheckTestV2Api(t *testing.T) {
+	InitTestDB(t)
+	r := macaron.Classic()
+	setting.AdminKey = "test"
+	Register(r)
+	sockets.InitCache(&mockPublisher{})
+	populateCollectors(t)
+
+	Convey("When testing a check on probes without sessions", t, func() {
+		cmd := m.TestCheckCmd{
+			Check: m.Check{
+				Type:      m.PING_CHECK,
+				Frequency: 60,
+				Settings: map[string]interface{}{
+					"hostname": "www.google.com",
+					"timeout":  5,
+				},
+			},
+			Probes:  []int64{1, 1, 99},
+			Timeout: 1,
+		}
+		body, err := json.Marshal(cmd)
+		So(err, ShouldBeNil)
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/api/v2/checks/test", bytes.NewReader(body))
+		So(err, ShouldBeNil)
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req)
+
+		r.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, 200)
+		response := rbody.ApiResponse{}
+		err = json.Unmarshal(resp.Body.Bytes(), &response)
+		So(err, ShouldBeNil)
+		So(response.Meta.Code, ShouldEqual, 200)
+		So(response.Meta.Type, ShouldEqual, "checkTest")
+
+		results := make([]m.CheckTestResult, 0)
+		err = json.Unmarshal(response.Body, &results)
+		So(err, ShouldBeNil)
+		So(len(results), ShouldEqual, 2)
+		So(results[0].ProbeId, ShouldEqual, 1)
+		So(results[0].Error, ShouldEqual, "probe is not connected")
+		So(results[1].ProbeId, ShouldEqual, 99)
+		So(results[1].Error, ShouldEqual, "probe not found")
+	})
+
+	Convey("When delivering check test results", t, func() {
+		ch := checkTests.add("req1", 1)
+		checkTests.deliver(&m.CheckTestResult{RequestId: "req1", ProbeId: 1})
+		checkTests.deliver(&m.CheckTestResult{RequestId: "req1", ProbeId: 2})
+		checkTests.deliver(&m.CheckTestResult{RequestId: "other", ProbeId: 3})
+		checkTests.remove("req1")
+		So(len(ch), ShouldEqual, 1)
+		res := <-ch
+		So(res.ProbeId, ShouldEqual, 1)
+	})
+}
+
+// v2Response sends the request and decodes the ApiResponse.
+func v2Response(r *macaron.Macaron, method, url string, body interface{}) rbody.ApiResponse {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		So(err, ShouldBeNil)
+	}
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	So(err, ShouldBeNil)
+	addAuthHeader(req)
+	addContentTypeHeader(req)
+	r.ServeHTTP(resp, req)
+	So(resp.Code, ShouldEqual, 200)
+	response := rbody.ApiResponse{}
+	So(json.Unmarshal(resp.Body.Bytes(), &response), ShouldBeNil)
+	return response
+}
+
+func TestEndpointChecksV2Api(t *testing.T) {
+	InitTestDB(t)
+	r := macaron.Classic()
+	setting.AdminKey = "test"
+	setting.Quota = setting.QuotaSettings{
+		Enabled: true,
+		Org: &setting.OrgQuota{
+			Endpoint: 4,
+			Probe:    4,
+		},
+		Global: &setting.GlobalQuota{
+			Endpoint: -1,
+			Probe:    -1,
+		},
+	}
+	Register(r)
+	populateCollectors(t)
+	populateEndpoints(t)
+
+	dns := m.Check{
+		Type:      m.DNS_CHECK,
+		Frequency: 60,
+		Enabled:   true,
+		Route:     &m.CheckRoute{Type: m.RouteByTags, Config: map[string]interface{}{"tags": []string{"test"}}},
+		Settings: map[string]interface{}{
+			"name":   "www1.google.com",
+			"type":   "A",
+			"server": "8.8.8.8",
+		},
+		HealthSettings: &m.CheckHealthSettings{NumProbes: 1, Steps: 3},
+	}
+	var pingId int64
+
+	Convey("Given GET request for /api/v2/endpoints/1/checks", t, func() {
+		response := v2Response(r, "GET", "/api/v2/endpoints/1/checks", nil)
+		So(response.Meta.Code, ShouldEqual, 200)
+		So(response.Meta.Type, ShouldEqual, "checks")
+		checks := make([]m.Check, 0)
+		So(json.Unmarshal(response.Body, &checks), ShouldBeNil)
+		So(len(checks), ShouldEqual, 2)
+		for _, c := range checks {
+			if c.Type == m.PING_CHECK {
+				pingId = c.Id
+			}
+		}
+		So(pingId, ShouldNotEqual, 0)
+	})
+	Convey("Given POST request to add a check to an endpoint", t, func() {
+		response := v2Response(r, "POST", "/api/v2/endpoints/1/checks", &dns)
+		So(response.Meta.Code, ShouldEqual, 200)
+		So(response.Meta.Type, ShouldEqual, "check")
+		So(json.Unmarshal(response.Body, &dns), ShouldBeNil)
+		So(dns.Id, ShouldNotEqual, 0)
+		So(dns.EndpointId, ShouldEqual, 1)
+
+		endpoint, err := sqlstore.GetEndpointById(1, 1)
+		So(err, ShouldBeNil)
+		So(len(endpoint.Checks), ShouldEqual, 3)
+		So(len(endpoint.Tags), ShouldEqual, 2)
+	})
+	Convey("Given POST request to add a second ping check to an endpoint", t, func() {
+		check := dns
+		check.Id = 0
+		check.Type = m.PING_CHECK
+		check.Settings = map[string]interface{}{"hostname": "www1.google.com"}
+		response := v2Response(r, "POST", "/api/v2/endpoints/1/checks", &check)
+		So(response.Meta.Code, ShouldEqual, 400)
+	})
+	Convey("Given POST request to add a disabled check without a route or frequency", t, func() {
+		check := m.Check{Type: m.HTTPS_CHECK, Enabled: false}
+		response := v2Response(r, "POST", "/api/v2/endpoints/2/checks", &check)
+		So(response.Meta.Code, ShouldEqual, 400)
+
+		check.Route = dns.Route
+		response = v2Response(r, "POST", "/api/v2/endpoints/2/checks", &check)
+		So(response.Meta.Code, ShouldEqual, 400)
+
+		check.Frequency = 60
+		response = v2Response(r, "POST", "/api/v2/endpoints/2/checks", &check)
+		So(response.Meta.Code, ShouldEqual, 200)
+	})
+	Convey("Given PUT request to update a check of an endpoint", t, func() {
+		check := dns
+		check.Frequency = 120
+		response := v2Response(r, "PUT", fmt.Sprintf("/api/v2/endpoints/1/checks/%d", dns.Id), &check)
+		So(response.Meta.Code, ShouldEqual, 200)
+
+		stored, err := sqlstore.GetCheckById(1, dns.Id)
+		So(err, ShouldBeNil)
+		So(stored.Frequency, ShouldEqual, 120)
+	})
+	Convey("Given PUT request with an invalid check", t, func() {
+		check := dns
+		check.Frequency = 45
+		response := v2Response(r, "PUT", fmt.Sprintf("/api/v2/endpoints/1/checks/%d", dns.Id), &check)
+		So(response.Meta.Code, ShouldEqual, 400)
+	})
+	Convey("Given GET request for a check of an endpoint", t, func() {
+		response := v2Response(r, "GET", fmt.Sprintf("/api/v2/endpoints/1/checks/%d", pingId), nil)
+		So(response.Meta.Code, ShouldEqual, 200)
+		check := m.Check{}
+		So(json.Unmarshal(response.Body, &check), ShouldBeNil)
+		So(check.Type, ShouldEqual, m.PING_CHECK)
+
+		response = v2Response(r, "GET", fmt.Sprintf("/api/v2/endpoints/2/checks/%d", pingId), nil)
+		So(response.Meta.Code, ShouldEqual, 404)
+	})
+	Convey("Given DELETE request for a check of an endpoint", t, func() {
+		response := v2Response(r, "DELETE", fmt.Sprintf("/api/v2/endpoints/1/checks/%d", dns.Id), nil)
+		So(response.Meta.Code, ShouldEqual, 200)
+
+		endpoint, err := sqlstore.GetEndpointById(1, 1)
+		So(err, ShouldBeNil)
+		So(len(endpoint.Checks), ShouldEqual, 2)
+	})
+}
+
+func TestCheckTestKey(t *testing.T) {
+	Convey("When choosing sessions for check tests", t, func() {
+		sessions := []m.ProbeSession{{SocketId: "a"}, {SocketId: "b"}}
+		used := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			requestId, err := newCheckTestId()
+			So(err, ShouldBeNil)
+			used[sockets.SessionForTest(checkTestKey(requestId), sessions).SocketId] = true
+		}
+		Convey("the tests should be spread between the sessions", func() {
+			So(len(used), ShouldEqual, 2)
+		})
+		Convey("the same request should always use the same session", func() {
+			So(checkTestKey("request"), ShouldEqual, checkTestKey("request"))
+		})
+	})
+}
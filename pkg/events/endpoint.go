@@ -73,3 +73,45 @@ func (a *EndpointUpdated) Timestamp() time.Time {
 func (a *EndpointUpdated) Body() ([]byte, error) {
 	return json.Marshal(a.Payload)
 }
+
+type CheckTestRequested struct {
+	Ts      time.Time
+	Payload *m.CheckTestRequest
+}
+
+func (a *CheckTestRequested) Id() string {
+	return a.Payload.RequestId
+}
+
+func (a *CheckTestRequested) Type() string {
+	return "Check.testRequested"
+}
+
+func (a *CheckTestRequested) Timestamp() time.Time {
+	return a.Ts
+}
+
+func (a *CheckTestRequested) Body() ([]byte, error) {
+	return json.Marshal(a.Payload)
+}
+
+type CheckTestCompleted struct {
+	Ts      time.Time
+	Payload *m.CheckTestResult
+}
+
+func (a *CheckTestCompleted) Id() string {
+	return a.Payload.RequestId
+}
+
+func (a *CheckTestCompleted) Type() string {
+	return "Check.testCompleted"
+}
+
+func (a *CheckTestCompleted) Timestamp() time.Time {
+	return a.Ts
+}
+
+func (a *CheckTestCompleted) Body() ([]byte, error) {
+	return json.Marshal(a.Payload)
+}
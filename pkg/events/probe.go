@@ -157,3 +157,92 @@ func (a *ProbeSessionDeleted) Timestamp() time.Time {
 func (a *ProbeSessionDeleted) Body() ([]byte, error) {
 	return json.Marshal(a.Payload)
 }
+
+type ProbeSessionDisconnect struct {
+	Ts      time.Time
+	Payload *m.ProbeSession
+}
+
+func (a *ProbeSessionDisconnect) Id() string {
+	return fmt.Sprintf("%d", a.Payload.Id)
+}
+
+func (a *ProbeSessionDisconnect) Type() string {
+	return "ProbeSession.disconnect"
+}
+
+func (a *ProbeSessionDisconnect) Timestamp() time.Time {
+	return a.Ts
+}
+
+func (a *ProbeSessionDisconnect) Body() ([]byte, error) {
+	return json.Marshal(a.Payload)
+}
+
+type ProbeSessionDrained struct {
+	Ts      time.Time
+	Payload *m.ProbeSession
+}
+
+func (a *ProbeSessionDrained) Id() string {
+	return fmt.Sprintf("%d", a.Payload.Id)
+}
+
+func (a *ProbeSessionDrained) Type() string {
+	return "ProbeSession.drained"
+}
+
+func (a *ProbeSessionDrained) Timestamp() time.Time {
+	return a.Ts
+}
+
+func (a *ProbeSessionDrained) Body() ([]byte, error) {
+	return json.Marshal(a.Payload)
+}
+
+// ProbeGrantsUpdated is published when an org is granted or loses access to
+// a private probe, so that the checks of the probe can be refreshed.
+type ProbeGrantsUpdated struct {
+	Ts      time.Time
+	Payload *m.ProbeGrant
+}
+
+func (a *ProbeGrantsUpdated) Id() string {
+	return fmt.Sprintf("%d", a.Payload.ProbeId)
+}
+
+func (a *ProbeGrantsUpdated) Type() string {
+	return "Probe.grantsUpdated"
+}
+
+func (a *ProbeGrantsUpdated) Timestamp() time.Time {
+	return a.Ts
+}
+
+func (a *ProbeGrantsUpdated) Body() ([]byte, error) {
+	return json.Marshal(a.Payload)
+}
+
+type ProbeGroupUpdated struct {
+	Ts      time.Time
+	Payload struct {
+		Last    *m.ProbeGroupDTO `json:"last"`
+		Current *m.ProbeGroupDTO `json:"current"`
+	}
+}
+
+func (a *ProbeGroupUpdated) Id() string {
+	return fmt.Sprintf("%d", a.Payload.Current.Id)
+}
+
+func (a *ProbeGroupUpdated) Type() string {
+	return "ProbeGroup.updated"
+}
+
+func (a *ProbeGroupUpdated) Timestamp() time.Time {
+	return a.Ts
+}
+
+func (a *ProbeGroupUpdated) Body() ([]byte, error) {
+	return json.Marshal(a.Payload)
+}
@@ -11,12 +11,109 @@ import (
 // that said, for convenience, we track the generatedAt timestamp
 type AlertingJob struct {
 	*CheckForAlertDTO
-	GeneratedAt time.Time
-	LastPointTs time.Time
-	NewState    CheckEvalResult
-	TimeExec    time.Time
+	GeneratedAt   time.Time
+	LastPointTs   time.Time
+	NewState      CheckEvalResult
+	NewProbeState ProbeStateMap
+	TimeExec      time.Time
+	OutboxId      int64 `json:"-"`
 }
 
 func (job *AlertingJob) String() string {
 	return fmt.Sprintf("<Job> checkId=%d generatedAt=%s lastPointTs=%s definition: %d probes for %d steps", job.Id, job.GeneratedAt, job.LastPointTs, job.HealthSettings.NumProbes, job.HealthSettings.Steps)
 }
+
+// AlertSchedulerStatus describes how far the alerting job dispatcher has
+// progressed relative to wall clock.
+type AlertSchedulerStatus struct {
+	Running      bool      `json:"running"`
+	CatchUpMode  string    `json:"catchUpMode"`
+	CatchUpLimit int64     `json:"catchUpLimit"`
+	Offset       int       `json:"offset"`
+	Position     time.Time `json:"position"`
+	WallClock    time.Time `json:"wallClock"`
+	Lag          int64     `json:"lag"`
+}
+
+type EvalDatapoint struct {
+	Ts    int64    `json:"ts"`
+	Value *float64 `json:"value"`
+}
+
+// ProbeEvalResult records how the error_state series of a single probe was
+// judged during an alert evaluation.
+type ProbeEvalResult struct {
+	Probe         string          `json:"probe"`
+	Target        string          `json:"target"`
+	Datapoints    []EvalDatapoint `json:"datapoints"`
+	NonNullPoints int             `json:"nonNullPoints"`
+	CurrentStreak int             `json:"currentStreak"`
+	MaxStreak     int             `json:"maxStreak"`
+	Bad           bool            `json:"bad"`
+}
+
+type CheckEvalDetails struct {
+	State          CheckEvalResult
+	Probes         []ProbeEvalResult
+	BadProbes      []string
+	ProbesWithData int
+}
+
+// ProbeState returns the state of the check as seen by each probe that
+// returned data.
+func (d *CheckEvalDetails) ProbeState() ProbeStateMap {
+	probeState := make(ProbeStateMap)
+	for _, p := range d.Probes {
+		if p.NonNullPoints == 0 {
+			continue
+		}
+		if p.Bad {
+			probeState[p.Probe] = EvalResultCrit
+		} else {
+			probeState[p.Probe] = EvalResultOK
+		}
+	}
+	return probeState
+}
+
+// CheckEvaluation is the outcome of a dry-run of a check's alerting rule.
+type CheckEvaluation struct {
+	CheckId        int64                `json:"checkId"`
+	Query          string               `json:"query"`
+	Start          time.Time            `json:"start"`
+	End            time.Time            `json:"end"`
+	HealthSettings *CheckHealthSettings `json:"healthSettings"`
+	Probes         []ProbeEvalResult    `json:"probes"`
+	BadProbes      []string             `json:"badProbes"`
+	ProbesWithData int                  `json:"probesWithData"`
+	State          CheckEvalResult      `json:"state"`
+}
+
+// ----------------------
+// COMMANDS
+
+type EvaluateCheckCmd struct {
+	Timestamp      int64                `json:"timestamp"`
+	HealthSettings *CheckHealthSettings `json:"healthSettings"`
+}
+
+type AlertOutboxStatus int
+
+const (
+	// the state of the check still needs to be written to the check table.
+	AlertOutboxPendingState AlertOutboxStatus = iota
+	// the state has been written and resulted in a state change that
+	// notifications still need to be sent for.
+	AlertOutboxPendingNotification
+)
+
+// AlertOutboxEntry is a persisted alerting result that has not yet been
+// fully processed. Entries are replayed when the process restarts.
+type AlertOutboxEntry struct {
+	Id         int64
+	InstanceId string
+	CheckId    int64
+	Status     AlertOutboxStatus
+	Job        *AlertingJob `xorm:"JSON"`
+	Created    time.Time
+}
@@ -10,4 +10,11 @@ type SendEmailCommand struct {
 	Data     map[string]interface{}
 	Massive  bool
 	Info     string
+	// MessageId is used as the Message-ID of the email.
+	MessageId string
+}
+
+type SendWebhookCommand struct {
+	Url  string
+	Body interface{}
 }
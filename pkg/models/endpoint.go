@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -70,6 +71,7 @@ type Check struct {
 	State          CheckEvalResult        `json:"state"`
 	StateChange    time.Time              `json:"stateChange"`
 	StateCheck     time.Time              `json:"stateCheck"`
+	ProbeState     ProbeStateMap          `xorm:"JSON" json:"probeState"`
 	Settings       map[string]interface{} `json:"settings" binding:"Required"`
 	HealthSettings *CheckHealthSettings   `xorm:"JSON" json:"healthSettings"`
 	Created        time.Time              `json:"created"`
@@ -81,25 +83,35 @@ type CheckWithSlug struct {
 	Slug  string `json:"endpointSlug"`
 }
 
+// TestCheckCmd requests a one-off execution of a check by a list of probes.
+type TestCheckCmd struct {
+	Check  Check   `json:"check"`
+	Probes []int64 `json:"probes" binding:"Required"`
+	// seconds to wait for the probes to return their results.
+	Timeout int `json:"timeout"`
+}
+
+// CheckTestRequest is sent to a probe session to execute a check once.
+type CheckTestRequest struct {
+	RequestId string        `json:"requestId"`
+	ProbeId   int64         `json:"probeId"`
+	SocketId  string        `json:"socketId"`
+	Check     CheckWithSlug `json:"check"`
+}
+
+// CheckTestResult is the outcome of a CheckTestRequest.
+type CheckTestResult struct {
+	RequestId string                 `json:"requestId"`
+	ProbeId   int64                  `json:"probeId"`
+	Error     string                 `json:"error"`
+	Results   map[string]interface{} `json:"results"`
+}
+
 func (c Check) Validate(quotas []OrgQuotaDTO) error {
-	// check route config
-	if err := c.Route.Validate(); err != nil {
+	if err := c.ValidateSchedule(); err != nil {
 		return err
 	}
 
-	//check frequency
-	validFreq := map[int64]bool{
-		10:  true,
-		30:  true,
-		60:  true,
-		120: true,
-		300: true,
-		600: true,
-	}
-	if _, ok := validFreq[c.Frequency]; !ok {
-		return NewValidationError("Invalid frequency specified.")
-	}
-
 	//validate Settings.
 	switch c.Type {
 	case HTTP_CHECK:
@@ -124,6 +136,32 @@ func (c Check) Validate(quotas []OrgQuotaDTO) error {
 	return nil
 }
 
+// ValidateSchedule validates the route and frequency of the check. They are
+// needed to store the check, so they are validated even when it is disabled.
+func (c Check) ValidateSchedule() error {
+	// check route config
+	if c.Route == nil {
+		return NewValidationError("check route not set.")
+	}
+	if err := c.Route.Validate(); err != nil {
+		return err
+	}
+
+	//check frequency
+	validFreq := map[int64]bool{
+		10:  true,
+		30:  true,
+		60:  true,
+		120: true,
+		300: true,
+		600: true,
+	}
+	if _, ok := validFreq[c.Frequency]; !ok {
+		return NewValidationError("Invalid frequency specified.")
+	}
+	return nil
+}
+
 type CheckHealthSettings struct {
 	NumProbes     int                      `json:"num_collectors" binding:"Required"`
 	Steps         int                      `json:"steps" binding:"Required"`
@@ -138,8 +176,9 @@ type CheckNotificationSetting struct {
 type RouteType string
 
 const (
-	RouteByTags RouteType = "byTags"
-	RouteByIds  RouteType = "byIds"
+	RouteByTags  RouteType = "byTags"
+	RouteByIds   RouteType = "byIds"
+	RouteByGroup RouteType = "byGroup"
 )
 
 type RouteByIdIndex struct {
@@ -155,6 +194,12 @@ type RouteByTagIndex struct {
 	Tag     string
 	Created time.Time
 }
+type RouteByGroupIndex struct {
+	Id      int64
+	CheckId int64
+	GroupId int64
+	Created time.Time
+}
 
 var (
 	InvalidRouteConfig = NewValidationError("Invalid route config")
@@ -193,7 +238,7 @@ func (t *CheckRoute) UnmarshalJSON(body []byte) error {
 		for k, v := range c {
 			config[k] = v
 		}
-	case RouteByIds:
+	case RouteByIds, RouteByGroup:
 		c := make(map[string][]int64)
 		err = json.Unmarshal(firstPass.Config, &c)
 		if err != nil {
@@ -226,6 +271,13 @@ func (r *CheckRoute) Validate() error {
 		if _, ok := r.Config["ids"]; !ok {
 			return InvalidRouteConfig
 		}
+	case RouteByGroup:
+		if len(r.Config) != 1 {
+			return InvalidRouteConfig
+		}
+		if _, ok := r.Config["groups"]; !ok {
+			return InvalidRouteConfig
+		}
 	default:
 		return UnknownRouteType
 	}
@@ -256,6 +308,34 @@ type CheckState struct {
 	Checked time.Time
 }
 
+// ProbeStateMap holds the state of a check as seen from each probe, keyed by probe slug.
+type ProbeStateMap map[string]CheckEvalResult
+
+// Failing returns the slugs of all probes that are in a critical state.
+func (p ProbeStateMap) Failing() []string {
+	failing := make([]string, 0)
+	for probe, state := range p {
+		if state == EvalResultCrit {
+			failing = append(failing, probe)
+		}
+	}
+	sort.Strings(failing)
+	return failing
+}
+
+// Equal reports whether both maps hold the same state for the same probes.
+func (p ProbeStateMap) Equal(other ProbeStateMap) bool {
+	if len(p) != len(other) {
+		return false
+	}
+	for probe, state := range p {
+		if s, ok := other[probe]; !ok || s != state {
+			return false
+		}
+	}
+	return true
+}
+
 type CheckForAlertDTO struct {
 	Id             int64
 	OrgId          int64
@@ -269,6 +349,7 @@ type CheckForAlertDTO struct {
 	State          CheckEvalResult
 	StateChange    time.Time
 	StateCheck     time.Time
+	ProbeState     ProbeStateMap          `xorm:"JSON"`
 	Settings       map[string]interface{} `xorm:"JSON"`
 	HealthSettings *CheckHealthSettings   `xorm:"JSON"`
 	Created        time.Time
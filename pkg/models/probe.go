@@ -1,6 +1,11 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"reflect"
 	"regexp"
 	"strings"
 	"time"
@@ -8,8 +13,13 @@ import (
 
 // Typed errors
 var (
-	ErrProbeNotFound           = NewNotFoundError("Probe not found")
-	ErrProbeWithSameCodeExists = NewValidationError("A Probe with the same code already exists")
+	ErrProbeNotFound              = NewNotFoundError("Probe not found")
+	ErrProbeWithSameCodeExists    = NewValidationError("A Probe with the same code already exists")
+	ErrProbeSessionNotFound       = NewNotFoundError("Probe session not found")
+	ErrProbeTokenNotFound         = NewNotFoundError("Probe token not found")
+	ErrProbeGrantNotFound         = NewNotFoundError("Probe grant not found")
+	ErrProbeGrantToOwner          = NewValidationError("A probe can not be granted to the org that owns it")
+	ErrProbeCheckRevisionNotFound = NewNotFoundError("Probe check revision not found")
 )
 
 type Probe struct {
@@ -26,6 +36,60 @@ type Probe struct {
 	OnlineChange  time.Time
 	Enabled       bool
 	EnabledChange time.Time
+	Notifications *ProbeNotificationSettings `xorm:"JSON"`
+	Capabilities  *ProbeCapabilities         `xorm:"JSON"`
+	// set when the location was provided by the user rather than looked up
+	// from the address of the probe.
+	LocationOverride bool
+
+	// OfflineNotified is set once the probe owners have been told that the
+	// probe is offline, and cleared when they are told it is back online.
+	OfflineNotified bool
+	// DegradedNotified is set once the probe owners have been told that the
+	// probe is degraded, and cleared when they are told it is healthy again.
+	DegradedNotified bool
+}
+
+// ProbeNotificationSettings control how the owners of a probe are notified
+// when the probe goes offline and comes back online, or is degraded.
+type ProbeNotificationSettings struct {
+	Enabled   bool   `json:"enabled"`
+	Addresses string `json:"addresses"`
+	Webhook   string `json:"webhook"`
+	// number of seconds the probe must be offline before notifying. When 0
+	// the configured default is used.
+	GracePeriod int64 `json:"gracePeriod"`
+}
+
+func (s *ProbeNotificationSettings) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.GracePeriod < 0 {
+		return NewValidationError("notifications gracePeriod must not be negative.")
+	}
+	if s.Webhook != "" {
+		u, err := url.Parse(s.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return NewValidationError("notifications webhook must be a valid http or https url.")
+		}
+	}
+	return nil
+}
+
+// Emails returns the list of email addresses notifications should be sent to.
+func (s *ProbeNotificationSettings) Emails() []string {
+	emails := make([]string, 0)
+	if s == nil {
+		return emails
+	}
+	for _, email := range strings.Split(s.Addresses, ",") {
+		email = strings.TrimSpace(email)
+		if email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
 }
 
 type ProbeTag struct {
@@ -45,6 +109,211 @@ type ProbeSession struct {
 	InstanceId string
 	RemoteIp   string
 	Updated    time.Time
+
+	Capabilities *ProbeCapabilities `xorm:"JSON"`
+	// maximum number of checks per second the session can execute. 0 if the
+	// session did not report its capacity.
+	Capacity    float64
+	LastRefresh time.Time
+	// draining sessions are not assigned any checks.
+	Draining bool
+	// id of the ProbeToken used to authenticate, 0 for API keys.
+	TokenId int64
+	// location of the RemoteIp. Empty if it could not be looked up.
+	Country string
+	City    string
+	Asn     int64
+	AsnOrg  string
+
+	// latest health reported by the session. nil if the session has not
+	// reported its health.
+	Health *ProbeHealth `xorm:"JSON"`
+	// set while the reported health exceeds the configured thresholds.
+	Degraded        bool
+	DegradedSince   time.Time
+	DegradedReasons []string `xorm:"JSON"`
+}
+
+// ProbeSessionSweep counts the changes made when removing stale sessions.
+type ProbeSessionSweep struct {
+	SessionsRemoved     int64
+	ProbesMarkedOffline int64
+	ProbesMarkedOnline  int64
+}
+
+// ProbeHealth is the runtime state periodically reported by probe sessions.
+type ProbeHealth struct {
+	Timestamp time.Time `json:"timestamp"`
+	// number of seconds the execution of checks is behind schedule.
+	CheckLag float64 `json:"checkLag"`
+	// number of checks waiting to be executed.
+	QueueDepth int64 `json:"queueDepth"`
+	// percentage of a single cpu used by the probe.
+	Cpu float64 `json:"cpu"`
+	// memory used by the probe in bytes.
+	Memory int64 `json:"memory"`
+	// number of failed check executions per check type since the previous
+	// report.
+	FailedChecks map[CheckType]int64 `json:"failedChecks"`
+}
+
+// ProbeCapabilities are advertised by probes when they connect. A nil
+// ProbeCapabilities is used for probes that dont advertise their capabilities,
+// which are assumed to be able to run any check.
+type ProbeCapabilities struct {
+	CheckTypes []CheckType `json:"checkTypes"`
+	IpVersions []string    `json:"ipVersions"`
+	Features   []string    `json:"features"`
+}
+
+// ParseProbeCapabilities builds the capabilities from the comma separated
+// lists sent by probes during the handshake. If no capabilities are
+// advertised, nil is returned.
+func ParseProbeCapabilities(checkTypes, ipVersions, features string) (*ProbeCapabilities, error) {
+	if checkTypes == "" && ipVersions == "" && features == "" {
+		return nil, nil
+	}
+	c := &ProbeCapabilities{
+		CheckTypes: make([]CheckType, 0),
+		IpVersions: splitList(ipVersions),
+		Features:   splitList(features),
+	}
+	for _, t := range splitList(checkTypes) {
+		switch CheckType(t) {
+		case HTTP_CHECK, HTTPS_CHECK, DNS_CHECK, PING_CHECK:
+			c.CheckTypes = append(c.CheckTypes, CheckType(t))
+		default:
+			return nil, fmt.Errorf("unknown check type %s", t)
+		}
+	}
+	for _, v := range c.IpVersions {
+		if v != "v4" && v != "v6" {
+			return nil, fmt.Errorf("unknown ip version %s. Expected v4 or v6", v)
+		}
+	}
+	return c, nil
+}
+
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Supports returns true if a probe with these capabilities is able to run
+// the check.
+func (c *ProbeCapabilities) Supports(check *Check) bool {
+	if c == nil {
+		return true
+	}
+	if len(c.CheckTypes) > 0 {
+		supported := false
+		for _, t := range c.CheckTypes {
+			if t == check.Type {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return false
+		}
+	}
+	if len(c.IpVersions) > 0 {
+		ipVersion, _ := check.Settings["ipversion"].(string)
+		if (ipVersion == "v4" || ipVersion == "v6") && !c.hasIpVersion(ipVersion) {
+			return false
+		}
+	}
+	// probes must advertise every feature the check needs from the classes
+	// of capabilities they declare. IPv6 support can also be advertised as an
+	// ip version.
+	for _, feature := range requiredFeatures(check) {
+		if feature == ProbeFeatureIPv6 && c.hasIpVersion("v6") {
+			continue
+		}
+		if !c.HasFeature(feature) && c.declaresClass(probeFeatureClasses[feature]) {
+			return false
+		}
+	}
+	return true
+}
+
+// declaresClass returns true if the probe advertised any capability of the
+// class, in which case features of the class it did not advertise are
+// missing. Probes are assumed to support the features of other classes.
+func (c *ProbeCapabilities) declaresClass(class string) bool {
+	if class == "" {
+		return false
+	}
+	if class == probeCapabilityIp && len(c.IpVersions) > 0 {
+		return true
+	}
+	for _, f := range c.Features {
+		if probeFeatureClasses[f] == class {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ProbeCapabilities) hasIpVersion(ipVersion string) bool {
+	for _, v := range c.IpVersions {
+		if v == ipVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredFeatures returns the features a probe needs to run the check.
+func requiredFeatures(check *Check) []string {
+	features := make([]string, 0)
+	if ipVersion, _ := check.Settings["ipversion"].(string); ipVersion == "v6" {
+		features = append(features, ProbeFeatureIPv6)
+	}
+	return features
+}
+
+const (
+	// ProbeFeatureIncrementalRefresh is advertised by probes that accept
+	// "sync" events with only the changes since their last revision of checks.
+	ProbeFeatureIncrementalRefresh = "incrementalRefresh"
+	// ProbeFeatureIPv6 is advertised by probes that can run checks over IPv6.
+	ProbeFeatureIPv6 = "ipv6"
+)
+
+// classes of capabilities.
+const probeCapabilityIp = "ip"
+
+// probeFeatureClasses maps the features that checks can require to the class
+// of capabilities they belong to.
+var probeFeatureClasses = map[string]string{
+	ProbeFeatureIPv6: probeCapabilityIp,
+}
+
+// HasFeature returns true if the probe advertised the feature.
+func (c *ProbeCapabilities) HasFeature(feature string) bool {
+	if c == nil {
+		return false
+	}
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ProbeCapabilities) Equal(other *ProbeCapabilities) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+	return reflect.DeepEqual(c, other)
 }
 
 // ----------------------
@@ -65,6 +334,62 @@ type ProbeDTO struct {
 	Created       time.Time `json:"created"`
 	Updated       time.Time `json:"updated"`
 	RemoteIp      []string  `json:"remoteIp"`
+
+	Notifications    *ProbeNotificationSettings `json:"notifications"`
+	Capabilities     *ProbeCapabilities         `json:"capabilities"`
+	LocationOverride bool                       `json:"locationOverride"`
+}
+
+type ProbeSessionDTO struct {
+	Id         int64     `json:"id"`
+	SocketId   string    `json:"socketId"`
+	Version    string    `json:"version"`
+	InstanceId string    `json:"instanceId"`
+	RemoteIp   string    `json:"remoteIp"`
+	Updated    time.Time `json:"updated"`
+	Capacity   float64   `json:"capacity"`
+	Checks     int       `json:"checks"`
+	// number of checks executed per second by the session.
+	Load        float64   `json:"load"`
+	LastRefresh time.Time `json:"lastRefresh"`
+	Draining    bool      `json:"draining"`
+	Country     string    `json:"country"`
+	City        string    `json:"city"`
+	Asn         int64     `json:"asn"`
+	AsnOrg      string    `json:"asnOrg"`
+}
+
+// ProbeHealthDTO is the health of a probe and of each of its sessions. The
+// probe is degraded when any of its sessions is.
+type ProbeHealthDTO struct {
+	ProbeId  int64                   `json:"probeId"`
+	Degraded bool                    `json:"degraded"`
+	Sessions []ProbeSessionHealthDTO `json:"sessions"`
+}
+
+type ProbeSessionHealthDTO struct {
+	SocketId        string       `json:"socketId"`
+	InstanceId      string       `json:"instanceId"`
+	Updated         time.Time    `json:"updated"`
+	Degraded        bool         `json:"degraded"`
+	DegradedSince   *time.Time   `json:"degradedSince"`
+	DegradedReasons []string     `json:"degradedReasons"`
+	Health          *ProbeHealth `json:"health"`
+}
+
+// ProbeVersionUsage counts the connected probe sessions running a version.
+type ProbeVersionUsage struct {
+	Version    string `json:"version"`
+	Sessions   int    `json:"sessions"`
+	Probes     int    `json:"probes"`
+	Allowed    bool   `json:"allowed"`
+	Deprecated bool   `json:"deprecated"`
+}
+
+type DrainProbeCmd struct {
+	// only drain the session with this socketId. When empty, all sessions of
+	// the probe are drained.
+	SocketId string `json:"socketId"`
 }
 
 type ProbeLocationDTO struct {
@@ -80,9 +405,74 @@ type ProbeReadyPayload struct {
 	SocketId     string           `json:"socket_id"`
 }
 
+// CheckSyncPayload is sent to probes that support incremental refreshes. A
+// full sync replaces all checks of the probe with Checks. Otherwise the
+// changes since BaseRevision are sent.
+type CheckSyncPayload struct {
+	Revision     int64           `json:"revision"`
+	BaseRevision int64           `json:"baseRevision"`
+	Full         bool            `json:"full"`
+	Checks       []CheckWithSlug `json:"checks"`
+	Created      []CheckWithSlug `json:"created,omitempty"`
+	Updated      []CheckWithSlug `json:"updated,omitempty"`
+	Removed      []int64         `json:"removed,omitempty"`
+}
+
+// CheckSyncAck is sent by probes once they have applied a sync.
+type CheckSyncAck struct {
+	Revision int64 `json:"revision"`
+}
+
+// SyncedCheck is the state of a check when it was sent to a probe.
+type SyncedCheck struct {
+	Updated time.Time `json:"updated"`
+	Slug    string    `json:"slug"`
+}
+
+// ProbeCheckRevision is a revision of the checks sent to a probe session. It
+// is stored so that probes reconnecting with a revision are only sent the
+// changes since that revision. Full syncs are stored with all checks, other
+// syncs only with the changes since BaseRevision.
+type ProbeCheckRevision struct {
+	Id       int64
+	ProbeId  int64
+	Revision int64
+	// revision the changes apply to. 0 if Checks holds all checks.
+	BaseRevision int64
+	// all checks, or the created and updated checks when BaseRevision is set.
+	Checks  map[int64]SyncedCheck `xorm:"JSON"`
+	Removed []int64               `xorm:"JSON"`
+	Created time.Time
+	// number of changes applied to the last full revision to build this
+	// revision, and when that full revision was created. Only set when the
+	// revision is loaded.
+	Changes     int       `xorm:"-"`
+	FullCreated time.Time `xorm:"-"`
+}
+
 // ---------------------
 // QUERIES
 
+// ProbeNotification is the payload sent to a probe's notification webhook.
+type ProbeNotification struct {
+	ProbeId      int64     `json:"probeId"`
+	OrgId        int64     `json:"orgId"`
+	Name         string    `json:"name"`
+	Slug         string    `json:"slug"`
+	State        string    `json:"state"`
+	OnlineChange time.Time `json:"onlineChange"`
+	Timestamp    time.Time `json:"timestamp"`
+	// why the probe is degraded. Only set for the degraded state.
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+const (
+	ProbeStateOffline  = "offline"
+	ProbeStateOnline   = "online"
+	ProbeStateDegraded = "degraded"
+	ProbeStateHealthy  = "healthy"
+)
+
 type GetProbesQuery struct {
 	OrgId   int64  `form:"-"`
 	Public  string `form:"public"`
@@ -100,3 +490,75 @@ func (collector *Probe) UpdateSlug() {
 	re2 := regexp.MustCompile("\\s")
 	collector.Slug = re2.ReplaceAllString(re.ReplaceAllString(name, ""), "-")
 }
+
+// ProbeTokenPrefix is the prefix of all probe registration tokens, used to
+// tell them apart from API keys.
+const ProbeTokenPrefix = "wpt_"
+
+// ProbeToken is a credential that only allows a single probe to connect and
+// submit results. Only the hash of the token is stored.
+type ProbeToken struct {
+	Id       int64
+	OrgId    int64
+	ProbeId  int64
+	Name     string
+	Hash     string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+func (t *ProbeToken) ToDTO() *ProbeTokenDTO {
+	return &ProbeTokenDTO{
+		Id:       t.Id,
+		ProbeId:  t.ProbeId,
+		Name:     t.Name,
+		Created:  t.Created,
+		LastUsed: t.LastUsed,
+	}
+}
+
+func HashProbeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type ProbeTokenDTO struct {
+	Id      int64  `json:"id"`
+	ProbeId int64  `json:"probeId"`
+	Name    string `json:"name"`
+	// only returned when the token is created.
+	Token    string    `json:"token,omitempty"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+type AddProbeTokenCmd struct {
+	Name string `json:"name" binding:"Required"`
+}
+
+// ProbeGrant allows an org other than the owner to route checks to a private
+// probe. Results of those checks are stored in the org of the check.
+type ProbeGrant struct {
+	Id      int64
+	ProbeId int64
+	OrgId   int64
+	Created time.Time
+}
+
+func (g *ProbeGrant) ToDTO() *ProbeGrantDTO {
+	return &ProbeGrantDTO{
+		ProbeId: g.ProbeId,
+		OrgId:   g.OrgId,
+		Created: g.Created,
+	}
+}
+
+type ProbeGrantDTO struct {
+	ProbeId int64     `json:"probeId"`
+	OrgId   int64     `json:"orgId"`
+	Created time.Time `json:"created"`
+}
+
+type AddProbeGrantCmd struct {
+	OrgId int64 `json:"orgId" binding:"Required"`
+}
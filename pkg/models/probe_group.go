@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+)
+
+var (
+	ErrProbeGroupNotFound   = NewNotFoundError("Probe group not found")
+	ErrProbeGroupNameExists = NewValidationError("A probe group with the same name already exists")
+	ErrProbeGroupInUse      = NewValidationError("Probe group is used to route checks")
+)
+
+// ProbeGroup is a named set of probes that checks can be routed to, such as
+// all probes in a region.
+type ProbeGroup struct {
+	Id      int64
+	OrgId   int64
+	Name    string
+	Created time.Time
+	Updated time.Time
+}
+
+type ProbeGroupMember struct {
+	Id      int64
+	GroupId int64
+	ProbeId int64
+	Created time.Time
+}
+
+type ProbeGroupDTO struct {
+	Id      int64     `json:"id"`
+	OrgId   int64     `json:"orgId"`
+	Name    string    `json:"name"`
+	Probes  []int64   `json:"probes"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type AddProbeGroupCmd struct {
+	Name   string  `json:"name" binding:"Required"`
+	Probes []int64 `json:"probes"`
+}
+
+type UpdateProbeGroupCmd struct {
+	Name   string  `json:"name" binding:"Required"`
+	Probes []int64 `json:"probes"`
+}
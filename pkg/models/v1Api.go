@@ -32,6 +32,10 @@ type MonitorSettingDTO struct {
 
 type MonitorSettingsDTO []MonitorSettingDTO
 
+// ToV2Setting converts the settings of a v1 monitor to the settings of a
+// check. Ports are parsed as float64, the type numbers have when a check is
+// decoded from JSON, as Check.Validate expects that type and converts the port
+// to an int itself.
 func (s MonitorSettingsDTO) ToV2Setting(t CheckType) map[string]interface{} {
 	settings := make(map[string]interface{})
 	switch t {
@@ -43,7 +47,7 @@ func (s MonitorSettingsDTO) ToV2Setting(t CheckType) map[string]interface{} {
 			case "path":
 				settings["path"] = v.Value
 			case "port":
-				settings["port"], _ = strconv.ParseInt(v.Value, 10, 64)
+				settings["port"], _ = strconv.ParseFloat(v.Value, 64)
 			case "method":
 				settings["method"] = v.Value
 			case "headers":
@@ -62,7 +66,7 @@ func (s MonitorSettingsDTO) ToV2Setting(t CheckType) map[string]interface{} {
 			case "path":
 				settings["path"] = v.Value
 			case "port":
-				settings["port"], _ = strconv.ParseInt(v.Value, 10, 64)
+				settings["port"], _ = strconv.ParseFloat(v.Value, 64)
 			case "method":
 				settings["method"] = v.Value
 			case "headers":
@@ -94,7 +98,7 @@ func (s MonitorSettingsDTO) ToV2Setting(t CheckType) map[string]interface{} {
 			case "server":
 				settings["server"] = v.Value
 			case "port":
-				settings["port"], _ = strconv.ParseInt(v.Value, 10, 64)
+				settings["port"], _ = strconv.ParseFloat(v.Value, 64)
 			case "protocol":
 				settings["protocol"] = v.Value
 			case "timeout":
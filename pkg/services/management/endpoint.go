@@ -0,0 +1,136 @@
+// Package management validates and stores endpoints, checks and probes. The
+// v1 and v2 APIs both use it so that the same rules apply to each version.
+package management
+
+import (
+	"reflect"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+)
+
+// AddEndpoint validates the endpoint and its enabled checks, then stores it.
+func AddEndpoint(endpoint *m.EndpointDTO) error {
+	if endpoint.Name == "" {
+		return m.NewValidationError("Endpoint name not set.")
+	}
+	if err := validateChecks(endpoint.OrgId, endpoint.Checks, nil); err != nil {
+		return err
+	}
+	return sqlstore.AddEndpoint(endpoint)
+}
+
+// UpdateEndpoint validates the endpoint and the checks that were added or
+// changed, then stores it. Checks that are no longer part of the endpoint are
+// removed.
+func UpdateEndpoint(endpoint *m.EndpointDTO) error {
+	if endpoint.Name == "" {
+		return m.NewValidationError("Endpoint name not set.")
+	}
+	if endpoint.Id == 0 {
+		return m.NewValidationError("Endpoint id not set.")
+	}
+	existing, err := sqlstore.GetEndpointById(endpoint.OrgId, endpoint.Id)
+	if err != nil {
+		return err
+	}
+	if err := validateChecks(endpoint.OrgId, endpoint.Checks, existing.Checks); err != nil {
+		return err
+	}
+	return sqlstore.UpdateEndpoint(endpoint)
+}
+
+// validateChecks ensures that the enabled checks are valid and within the
+// quotas of the org. Only the route and frequency of disabled checks are
+// validated, as they are needed to store the check. Checks that are the same
+// as their stored version are not validated again, so that a check that is no
+// longer valid does not prevent changes to the rest of the endpoint.
+func validateChecks(orgId int64, checks []m.Check, stored []m.Check) error {
+	quotas, err := sqlstore.GetOrgQuotas(orgId)
+	if err != nil {
+		return m.NewValidationError("Error checking quota")
+	}
+	storedById := make(map[int64]*m.Check, len(stored))
+	for i := range stored {
+		storedById[stored[i].Id] = &stored[i]
+	}
+	for i := range checks {
+		check := &checks[i]
+		check.OrgId = orgId
+		if s, ok := storedById[check.Id]; ok && check.Id != 0 && checkUnchanged(check, s) {
+			// the settings are not validated again, but the org may have
+			// lost access to probes or groups in the route since it was
+			// stored, so they are still removed from it.
+			if check.Enabled && check.Route != nil {
+				if err := check.Route.Validate(); err != nil {
+					return err
+				}
+				if err := sqlstore.ValidateCheckRoute(check); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !check.Enabled {
+			if err := check.ValidateSchedule(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ValidateCheck(check, quotas); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUnchanged returns true if the check has the same configuration as its
+// stored version.
+func checkUnchanged(check, stored *m.Check) bool {
+	return check.Type == stored.Type &&
+		check.Frequency == stored.Frequency &&
+		check.Enabled == stored.Enabled &&
+		reflect.DeepEqual(check.Route, stored.Route) &&
+		reflect.DeepEqual(check.Settings, stored.Settings) &&
+		reflect.DeepEqual(check.HealthSettings, stored.HealthSettings)
+}
+
+// validateCheck ensures that the check is valid.
+func validateCheck(check *m.Check) error {
+	checks := []m.Check{*check}
+	if err := validateChecks(check.OrgId, checks, nil); err != nil {
+		return err
+	}
+	*check = checks[0]
+	return nil
+}
+
+// ValidateCheck validates the settings and route of a check. Probes and groups
+// in the route that the org can not use are removed from it.
+func ValidateCheck(check *m.Check, quotas []m.OrgQuotaDTO) error {
+	if err := check.Validate(quotas); err != nil {
+		return err
+	}
+	return sqlstore.ValidateCheckRoute(check)
+}
+
+// AddCheck validates the check, then adds it to its endpoint.
+func AddCheck(check *m.Check) error {
+	if err := validateCheck(check); err != nil {
+		return err
+	}
+	return sqlstore.AddCheck(check)
+}
+
+// UpdateCheck validates the check, then replaces it in its endpoint.
+func UpdateCheck(check *m.Check) error {
+	if err := validateCheck(check); err != nil {
+		return err
+	}
+	return sqlstore.UpdateCheck(check)
+}
+
+// DeleteCheck removes the check from its endpoint.
+func DeleteCheck(orgId, endpointId, checkId int64) error {
+	return sqlstore.DeleteCheck(orgId, endpointId, checkId)
+}
@@ -0,0 +1,77 @@
+package management
+
+import (
+	"testing"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	"github.com/raintank/worldping-api/pkg/setting"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidateChecks(t *testing.T) {
+	if err := sqlstore.MockEngine(); err != nil {
+		t.Fatalf("failed to init DB. %s", err)
+	}
+	setting.Quota = setting.QuotaSettings{
+		Enabled: true,
+		Org: &setting.OrgQuota{
+			Endpoint:      100,
+			Probe:         100,
+			DownloadLimit: 102400,
+		},
+		Global: &setting.GlobalQuota{
+			Endpoint: -1,
+			Probe:    -1,
+		},
+	}
+	invalid := m.Check{
+		Id:        1,
+		Type:      m.PING_CHECK,
+		Frequency: 45,
+		Enabled:   true,
+		Route:     &m.CheckRoute{Type: m.RouteByTags, Config: map[string]interface{}{"tags": []string{"test"}}},
+		Settings:  map[string]interface{}{"hostname": "www.google.com"},
+	}
+
+	Convey("When validating a new invalid check", t, func() {
+		err := validateChecks(1, []m.Check{invalid}, nil)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("When validating an invalid check that has not changed", t, func() {
+		err := validateChecks(1, []m.Check{invalid}, []m.Check{invalid})
+		So(err, ShouldBeNil)
+	})
+	Convey("When validating an invalid check that has been disabled", t, func() {
+		disabled := invalid
+		disabled.Enabled = false
+		err := validateChecks(1, []m.Check{disabled}, []m.Check{invalid})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "frequency")
+	})
+	Convey("When validating a disabled check without a route", t, func() {
+		disabled := invalid
+		disabled.Id = 0
+		disabled.Enabled = false
+		disabled.Frequency = 60
+		disabled.Route = nil
+		err := validateChecks(1, []m.Check{disabled}, nil)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("When validating an unchanged check routed to probes the org can not use", t, func() {
+		probe := &m.ProbeDTO{Name: "validate-route", OrgId: 1, Enabled: true}
+		So(sqlstore.AddProbe(probe), ShouldBeNil)
+		route := func() *m.CheckRoute {
+			return &m.CheckRoute{Type: m.RouteByIds, Config: map[string]interface{}{"ids": []int64{probe.Id, probe.Id + 1000}}}
+		}
+		check := invalid
+		check.Frequency = 60
+		check.Route = route()
+		stored := check
+		stored.Route = route()
+		checks := []m.Check{check}
+		err := validateChecks(1, checks, []m.Check{stored})
+		So(err, ShouldBeNil)
+		So(checks[0].Route.Config["ids"], ShouldResemble, []int64{probe.Id})
+	})
+}
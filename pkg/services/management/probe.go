@@ -0,0 +1,47 @@
+package management
+
+import (
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+)
+
+var ErrPublicProbe = m.NewValidationError("Only admins can make public probes.")
+
+// AddProbe validates the probe, then stores it. Only admins can add public
+// probes.
+func AddProbe(probe *m.ProbeDTO, isAdmin bool) error {
+	if probe.Id != 0 {
+		return m.NewValidationError("Id already set. Try update instead of create.")
+	}
+	if probe.Name == "" {
+		return m.NewValidationError("Probe name not set.")
+	}
+	if probe.Public && !isAdmin {
+		return ErrPublicProbe
+	}
+	if err := probe.Notifications.Validate(); err != nil {
+		return err
+	}
+	return sqlstore.AddProbe(probe)
+}
+
+// UpdateProbe validates the probe, then stores it. Only admins can make a
+// private probe public, though other orgs can still tag public probes.
+func UpdateProbe(probe *m.ProbeDTO, isAdmin bool) error {
+	if probe.Name == "" {
+		return m.NewValidationError("Probe name not set.")
+	}
+	if probe.Public && !isAdmin {
+		existing, err := sqlstore.GetProbeById(probe.Id, probe.OrgId)
+		if err != nil {
+			return err
+		}
+		if existing.OrgId == probe.OrgId && !existing.Public {
+			return ErrPublicProbe
+		}
+	}
+	if err := probe.Notifications.Validate(); err != nil {
+		return err
+	}
+	return sqlstore.UpdateProbe(probe)
+}
@@ -0,0 +1,40 @@
+package management
+
+import (
+	"testing"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPublicProbes(t *testing.T) {
+	if err := sqlstore.MockEngine(); err != nil {
+		t.Fatalf("failed to init DB. %s", err)
+	}
+	private := &m.ProbeDTO{Name: "private", OrgId: 1, Enabled: true}
+	if err := AddProbe(private, false); err != nil {
+		t.Fatal(err)
+	}
+	public := &m.ProbeDTO{Name: "public", OrgId: 2, Public: true, Enabled: true}
+	if err := AddProbe(public, true); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("When a user adds a public probe", t, func() {
+		err := AddProbe(&m.ProbeDTO{Name: "user public", OrgId: 1, Public: true}, false)
+		So(err, ShouldEqual, ErrPublicProbe)
+	})
+	Convey("When a user makes their probe public", t, func() {
+		err := UpdateProbe(&m.ProbeDTO{Id: private.Id, Name: "private", OrgId: 1, Public: true}, false)
+		So(err, ShouldEqual, ErrPublicProbe)
+	})
+	Convey("When a user tags a public probe of another org", t, func() {
+		err := UpdateProbe(&m.ProbeDTO{Id: public.Id, Name: "public", OrgId: 1, Public: true, Tags: []string{"foo"}}, false)
+		So(err, ShouldBeNil)
+	})
+	Convey("When an admin makes a probe public", t, func() {
+		err := UpdateProbe(&m.ProbeDTO{Id: private.Id, Name: "private", OrgId: 1, Public: true}, true)
+		So(err, ShouldBeNil)
+	})
+}
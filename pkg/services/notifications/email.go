@@ -5,18 +5,23 @@ import (
 )
 
 type Message struct {
-	To      []string
-	From    string
-	Subject string
-	Body    string
-	Massive bool
-	Info    string
+	To        []string
+	From      string
+	Subject   string
+	Body      string
+	Massive   bool
+	Info      string
+	MessageId string
 }
 
 // create mail content
 func (m *Message) Content() string {
 	contentType := "text/html; charset=UTF-8"
-	content := "From: " + m.From + "\r\nSubject: " + m.Subject + "\r\nContent-Type: " + contentType + "\r\n\r\n" + m.Body
+	content := "From: " + m.From + "\r\nSubject: " + m.Subject + "\r\nContent-Type: " + contentType + "\r\n"
+	if m.MessageId != "" {
+		content += "Message-ID: " + m.MessageId + "\r\n"
+	}
+	content += "\r\n" + m.Body
 	return content
 }
 
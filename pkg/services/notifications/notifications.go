@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"strings"
 
 	"path/filepath"
 
@@ -43,8 +44,28 @@ func subjectTemplateFunc(obj map[string]interface{}, value string) string {
 }
 
 func SendEmail(cmd *m.SendEmailCommand) error {
+	msg, err := buildMessage(cmd)
+	if err != nil {
+		return err
+	}
+	addToMailQueue(msg)
+	return nil
+}
+
+// SendEmailSync sends the email to the SMTP server before returning, so that
+// callers know whether it was delivered.
+func SendEmailSync(cmd *m.SendEmailCommand) error {
+	msg, err := buildMessage(cmd)
+	if err != nil {
+		return err
+	}
+	_, err = buildAndSend(msg)
+	return err
+}
+
+func buildMessage(cmd *m.SendEmailCommand) (*Message, error) {
 	if !setting.Smtp.Enabled {
-		return errors.New("Worldping mailing/smtp options not configured, contact your network admin")
+		return nil, errors.New("Worldping mailing/smtp options not configured, contact your network admin")
 	}
 	if mailTemplates == nil {
 		log.Fatal(4, "email templates not yet initialized.")
@@ -62,34 +83,46 @@ func SendEmail(cmd *m.SendEmailCommand) error {
 	setDefaultTemplateData(data)
 	err = mailTemplates.ExecuteTemplate(&buffer, cmd.Template, data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	subjectData := data["Subject"].(map[string]interface{})
 	subjectText, hasSubject := subjectData["value"]
 
 	if !hasSubject {
-		return errors.New(fmt.Sprintf("Missing subject in Template %s", cmd.Template))
+		return nil, errors.New(fmt.Sprintf("Missing subject in Template %s", cmd.Template))
 	}
 
 	subjectTmpl, err := template.New("subject").Parse(subjectText.(string))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var subjectBuffer bytes.Buffer
 	err = subjectTmpl.ExecuteTemplate(&subjectBuffer, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	addToMailQueue(&Message{
-		To:      cmd.To,
-		From:    setting.Smtp.FromAddress,
-		Subject: subjectBuffer.String(),
-		Body:    buffer.String(),
-		Massive: true,
-	})
+	return &Message{
+		To:        cmd.To,
+		From:      setting.Smtp.FromAddress,
+		Subject:   subjectBuffer.String(),
+		Body:      buffer.String(),
+		Massive:   true,
+		MessageId: messageId(cmd.MessageId),
+	}, nil
+}
 
-	return nil
+// messageId returns the Message-ID header for an id, using the domain of the
+// from address.
+func messageId(id string) string {
+	if id == "" {
+		return ""
+	}
+	domain := "localhost"
+	if i := strings.LastIndex(setting.Smtp.FromAddress, "@"); i >= 0 {
+		domain = strings.Trim(setting.Smtp.FromAddress[i+1:], "> ")
+	}
+	return fmt.Sprintf("<%s@%s>", id, domain)
 }
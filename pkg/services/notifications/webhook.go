@@ -0,0 +1,101 @@
+package notifications
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+var errWebhookAddress = errors.New("webhook address is not allowed")
+
+// webhook urls are supplied by users, so requests are only allowed to public
+// addresses. Addresses are checked when connecting, after the host name has
+// been resolved, so that names resolving to internal addresses are rejected
+// too. Redirects are checked the same way.
+var webhookClient = &http.Client{
+	Timeout: time.Second * 10,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: time.Second * 5,
+			Control: checkWebhookConn,
+		}).DialContext,
+		TLSHandshakeTimeout: time.Second * 5,
+	},
+}
+
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = n
+	}
+	return networks
+}
+
+// publicAddress returns true if the ip is not a loopback, link-local,
+// private or multicast address.
+func publicAddress(ip net.IP) bool {
+	if ip == nil || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkWebhookConn(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(net.ParseIP(host)) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+// SendWebhook posts the JSON encoded body of the command to its Url.
+func SendWebhook(cmd *m.SendWebhookCommand) error {
+	body, err := json.Marshal(cmd.Body)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(cmd.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned status %d", cmd.Url, resp.StatusCode)
+	}
+	return nil
+}
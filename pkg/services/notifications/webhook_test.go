@@ -0,0 +1,32 @@
+package notifications
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebhookAddresses(t *testing.T) {
+	Convey("When checking webhook addresses", t, func() {
+		for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.20.0.1", "192.168.1.1", "169.254.169.254", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+			So(publicAddress(net.ParseIP(ip)), ShouldBeFalse)
+		}
+		for _, ip := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+			So(publicAddress(net.ParseIP(ip)), ShouldBeTrue)
+		}
+	})
+	Convey("When sending a webhook to an internal address", t, func() {
+		called := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+		defer server.Close()
+		err := SendWebhook(&m.SendWebhookCommand{Url: server.URL, Body: map[string]string{}})
+		So(err, ShouldNotBeNil)
+		So(called, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,200 @@
+package probealerting
+
+import (
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/services/notifications"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	"github.com/raintank/worldping-api/pkg/setting"
+)
+
+var (
+	probeAlertingEmailSent     = stats.NewCounterRate32("probe-alerting.emails.sent")
+	probeAlertingEmailFailed   = stats.NewCounterRate32("probe-alerting.emails.failed")
+	probeAlertingWebhookSent   = stats.NewCounterRate32("probe-alerting.webhooks.sent")
+	probeAlertingWebhookFailed = stats.NewCounterRate32("probe-alerting.webhooks.failed")
+)
+
+// Init starts watching for probes that go offline or come back online, or that
+// become degraded or healthy again, and notifies their owners.
+func Init() {
+	if !setting.ProbeAlerting.Enabled {
+		return
+	}
+	log.Info("ProbeAlerting: starting probe offline notifier")
+	go run(setting.ProbeAlerting.Interval)
+}
+
+func run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		checkProbes(now)
+		checkDegradedProbes(now)
+	}
+}
+
+func checkProbes(now time.Time) {
+	probes, err := sqlstore.GetProbesForOfflineNotification()
+	if err != nil {
+		log.Error(3, "ProbeAlerting: failed to get probes. %s", err)
+		return
+	}
+	for i := range probes {
+		p := &probes[i]
+		state, send := probeState(p, now)
+		if state == "" {
+			continue
+		}
+		// only one instance will succeed in changing the flag, so only one
+		// instance sends the notification.
+		changed, err := sqlstore.SetProbeOfflineNotified(p.Id, state == m.ProbeStateOffline)
+		if err != nil {
+			log.Error(3, "ProbeAlerting: failed to update notified state of probeId=%d. %s", p.Id, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if !send {
+			log.Info("ProbeAlerting: probe is %s, not notifying. probeId=%d, orgId=%d, notificationsEnabled=%t", state, p.Id, p.OrgId, notificationsEnabled(p))
+			continue
+		}
+		notify(p, state, now, nil)
+	}
+}
+
+func checkDegradedProbes(now time.Time) {
+	// probes must be degraded for the grace period before notifying. Sessions
+	// that have not sent a heartbeat for as long are considered gone.
+	gracePeriod := setting.ProbeHealth.GracePeriod
+	probes, degraded, err := sqlstore.GetProbesForDegradedNotification(now.Add(-gracePeriod), now.Add(-gracePeriod))
+	if err != nil {
+		log.Error(3, "ProbeAlerting: failed to get degraded probes. %s", err)
+		return
+	}
+	for i := range probes {
+		p := &probes[i]
+		reasons, isDegraded := degraded[p.Id]
+		state, send := degradedState(p, isDegraded)
+		if state == "" {
+			continue
+		}
+		changed, err := sqlstore.SetProbeDegradedNotified(p.Id, state == m.ProbeStateDegraded)
+		if err != nil {
+			log.Error(3, "ProbeAlerting: failed to update degraded notified state of probeId=%d. %s", p.Id, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if !send {
+			log.Info("ProbeAlerting: cleared degraded state of probe without notifying. probeId=%d, orgId=%d, online=%t, notificationsEnabled=%t", p.Id, p.OrgId, p.Online, notificationsEnabled(p))
+			continue
+		}
+		notify(p, state, now, reasons)
+	}
+}
+
+// probeState returns the state the probe has changed to, or an empty string if
+// it has not changed, and whether the owners of the probe need to be notified
+// of it.
+func probeState(p *m.Probe, now time.Time) (string, bool) {
+	if p.Online {
+		if p.OfflineNotified {
+			return m.ProbeStateOnline, notificationsEnabled(p)
+		}
+		return "", false
+	}
+	if p.OfflineNotified || !p.Enabled || !notificationsEnabled(p) {
+		return "", false
+	}
+	gracePeriod := setting.ProbeAlerting.GracePeriod
+	if p.Notifications.GracePeriod > 0 {
+		gracePeriod = time.Duration(p.Notifications.GracePeriod) * time.Second
+	}
+	if now.Sub(p.OnlineChange) < gracePeriod {
+		return "", false
+	}
+	return m.ProbeStateOffline, true
+}
+
+// degradedState returns the degraded state the probe has changed to, or an
+// empty string if it has not changed, and whether the owners of the probe need
+// to be notified of it. Probes that go offline lose their sessions, so they
+// are no longer degraded, but their owners are notified of them being offline
+// instead of healthy.
+func degradedState(p *m.Probe, degraded bool) (string, bool) {
+	if p.DegradedNotified {
+		if !p.Online {
+			return m.ProbeStateHealthy, false
+		}
+		if !degraded {
+			return m.ProbeStateHealthy, notificationsEnabled(p)
+		}
+		return "", false
+	}
+	if !degraded || !p.Online || !p.Enabled || !notificationsEnabled(p) {
+		return "", false
+	}
+	return m.ProbeStateDegraded, true
+}
+
+func notificationsEnabled(p *m.Probe) bool {
+	return p.Notifications != nil && p.Notifications.Enabled
+}
+
+func notify(p *m.Probe, state string, now time.Time, reasons []string) {
+	log.Info("ProbeAlerting: probe is %s. probeId=%d, orgId=%d, name=%s reasons=%v", state, p.Id, p.OrgId, p.Name, reasons)
+	if !notificationsEnabled(p) {
+		return
+	}
+	if emails := p.Notifications.Emails(); len(emails) > 0 {
+		sendCmd := &m.SendEmailCommand{
+			To:       emails,
+			Template: "probe_notification.html",
+			Data: map[string]interface{}{
+				"ProbeId":      p.Id,
+				"ProbeName":    p.Name,
+				"ProbeSlug":    p.Slug,
+				"State":        state,
+				"OnlineChange": p.OnlineChange,
+				"Reasons":      reasons,
+			},
+		}
+		// sending is slow, so don't hold up the checks of the other probes.
+		go func(cmd *m.SendEmailCommand, probeId int64) {
+			if err := notifications.SendEmail(cmd); err != nil {
+				log.Error(3, "ProbeAlerting: failed to send email to %s. probeId=%d. %s", cmd.To, probeId, err)
+				probeAlertingEmailFailed.Inc()
+			} else {
+				probeAlertingEmailSent.Inc()
+			}
+		}(sendCmd, p.Id)
+	}
+	if p.Notifications.Webhook != "" {
+		cmd := &m.SendWebhookCommand{
+			Url: p.Notifications.Webhook,
+			Body: &m.ProbeNotification{
+				ProbeId:      p.Id,
+				OrgId:        p.OrgId,
+				Name:         p.Name,
+				Slug:         p.Slug,
+				State:        state,
+				OnlineChange: p.OnlineChange,
+				Timestamp:    now,
+				Reasons:      reasons,
+			},
+		}
+		go func(cmd *m.SendWebhookCommand, probeId int64) {
+			if err := notifications.SendWebhook(cmd); err != nil {
+				log.Error(3, "ProbeAlerting: failed to send webhook to %s. probeId=%d. %s", cmd.Url, probeId, err)
+				probeAlertingWebhookFailed.Inc()
+			} else {
+				probeAlertingWebhookSent.Inc()
+			}
+		}(cmd, p.Id)
+	}
+}
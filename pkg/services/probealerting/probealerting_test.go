@@ -0,0 +1,120 @@
+package probealerting
+
+import (
+	"testing"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/setting"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProbeState(t *testing.T) {
+	setting.ProbeAlerting.GracePeriod = time.Minute * 5
+	now := time.Now()
+	Convey("Given a probe with notifications enabled", t, func() {
+		p := &m.Probe{
+			Id:           1,
+			Enabled:      true,
+			OnlineChange: now.Add(-time.Minute),
+			Notifications: &m.ProbeNotificationSettings{
+				Enabled: true,
+			},
+		}
+		Convey("offline within the grace period should not notify", func() {
+			state, _ := probeState(p, now)
+			So(state, ShouldEqual, "")
+		})
+		Convey("offline longer than the grace period should notify", func() {
+			p.OnlineChange = now.Add(-time.Minute * 6)
+			state, send := probeState(p, now)
+			So(state, ShouldEqual, m.ProbeStateOffline)
+			So(send, ShouldBeTrue)
+		})
+		Convey("the probe grace period should override the default", func() {
+			p.Notifications.GracePeriod = 30
+			state, _ := probeState(p, now)
+			So(state, ShouldEqual, m.ProbeStateOffline)
+		})
+		Convey("disabled probes should not notify", func() {
+			p.OnlineChange = now.Add(-time.Minute * 6)
+			p.Enabled = false
+			state, _ := probeState(p, now)
+			So(state, ShouldEqual, "")
+		})
+		Convey("already notified probes should not notify again", func() {
+			p.OnlineChange = now.Add(-time.Minute * 6)
+			p.OfflineNotified = true
+			state, _ := probeState(p, now)
+			So(state, ShouldEqual, "")
+			Convey("until they come back online", func() {
+				p.Online = true
+				state, send := probeState(p, now)
+				So(state, ShouldEqual, m.ProbeStateOnline)
+				So(send, ShouldBeTrue)
+			})
+			Convey("when notifications are disabled the flag should be cleared silently", func() {
+				p.Online = true
+				p.Notifications.Enabled = false
+				state, send := probeState(p, now)
+				So(state, ShouldEqual, m.ProbeStateOnline)
+				So(send, ShouldBeFalse)
+			})
+		})
+		Convey("online probes that were not notified should not notify", func() {
+			p.Online = true
+			state, _ := probeState(p, now)
+			So(state, ShouldEqual, "")
+		})
+	})
+}
+
+func TestDegradedState(t *testing.T) {
+	Convey("Given an online probe with notifications enabled", t, func() {
+		p := &m.Probe{
+			Id:      1,
+			Enabled: true,
+			Online:  true,
+			Notifications: &m.ProbeNotificationSettings{
+				Enabled: true,
+			},
+		}
+		Convey("healthy probes should not notify", func() {
+			state, send := degradedState(p, false)
+			So(state, ShouldEqual, "")
+			So(send, ShouldBeFalse)
+		})
+		Convey("degraded probes should notify", func() {
+			state, send := degradedState(p, true)
+			So(state, ShouldEqual, m.ProbeStateDegraded)
+			So(send, ShouldBeTrue)
+		})
+		Convey("offline probes should not notify", func() {
+			p.Online = false
+			state, _ := degradedState(p, true)
+			So(state, ShouldEqual, "")
+		})
+		Convey("already notified probes should not notify again", func() {
+			p.DegradedNotified = true
+			state, _ := degradedState(p, true)
+			So(state, ShouldEqual, "")
+			Convey("until they are healthy again", func() {
+				state, send := degradedState(p, false)
+				So(state, ShouldEqual, m.ProbeStateHealthy)
+				So(send, ShouldBeTrue)
+			})
+			Convey("when they go offline the flag should be cleared silently", func() {
+				p.Online = false
+				state, send := degradedState(p, false)
+				So(state, ShouldEqual, m.ProbeStateHealthy)
+				So(send, ShouldBeFalse)
+			})
+			Convey("when notifications are disabled the flag should be cleared silently", func() {
+				p.Notifications.Enabled = false
+				state, send := degradedState(p, false)
+				So(state, ShouldEqual, m.ProbeStateHealthy)
+				So(send, ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -0,0 +1,51 @@
+package probesessions
+
+import (
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/raintank/worldping-api/pkg/services/sqlstore"
+	"github.com/raintank/worldping-api/pkg/setting"
+)
+
+var (
+	sweepsFailed        = stats.NewCounter32("probe-sessions.sweeps.failed")
+	sessionsRemoved     = stats.NewCounter32("probe-sessions.stale-removed")
+	probesMarkedOffline = stats.NewCounter32("probe-sessions.probes-marked-offline")
+	probesMarkedOnline  = stats.NewCounter32("probe-sessions.probes-marked-online")
+)
+
+// Init starts periodically removing the sessions of probes that have stopped
+// sending heartbeats, such as the sessions of an instance that died without
+// shutting down. Every instance runs the sweeper, each stale session is only
+// removed once.
+func Init() {
+	if !setting.ProbeSessions.SweepEnabled {
+		return
+	}
+	log.Info("ProbeSessions: starting stale session sweeper")
+	go run(setting.ProbeSessions.SweepInterval)
+}
+
+func run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		sweep(now)
+	}
+}
+
+func sweep(now time.Time) {
+	result, err := sqlstore.SweepProbeSessions(now.Add(-setting.ProbeSessions.StaleAfter))
+	if err != nil {
+		log.Error(3, "ProbeSessions: failed to sweep stale sessions. %s", err)
+		sweepsFailed.Inc()
+		return
+	}
+	sessionsRemoved.Add(int(result.SessionsRemoved))
+	probesMarkedOffline.Add(int(result.ProbesMarkedOffline))
+	probesMarkedOnline.Add(int(result.ProbesMarkedOnline))
+	if result.SessionsRemoved > 0 || result.ProbesMarkedOffline > 0 || result.ProbesMarkedOnline > 0 {
+		log.Info("ProbeSessions: removed %d stale sessions, marked %d probes offline and %d online.", result.SessionsRemoved, result.ProbesMarkedOffline, result.ProbesMarkedOnline)
+	}
+}
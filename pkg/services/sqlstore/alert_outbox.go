@@ -0,0 +1,109 @@
+package sqlstore
+
+import (
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+func AddAlertOutboxEntry(instanceId string, job *m.AlertingJob) error {
+	sess, err := newSession(false, "alert_outbox")
+	if err != nil {
+		return err
+	}
+	return addAlertOutboxEntry(sess, instanceId, job)
+}
+
+func addAlertOutboxEntry(sess *session, instanceId string, job *m.AlertingJob) error {
+	entry := &m.AlertOutboxEntry{
+		InstanceId: instanceId,
+		CheckId:    job.Id,
+		Status:     m.AlertOutboxPendingState,
+		Job:        job,
+		Created:    time.Now(),
+	}
+	if _, err := sess.Insert(entry); err != nil {
+		return err
+	}
+	job.OutboxId = entry.Id
+	return nil
+}
+
+func GetAlertOutboxEntries(instanceId string) ([]m.AlertOutboxEntry, error) {
+	sess, err := newSession(false, "alert_outbox")
+	if err != nil {
+		return nil, err
+	}
+	return getAlertOutboxEntries(sess, instanceId)
+}
+
+func getAlertOutboxEntries(sess *session, instanceId string) ([]m.AlertOutboxEntry, error) {
+	entries := make([]m.AlertOutboxEntry, 0)
+	sess.Where("instance_id=?", instanceId).Asc("id")
+	if err := sess.Find(&entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Job != nil {
+			e.Job.OutboxId = e.Id
+		}
+	}
+	return entries, nil
+}
+
+// ClaimAlertOutboxEntries moves the entries of other instances that were
+// created before olderThan to the instance, so that they are replayed by it.
+func ClaimAlertOutboxEntries(instanceId string, olderThan time.Time) (int64, error) {
+	sess, err := newSession(false, "alert_outbox")
+	if err != nil {
+		return 0, err
+	}
+	return claimAlertOutboxEntries(sess, instanceId, olderThan)
+}
+
+func claimAlertOutboxEntries(sess *session, instanceId string, olderThan time.Time) (int64, error) {
+	res, err := sess.Exec("UPDATE alert_outbox SET instance_id=? WHERE instance_id != ? AND created < ?", instanceId, instanceId, olderThan)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func DeleteAlertOutboxEntry(id int64) error {
+	sess, err := newSession(false, "alert_outbox")
+	if err != nil {
+		return err
+	}
+	return deleteAlertOutboxEntry(sess, id)
+}
+
+func deleteAlertOutboxEntry(sess *session, id int64) error {
+	_, err := sess.Exec("DELETE FROM alert_outbox WHERE id=?", id)
+	return err
+}
+
+// completeAlertOutboxEntries removes the outbox entries of jobs whose state has
+// been stored, unless they resulted in a state change. Those are kept until
+// their notifications have been sent.
+func completeAlertOutboxEntries(sess *session, jobs []*m.AlertingJob, jobsWithStateChange []*m.AlertingJob) error {
+	changed := make(map[int64]struct{})
+	for _, j := range jobsWithStateChange {
+		changed[j.OutboxId] = struct{}{}
+	}
+	for _, j := range jobs {
+		if j.OutboxId == 0 {
+			continue
+		}
+		if _, ok := changed[j.OutboxId]; ok {
+			_, err := sess.Exec("UPDATE alert_outbox SET status=? WHERE id=?", int(m.AlertOutboxPendingNotification), j.OutboxId)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := deleteAlertOutboxEntry(sess, j.OutboxId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package sqlstore
+
+import (
+	"testing"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAlertOutbox(t *testing.T) {
+	InitTestDB(t)
+	populateProbes(t)
+	e := &m.EndpointDTO{
+		Name:  "outbox.google.com",
+		OrgId: 1,
+		Checks: []m.Check{
+			{
+				Route: &m.CheckRoute{
+					Type: m.RouteByIds,
+					Config: map[string]interface{}{
+						"ids": []int64{1},
+					},
+				},
+				Frequency: 60,
+				Type:      m.PING_CHECK,
+				Enabled:   true,
+				Settings: map[string]interface{}{
+					"hostname": "outbox.google.com",
+					"timeout":  5,
+				},
+				HealthSettings: &m.CheckHealthSettings{
+					NumProbes: 1,
+					Steps:     3,
+				},
+			},
+		},
+	}
+	if err := AddEndpoint(e); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("When adding results to the alert outbox", t, func() {
+		jobFor := func(checkId int64) *m.AlertingJob {
+			return &m.AlertingJob{
+				CheckForAlertDTO: &m.CheckForAlertDTO{
+					Id:             checkId,
+					OrgId:          1,
+					HealthSettings: &m.CheckHealthSettings{NumProbes: 1, Steps: 3},
+				},
+				NewState: m.EvalResultCrit,
+				TimeExec: time.Now().Add(time.Second),
+			}
+		}
+		changing := jobFor(e.Checks[0].Id)
+		unknown := jobFor(e.Checks[0].Id + 1000)
+		So(AddAlertOutboxEntry("test", changing), ShouldBeNil)
+		So(AddAlertOutboxEntry("test", unknown), ShouldBeNil)
+		So(AddAlertOutboxEntry("other", jobFor(1)), ShouldBeNil)
+		So(changing.OutboxId, ShouldNotEqual, 0)
+
+		entries, err := GetAlertOutboxEntries("test")
+		So(err, ShouldBeNil)
+		So(entries, ShouldHaveLength, 2)
+		So(entries[0].Status, ShouldEqual, m.AlertOutboxPendingState)
+		So(entries[0].Job.Id, ShouldEqual, changing.Id)
+		So(entries[0].Job.OutboxId, ShouldEqual, changing.OutboxId)
+
+		Convey("storing the state should only keep entries with pending notifications", func() {
+			changes, err := BatchUpdateCheckState([]*m.AlertingJob{changing, unknown})
+			So(err, ShouldBeNil)
+			So(changes, ShouldHaveLength, 1)
+
+			entries, err := GetAlertOutboxEntries("test")
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Id, ShouldEqual, changing.OutboxId)
+			So(entries[0].Status, ShouldEqual, m.AlertOutboxPendingNotification)
+
+			Convey("deleting the entry should empty the outbox", func() {
+				So(DeleteAlertOutboxEntry(changing.OutboxId), ShouldBeNil)
+				entries, err := GetAlertOutboxEntries("test")
+				So(err, ShouldBeNil)
+				So(entries, ShouldHaveLength, 0)
+			})
+		})
+
+		Convey("entries of other instances should only be claimed once old enough", func() {
+			claimed, err := ClaimAlertOutboxEntries("test", time.Now().Add(-time.Hour))
+			So(err, ShouldBeNil)
+			So(claimed, ShouldEqual, 0)
+
+			claimed, err = ClaimAlertOutboxEntries("test", time.Now().Add(time.Second))
+			So(err, ShouldBeNil)
+			So(claimed, ShouldBeGreaterThanOrEqualTo, 1)
+			entries, err := GetAlertOutboxEntries("other")
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 0)
+		})
+	})
+}
@@ -34,6 +34,7 @@ func scrutinizeState(now time.Time, monitor *m.Check) {
 	if monitor.StateCheck.Before(oldest) {
 		monitor.State = m.EvalResultUnknown
 		monitor.StateChange = monitor.StateCheck
+		monitor.ProbeState = nil
 	}
 }
 
@@ -425,6 +426,162 @@ func deleteEndpoint(sess *session, orgId, id int64) error {
 	return nil
 }
 
+// AddCheck adds a check to an existing endpoint. An endpoint can only have one
+// check of each type.
+func AddCheck(c *m.Check) error {
+	sess, err := newSession(true, "endpoint")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+
+	if err = addEndpointCheck(sess, c); err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func addEndpointCheck(sess *session, c *m.Check) error {
+	existing, err := getEndpointById(sess, c.OrgId, c.EndpointId)
+	if err != nil {
+		return err
+	}
+	for _, ec := range existing.Checks {
+		if ec.Type == c.Type {
+			return m.NewValidationError(fmt.Sprintf("an existing %s check is already defined for this endpoint.", c.Type))
+		}
+	}
+	current, err := touchEndpoint(sess, existing)
+	if err != nil {
+		return err
+	}
+	if err := addCheck(sess, c); err != nil {
+		return err
+	}
+	current.Checks = append(current.Checks, *c)
+	publishEndpointUpdated(current, existing)
+	return nil
+}
+
+// UpdateCheck replaces a check of an endpoint. The type of a check can not be
+// changed.
+func UpdateCheck(c *m.Check) error {
+	sess, err := newSession(true, "endpoint")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+
+	if err = updateEndpointCheck(sess, c); err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func updateEndpointCheck(sess *session, c *m.Check) error {
+	existing, err := getEndpointById(sess, c.OrgId, c.EndpointId)
+	if err != nil {
+		return err
+	}
+	pos := -1
+	for i, ec := range existing.Checks {
+		if ec.Id == c.Id {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return m.NewNotFoundError("check not found")
+	}
+	ec := existing.Checks[pos]
+	if ec.Type != c.Type {
+		return m.NewValidationError("check type can not be changed.")
+	}
+	// the state is owned by the alerting engine.
+	c.State = ec.State
+	c.StateChange = ec.StateChange
+	c.StateCheck = ec.StateCheck
+	c.Created = ec.Created
+
+	current, err := touchEndpoint(sess, existing)
+	if err != nil {
+		return err
+	}
+	if err := updateCheck(sess, c); err != nil {
+		return err
+	}
+	current.Checks[pos] = *c
+	publishEndpointUpdated(current, existing)
+	return nil
+}
+
+// DeleteCheck removes a check from an endpoint.
+func DeleteCheck(orgId, endpointId, checkId int64) error {
+	sess, err := newSession(true, "endpoint")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+
+	if err = deleteEndpointCheck(sess, orgId, endpointId, checkId); err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func deleteEndpointCheck(sess *session, orgId, endpointId, checkId int64) error {
+	existing, err := getEndpointById(sess, orgId, endpointId)
+	if err != nil {
+		return err
+	}
+	pos := -1
+	for i, ec := range existing.Checks {
+		if ec.Id == checkId {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return m.NewNotFoundError("check not found")
+	}
+	current, err := touchEndpoint(sess, existing)
+	if err != nil {
+		return err
+	}
+	if err := deleteCheck(sess, &existing.Checks[pos]); err != nil {
+		return err
+	}
+	current.Checks = append(current.Checks[:pos], current.Checks[pos+1:]...)
+	publishEndpointUpdated(current, existing)
+	return nil
+}
+
+// touchEndpoint sets the updated time of the endpoint and returns a copy of it
+// for the checks to be changed in. Checks that are not changed keep an older
+// updated time, so probes are only told about the changed check.
+func touchEndpoint(sess *session, existing *m.EndpointDTO) (*m.EndpointDTO, error) {
+	current := *existing
+	current.Updated = time.Now()
+	current.Checks = make([]m.Check, len(existing.Checks))
+	copy(current.Checks, existing.Checks)
+	rawSql := "UPDATE endpoint SET updated=? WHERE id=? AND org_id=?"
+	if _, err := sess.Exec(rawSql, current.Updated, current.Id, current.OrgId); err != nil {
+		return nil, err
+	}
+	return &current, nil
+}
+
+func publishEndpointUpdated(current, last *m.EndpointDTO) {
+	evnt := new(events.EndpointUpdated)
+	evnt.Ts = current.Updated
+	evnt.Payload.Current = current
+	evnt.Payload.Last = last
+	events.Publish(evnt, 0)
+}
+
 func addCheck(sess *session, c *m.Check) error {
 	c.State = -1
 	c.StateCheck = time.Now()
@@ -468,6 +625,18 @@ func addCheckRoutes(sess *session, c *m.Check) error {
 		if _, err := sess.Insert(&idxs); err != nil {
 			return err
 		}
+	case m.RouteByGroup:
+		idxs := make([]m.RouteByGroupIndex, len(c.Route.Config["groups"].([]int64)))
+		for i, id := range c.Route.Config["groups"].([]int64) {
+			idxs[i] = m.RouteByGroupIndex{
+				CheckId: c.Id,
+				GroupId: id,
+				Created: time.Now(),
+			}
+		}
+		if _, err := sess.Insert(&idxs); err != nil {
+			return err
+		}
 	default:
 		return m.UnknownRouteType
 	}
@@ -478,6 +647,7 @@ func deleteCheckRoutes(sess *session, c *m.Check) error {
 	deletes := []string{
 		"DELETE from route_by_id_index where check_id = ?",
 		"DELETE from route_by_tag_index where check_id = ?",
+		"DELETE from route_by_group_index where check_id = ?",
 	}
 	for _, sql := range deletes {
 		_, err := sess.Exec(sql, c.Id)
@@ -501,13 +671,15 @@ func updateCheck(sess *session, c *m.Check) error {
 		c.StateChange = time.Now()
 		c.State = -1
 	}
-	_, err = sess.Id(c.Id).Update(c)
+	// probe_state is owned by the alerting engine.
+	_, err = sess.Id(c.Id).Omit("probe_state").Update(c)
 	if err != nil {
 		return err
 	}
 
-	// handle task routes.
-	if existing.Route.Type != c.Route.Type {
+	// handle task routes. Group routes only reference a few groups, so they
+	// are always replaced.
+	if existing.Route.Type != c.Route.Type || c.Route.Type == m.RouteByGroup {
 		if err := deleteCheckRoutes(sess, existing); err != nil {
 			return err
 		}
@@ -693,6 +865,13 @@ func getProbeChecks(sess *session, probe *m.ProbeDTO) ([]m.Check, error) {
 	rawParams = append(rawParams, probe.Id)
 	rawQuery = fmt.Sprintf("%s UNION %s", rawQuery, q)
 
+	q = `SELECT DISTINCT(idx.check_id)
+		FROM route_by_group_index as idx
+		INNER JOIN probe_group_member on idx.group_id=probe_group_member.group_id
+		WHERE probe_group_member.probe_id=?`
+	rawParams = append(rawParams, probe.Id)
+	rawQuery = fmt.Sprintf("%s UNION %s", rawQuery, q)
+
 	err := sess.Sql(rawQuery, rawParams...).Find(&checkIds)
 	if err != nil {
 		return nil, err
@@ -708,6 +887,9 @@ func getProbeChecks(sess *session, probe *m.ProbeDTO) ([]m.Check, error) {
 	checkIdsStr := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(cid)), ","), "[]")
 	sess.Table("check")
 	sess.Where(fmt.Sprintf("`check`.id IN (%s)", checkIdsStr)).And("`check`.enabled=1")
+	if !probe.Public {
+		sess.And(probeCheckOrgCond, probe.OrgId, probe.Id)
+	}
 	err = sess.Find(&checks)
 	return checks, err
 }
@@ -717,10 +899,28 @@ func GetProbeChecksWithEndpointSlug(probe *m.ProbeDTO) ([]m.CheckWithSlug, error
 	if err != nil {
 		return nil, err
 	}
-	return getProbeChecksWithEndpointSlug(sess, probe)
+	return getProbeChecksWithEndpointSlug(sess, probe, "`check`.*", "endpoint.slug")
 }
 
-func getProbeChecksWithEndpointSlug(sess *session, probe *m.ProbeDTO) ([]m.CheckWithSlug, error) {
+// probeCheckVersionCols are the columns of checks needed to assign checks to
+// probe sessions and detect which checks changed.
+var probeCheckVersionCols = []string{
+	"`check`.id", "`check`.org_id", "`check`.endpoint_id", "`check`.type", "`check`.frequency",
+	"`check`.enabled", "`check`.settings", "`check`.updated", "endpoint.slug",
+}
+
+// GetProbeCheckVersions returns the checks of the probe without their route,
+// health settings and state, so that the checks that changed can be found
+// without loading all checks in full.
+func GetProbeCheckVersions(probe *m.ProbeDTO) ([]m.CheckWithSlug, error) {
+	sess, err := newSession(false, "check")
+	if err != nil {
+		return nil, err
+	}
+	return getProbeChecksWithEndpointSlug(sess, probe, probeCheckVersionCols...)
+}
+
+func getProbeChecksWithEndpointSlug(sess *session, probe *m.ProbeDTO, cols ...string) ([]m.CheckWithSlug, error) {
 	checks := make([]m.CheckWithSlug, 0)
 
 	type checkIdRow struct {
@@ -738,6 +938,13 @@ func getProbeChecksWithEndpointSlug(sess *session, probe *m.ProbeDTO) ([]m.Check
 	rawParams = append(rawParams, probe.Id)
 	rawQuery = fmt.Sprintf("%s UNION %s", rawQuery, q)
 
+	q = `SELECT DISTINCT(idx.check_id)
+		FROM route_by_group_index as idx
+		INNER JOIN probe_group_member on idx.group_id=probe_group_member.group_id
+		WHERE probe_group_member.probe_id=?`
+	rawParams = append(rawParams, probe.Id)
+	rawQuery = fmt.Sprintf("%s UNION %s", rawQuery, q)
+
 	err := sess.Sql(rawQuery, rawParams...).Find(&checkIds)
 	if err != nil {
 		return nil, err
@@ -754,11 +961,37 @@ func getProbeChecksWithEndpointSlug(sess *session, probe *m.ProbeDTO) ([]m.Check
 	sess.Table("check")
 	sess.Join("INNER", "endpoint", "`check`.endpoint_id=endpoint.id")
 	sess.Where(fmt.Sprintf("`check`.id IN (%s)", checkIdsStr)).And("`check`.enabled=1")
-	sess.Cols("`check`.*", "endpoint.slug")
+	if !probe.Public {
+		sess.And(probeCheckOrgCond, probe.OrgId, probe.Id)
+	}
+	sess.Cols(cols...)
 	err = sess.Find(&checks)
 	return checks, err
 }
 
+// GetChecksWithEndpointSlug returns the enabled checks with the ids.
+func GetChecksWithEndpointSlug(ids []int64) ([]m.CheckWithSlug, error) {
+	sess, err := newSession(false, "check")
+	if err != nil {
+		return nil, err
+	}
+	return getChecksWithEndpointSlug(sess, ids)
+}
+
+func getChecksWithEndpointSlug(sess *session, ids []int64) ([]m.CheckWithSlug, error) {
+	checks := make([]m.CheckWithSlug, 0)
+	if len(ids) == 0 {
+		return checks, nil
+	}
+	checkIdsStr := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(ids)), ","), "[]")
+	sess.Table("check")
+	sess.Join("INNER", "endpoint", "`check`.endpoint_id=endpoint.id")
+	sess.Where(fmt.Sprintf("`check`.id IN (%s)", checkIdsStr)).And("`check`.enabled=1")
+	sess.Cols("`check`.*", "endpoint.slug")
+	err := sess.Find(&checks)
+	return checks, err
+}
+
 func BatchUpdateCheckState(jobs []*m.AlertingJob) ([]*m.AlertingJob, error) {
 	sess, err := newSession(true, "check")
 	if err != nil {
@@ -775,9 +1008,13 @@ func BatchUpdateCheckState(jobs []*m.AlertingJob) ([]*m.AlertingJob, error) {
 
 func batchUpdateCheckState(sess *session, jobs []*m.AlertingJob) ([]*m.AlertingJob, error) {
 	stateSql := "UPDATE `check` SET state=?, state_change=? WHERE id=? AND state != ? AND state_change < ?"
-	lastCheckSql := "UPDATE `check` SET state_check=? WHERE id=? and state_check < ?"
+	lastCheckSql := "UPDATE `check` SET state_check=?, probe_state=? WHERE id=? and state_check < ?"
 	jobsWithStateChange := make([]*m.AlertingJob, 0)
 	for _, j := range jobs {
+		probeState, err := json.Marshal(j.NewProbeState)
+		if err != nil {
+			return nil, err
+		}
 		res, err := sess.Exec(stateSql, int(j.NewState), j.TimeExec, j.Id, int(j.NewState), j.TimeExec)
 		if err != nil {
 			return nil, err
@@ -789,12 +1026,16 @@ func batchUpdateCheckState(sess *session, jobs []*m.AlertingJob) ([]*m.AlertingJ
 			jobsWithStateChange = append(jobsWithStateChange, j)
 		}
 
-		res, err = sess.Exec(lastCheckSql, j.TimeExec, j.Id, j.TimeExec)
+		res, err = sess.Exec(lastCheckSql, j.TimeExec, string(probeState), j.Id, j.TimeExec)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	if err := completeAlertOutboxEntries(sess, jobs, jobsWithStateChange); err != nil {
+		return nil, err
+	}
+
 	return jobsWithStateChange, nil
 }
 
@@ -815,9 +1056,14 @@ func UpdateCheckState(job *m.AlertingJob) (bool, error) {
 
 func updateCheckState(sess *session, j *m.AlertingJob) (bool, error) {
 	stateSql := "UPDATE `check` SET state=?, state_change=? WHERE id=? AND state != ? AND state_change < ?"
-	lastCheckSql := "UPDATE `check` SET state_check=? WHERE id=? and state_check < ?"
+	lastCheckSql := "UPDATE `check` SET state_check=?, probe_state=? WHERE id=? and state_check < ?"
 	stateChange := false
 
+	probeState, err := json.Marshal(j.NewProbeState)
+	if err != nil {
+		return stateChange, err
+	}
+
 	res, err := sess.Exec(stateSql, int(j.NewState), j.TimeExec, j.Id, int(j.NewState), j.TimeExec)
 	if err != nil {
 		return stateChange, err
@@ -829,7 +1075,7 @@ func updateCheckState(sess *session, j *m.AlertingJob) (bool, error) {
 		stateChange = true
 	}
 
-	res, err = sess.Exec(lastCheckSql, j.TimeExec, j.Id, j.TimeExec)
+	res, err = sess.Exec(lastCheckSql, j.TimeExec, string(probeState), j.Id, j.TimeExec)
 
 	return stateChange, err
 }
@@ -858,6 +1104,7 @@ func getChecksForAlerts(sess *session, ts int64) ([]m.CheckForAlertDTO, error) {
 		"`check`.state`",
 		"`check`.state_change",
 		"`check`.state_check",
+		"`check`.probe_state",
 		"`check`.settings",
 		"`check`.health_settings",
 		"`check`.created",
@@ -891,7 +1138,7 @@ func validateCheckRoute(sess *session, check *m.Check) error {
 			return m.NewValidationError("Need at least 1 valid id defined in route config.")
 		}
 		// get all checks.
-		sess.Where("org_id=? OR public=1", check.OrgId).In("id", check.Route.Config["ids"].([]int64))
+		sess.Where(probeAccessCond, check.OrgId, check.OrgId).In("id", check.Route.Config["ids"].([]int64))
 		results := make([]ProbeId, 0)
 		err := sess.Find(&results)
 		if err != nil {
@@ -905,6 +1152,25 @@ func validateCheckRoute(sess *session, check *m.Check) error {
 			filteredIds[i] = row.Id
 		}
 		check.Route.Config["ids"] = filteredIds
+	case m.RouteByGroup:
+		sess.Table("probe_group")
+		if len(check.Route.Config["groups"].([]int64)) == 0 {
+			return m.NewValidationError("Need at least 1 valid group defined in route config.")
+		}
+		sess.Where("org_id=?", check.OrgId).In("id", check.Route.Config["groups"].([]int64))
+		results := make([]m.ProbeGroup, 0)
+		err := sess.Find(&results)
+		if err != nil {
+			return err
+		}
+		if len(results) == 0 {
+			return m.NewValidationError("Need at least 1 valid group defined in route config.")
+		}
+		filteredIds := make([]int64, len(results))
+		for i, row := range results {
+			filteredIds[i] = row.Id
+		}
+		check.Route.Config["groups"] = filteredIds
 	default:
 		return m.NewValidationError(m.UnknownRouteType.Error())
 	}
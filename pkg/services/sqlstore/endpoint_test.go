@@ -145,6 +145,35 @@ func TestEndpoints(t *testing.T) {
 			}
 		}
 
+		Convey("When updating check state", func() {
+			job := &m.AlertingJob{
+				CheckForAlertDTO: &m.CheckForAlertDTO{Id: e.Checks[0].Id},
+				NewState:         m.EvalResultCrit,
+				NewProbeState: m.ProbeStateMap{
+					"test1": m.EvalResultCrit,
+					"test2": m.EvalResultOK,
+				},
+				TimeExec: time.Now().Add(time.Second),
+			}
+			changed, err := UpdateCheckState(job)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeTrue)
+			Convey("probe state should be stored with the check", func() {
+				updated, err := GetEndpointById(e.OrgId, e.Id)
+				So(err, ShouldBeNil)
+				var check *m.Check
+				for i := range updated.Checks {
+					if updated.Checks[i].Id == job.Id {
+						check = &updated.Checks[i]
+					}
+				}
+				So(check, ShouldNotBeNil)
+				So(check.State, ShouldEqual, m.EvalResultCrit)
+				So(check.ProbeState, ShouldResemble, job.NewProbeState)
+				So(check.ProbeState.Failing(), ShouldResemble, []string{"test1"})
+			})
+		})
+
 		Convey("When replacing endpoint tags", func() {
 			e.Tags = []string{"foo", "bar"}
 			err := UpdateEndpoint(e)
@@ -241,3 +270,115 @@ func TestEndpoints(t *testing.T) {
 		So(len(checks), ShouldEqual, (endpointCount*2)-2)
 	})
 }
+
+func TestEndpointChecks(t *testing.T) {
+	InitTestDB(t)
+	populateProbes(t)
+	e := &m.EndpointDTO{
+		Name:  "checks.google.com",
+		OrgId: 1,
+		Tags:  []string{"test"},
+		Checks: []m.Check{
+			{
+				Route: &m.CheckRoute{
+					Type: m.RouteByTags,
+					Config: map[string]interface{}{
+						"tags": []string{"test"},
+					},
+				},
+				Frequency: 60,
+				Type:      m.HTTP_CHECK,
+				Enabled:   true,
+				Settings: map[string]interface{}{
+					"host": "checks.google.com",
+					"path": "/",
+				},
+			},
+		},
+	}
+	if err := AddEndpoint(e); err != nil {
+		t.Fatal(err)
+	}
+	ping := &m.Check{
+		OrgId:      1,
+		EndpointId: e.Id,
+		Route: &m.CheckRoute{
+			Type: m.RouteByIds,
+			Config: map[string]interface{}{
+				"ids": []int64{1, 2},
+			},
+		},
+		Frequency: 60,
+		Type:      m.PING_CHECK,
+		Enabled:   true,
+		Settings: map[string]interface{}{
+			"hostname": "checks.google.com",
+		},
+	}
+
+	Convey("When adding a check to an endpoint", t, func() {
+		err := AddCheck(ping)
+		So(err, ShouldBeNil)
+		So(ping.Id, ShouldNotEqual, 0)
+		endpoint, err := GetEndpointById(1, e.Id)
+		So(err, ShouldBeNil)
+		So(len(endpoint.Checks), ShouldEqual, 2)
+		So(endpoint.Tags, ShouldResemble, []string{"test"})
+		probes, err := GetProbesForCheck(ping)
+		So(err, ShouldBeNil)
+		So(len(probes), ShouldEqual, 2)
+	})
+	Convey("When adding a second check of the same type", t, func() {
+		err := AddCheck(&m.Check{
+			OrgId:      1,
+			EndpointId: e.Id,
+			Route:      ping.Route,
+			Frequency:  60,
+			Type:       m.PING_CHECK,
+			Settings:   ping.Settings,
+		})
+		So(err, ShouldHaveSameTypeAs, m.ValidationError{})
+	})
+	Convey("When updating a check of an endpoint", t, func() {
+		ping.Frequency = 120
+		ping.Route.Config["ids"] = []int64{1}
+		err := UpdateCheck(ping)
+		So(err, ShouldBeNil)
+		endpoint, err := GetEndpointById(1, e.Id)
+		So(err, ShouldBeNil)
+		So(len(endpoint.Checks), ShouldEqual, 2)
+		for _, c := range endpoint.Checks {
+			if c.Type == m.PING_CHECK {
+				So(c.Frequency, ShouldEqual, 120)
+				So(c.Updated.Unix(), ShouldBeGreaterThanOrEqualTo, endpoint.Updated.Unix())
+			} else {
+				So(c.Frequency, ShouldEqual, 60)
+			}
+		}
+		probes, err := GetProbesForCheck(ping)
+		So(err, ShouldBeNil)
+		So(probes, ShouldResemble, []int64{1})
+	})
+	Convey("When changing the type of a check", t, func() {
+		check := *ping
+		check.Type = m.DNS_CHECK
+		err := UpdateCheck(&check)
+		So(err, ShouldHaveSameTypeAs, m.ValidationError{})
+	})
+	Convey("When updating a check of another endpoint", t, func() {
+		check := *ping
+		check.EndpointId = e.Id + 1
+		err := UpdateCheck(&check)
+		So(err, ShouldHaveSameTypeAs, m.NotFoundError{})
+	})
+	Convey("When deleting a check of an endpoint", t, func() {
+		err := DeleteCheck(1, e.Id, ping.Id)
+		So(err, ShouldBeNil)
+		endpoint, err := GetEndpointById(1, e.Id)
+		So(err, ShouldBeNil)
+		So(len(endpoint.Checks), ShouldEqual, 1)
+		So(endpoint.Checks[0].Type, ShouldEqual, m.HTTP_CHECK)
+		err = DeleteCheck(1, e.Id, ping.Id)
+		So(err, ShouldHaveSameTypeAs, m.NotFoundError{})
+	})
+}
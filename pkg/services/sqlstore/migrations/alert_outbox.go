@@ -0,0 +1,23 @@
+package migrations
+
+import . "github.com/raintank/worldping-api/pkg/services/sqlstore/migrator"
+
+func addAlertOutboxMigration(mg *Migrator) {
+
+	var alertOutboxV1 = Table{
+		Name: "alert_outbox",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "instance_id", Type: DB_NVarchar, Length: 255, Nullable: false},
+			{Name: "check_id", Type: DB_BigInt, Nullable: false},
+			{Name: "status", Type: DB_Int, Nullable: false},
+			{Name: "job", Type: DB_Text, Nullable: false},
+			{Name: "created", Type: DB_DateTime, Nullable: false},
+		},
+		Indices: []*Index{
+			{Cols: []string{"instance_id"}},
+		},
+	}
+	mg.AddMigration("create alert_outbox table v1", NewAddTableMigration(alertOutboxV1))
+	addTableIndicesMigrations(mg, "v1", alertOutboxV1)
+}
@@ -439,4 +439,26 @@ func addCheckMigration(mg *Migrator) {
 	}
 
 	mg.AddMigration("Drop old table monitor_collector_tag", NewDropTableMigration("monitor_collector_tag"))
+
+	// add per probe state
+	mg.AddMigration("check add probe_state v1", NewAddColumnMigration(checkV1, &Column{
+		Name: "probe_state", Type: DB_Text, Nullable: true,
+	}))
+
+	// routing of checks to probe groups
+	routeGroupIndexV1 := Table{
+		Name: "route_by_group_index",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "check_id", Type: DB_BigInt, Nullable: false},
+			{Name: "group_id", Type: DB_BigInt, Nullable: false},
+			{Name: "created", Type: DB_DateTime},
+		},
+		Indices: []*Index{
+			{Cols: []string{"check_id", "group_id"}, Type: UniqueIndex},
+			{Cols: []string{"group_id"}},
+		},
+	}
+	mg.AddMigration("create route_by_group_index table v1", NewAddTableMigration(routeGroupIndexV1))
+	addTableIndicesMigrations(mg, "v1", routeGroupIndexV1)
 }
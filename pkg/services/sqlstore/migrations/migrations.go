@@ -14,6 +14,7 @@ func AddMigrations(mg *Migrator) {
 	addEndpointMigration(mg)
 	addAlertSchedulerValueMigration(mg)
 	addQuotaMigration(mg)
+	addAlertOutboxMigration(mg)
 }
 
 func addMigrationLogMigrations(mg *Migrator) {
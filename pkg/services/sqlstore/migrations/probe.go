@@ -154,4 +154,163 @@ func addCollectorMigration(mg *Migrator) {
 	}
 	mg.AddMigration("Drop old table collector_session", NewDropTableMigration("collector_session"))
 
+	// probe offline notifications
+	probeV1 := Table{Name: "probe"}
+	mg.AddMigration("add notifications col to probe table v1",
+		NewAddColumnMigration(probeV1,
+			&Column{Name: "notifications", Type: DB_Text, Nullable: true}))
+	mg.AddMigration("add offline_notified col to probe table v1",
+		NewAddColumnMigration(probeV1,
+			&Column{Name: "offline_notified", Type: DB_Bool, Nullable: false, Default: "0"}))
+
+	// capabilities advertised by probes
+	mg.AddMigration("add capabilities col to probe table v1",
+		NewAddColumnMigration(probeV1,
+			&Column{Name: "capabilities", Type: DB_Text, Nullable: true}))
+	mg.AddMigration("add capabilities col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "capabilities", Type: DB_Text, Nullable: true}))
+
+	// capacity reported by probe sessions
+	mg.AddMigration("add capacity col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "capacity", Type: DB_Float, Nullable: false, Default: "0"}))
+	mg.AddMigration("add last_refresh col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "last_refresh", Type: DB_DateTime, Nullable: true}))
+
+	// sessions being drained before maintenance
+	mg.AddMigration("add draining col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "draining", Type: DB_Bool, Nullable: false, Default: "0"}))
+
+	// probe registration tokens
+	probeTokenV1 := Table{
+		Name: "probe_token",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "org_id", Type: DB_BigInt, Nullable: false},
+			{Name: "probe_id", Type: DB_BigInt, Nullable: false},
+			{Name: "name", Type: DB_NVarchar, Length: 255, Nullable: false},
+			{Name: "hash", Type: DB_NVarchar, Length: 64, Nullable: false},
+			{Name: "created", Type: DB_DateTime, Nullable: false},
+			{Name: "last_used", Type: DB_DateTime, Nullable: true},
+		},
+		Indices: []*Index{
+			{Cols: []string{"probe_id"}},
+			{Cols: []string{"hash"}, Type: UniqueIndex},
+		},
+	}
+	mg.AddMigration("create probe_token table v1", NewAddTableMigration(probeTokenV1))
+	addTableIndicesMigrations(mg, "v1", probeTokenV1)
+	mg.AddMigration("add token_id col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "token_id", Type: DB_BigInt, Nullable: false, Default: "0"}))
+
+	// geoip details of probe sessions and manual probe locations
+	mg.AddMigration("add location_override col to probe table v1",
+		NewAddColumnMigration(probeV1,
+			&Column{Name: "location_override", Type: DB_Bool, Nullable: false, Default: "0"}))
+	mg.AddMigration("add country col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "country", Type: DB_NVarchar, Length: 8, Nullable: true}))
+	mg.AddMigration("add city col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "city", Type: DB_NVarchar, Length: 255, Nullable: true}))
+	mg.AddMigration("add asn col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "asn", Type: DB_BigInt, Nullable: false, Default: "0"}))
+	mg.AddMigration("add asn_org col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "asn_org", Type: DB_NVarchar, Length: 255, Nullable: true}))
+
+	// grants of private probes to other orgs
+	probeGrantV1 := Table{
+		Name: "probe_grant",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "probe_id", Type: DB_BigInt, Nullable: false},
+			{Name: "org_id", Type: DB_BigInt, Nullable: false},
+			{Name: "created", Type: DB_DateTime, Nullable: false},
+		},
+		Indices: []*Index{
+			{Cols: []string{"probe_id", "org_id"}, Type: UniqueIndex},
+			{Cols: []string{"org_id"}},
+		},
+	}
+	mg.AddMigration("create probe_grant table v1", NewAddTableMigration(probeGrantV1))
+	addTableIndicesMigrations(mg, "v1", probeGrantV1)
+
+	// probe groups
+	probeGroupV1 := Table{
+		Name: "probe_group",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "org_id", Type: DB_BigInt, Nullable: false},
+			{Name: "name", Type: DB_NVarchar, Length: 255, Nullable: false},
+			{Name: "created", Type: DB_DateTime, Nullable: false},
+			{Name: "updated", Type: DB_DateTime, Nullable: false},
+		},
+		Indices: []*Index{
+			{Cols: []string{"org_id", "name"}, Type: UniqueIndex},
+		},
+	}
+	mg.AddMigration("create probe_group table v1", NewAddTableMigration(probeGroupV1))
+	addTableIndicesMigrations(mg, "v1", probeGroupV1)
+
+	probeGroupMemberV1 := Table{
+		Name: "probe_group_member",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "group_id", Type: DB_BigInt, Nullable: false},
+			{Name: "probe_id", Type: DB_BigInt, Nullable: false},
+			{Name: "created", Type: DB_DateTime, Nullable: false},
+		},
+		Indices: []*Index{
+			{Cols: []string{"group_id", "probe_id"}, Type: UniqueIndex},
+			{Cols: []string{"probe_id"}},
+		},
+	}
+	mg.AddMigration("create probe_group_member table v1", NewAddTableMigration(probeGroupMemberV1))
+	addTableIndicesMigrations(mg, "v1", probeGroupMemberV1)
+
+	// health reported by probe sessions
+	mg.AddMigration("add health col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "health", Type: DB_Text, Nullable: true}))
+	mg.AddMigration("add degraded col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "degraded", Type: DB_Bool, Nullable: false, Default: "0"}))
+	mg.AddMigration("add degraded_since col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "degraded_since", Type: DB_DateTime, Nullable: true}))
+	mg.AddMigration("add degraded_reasons col to probe_session table v1",
+		NewAddColumnMigration(probeSessionV1,
+			&Column{Name: "degraded_reasons", Type: DB_Text, Nullable: true}))
+	mg.AddMigration("add degraded_notified col to probe table v1",
+		NewAddColumnMigration(probeV1,
+			&Column{Name: "degraded_notified", Type: DB_Bool, Nullable: false, Default: "0"}))
+
+	// revisions of the checks sent to probes with incremental refreshes
+	probeCheckRevisionV1 := Table{
+		Name: "probe_check_revision",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "probe_id", Type: DB_BigInt, Nullable: false},
+			{Name: "revision", Type: DB_BigInt, Nullable: false},
+			{Name: "checks", Type: DB_Text, Nullable: false},
+			{Name: "created", Type: DB_DateTime, Nullable: false},
+		},
+		Indices: []*Index{
+			{Cols: []string{"probe_id", "revision"}, Type: UniqueIndex},
+		},
+	}
+	mg.AddMigration("create probe_check_revision table v1", NewAddTableMigration(probeCheckRevisionV1))
+	addTableIndicesMigrations(mg, "v1", probeCheckRevisionV1)
+	mg.AddMigration("add base_revision col to probe_check_revision table v1",
+		NewAddColumnMigration(probeCheckRevisionV1,
+			&Column{Name: "base_revision", Type: DB_BigInt, Nullable: false, Default: "0"}))
+	mg.AddMigration("add removed col to probe_check_revision table v1",
+		NewAddColumnMigration(probeCheckRevisionV1,
+			&Column{Name: "removed", Type: DB_Text, Nullable: true}))
 }
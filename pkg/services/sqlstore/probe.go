@@ -2,6 +2,7 @@ package sqlstore
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -10,6 +11,7 @@ import (
 	"github.com/raintank/worldping-api/pkg/events"
 	"github.com/raintank/worldping-api/pkg/log"
 	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/setting"
 )
 
 type probeWithTag struct {
@@ -47,6 +49,10 @@ func (rows probeWithTags) ToProbeDTO() []m.ProbeDTO {
 				Longitude:     r.Probe.Longitude,
 				Latitude:      r.Probe.Latitude,
 				RemoteIp:      make([]string, 0),
+				Notifications: r.Probe.Notifications,
+				Capabilities:  r.Probe.Capabilities,
+
+				LocationOverride: r.Probe.LocationOverride,
 			}
 			probeTagsById[r.Probe.Id] = make(map[string]struct{})
 			if r.ProbeTag.Tag != "" {
@@ -147,13 +153,13 @@ func getProbes(sess *session, query *m.GetProbesQuery) ([]m.ProbeDTO, error) {
 			fmt.Fprintf(&where, "%s probe.public=1 ", prefix)
 			prefix = "AND"
 		} else {
-			fmt.Fprintf(&where, "%s (probe.public=0 AND probe.org_id=?) ", prefix)
-			whereArgs = append(whereArgs, query.OrgId)
+			fmt.Fprintf(&where, "%s probe.public=0 AND %s ", prefix, probeAccessCond)
+			whereArgs = append(whereArgs, query.OrgId, query.OrgId)
 			prefix = "AND"
 		}
 	} else {
-		fmt.Fprintf(&where, "%s (probe.org_id=? OR probe.public=1) ", prefix)
-		whereArgs = append(whereArgs, query.OrgId)
+		fmt.Fprintf(&where, "%s %s ", prefix, probeAccessCond)
+		whereArgs = append(whereArgs, query.OrgId, query.OrgId)
 		prefix = "AND"
 	}
 
@@ -218,7 +224,7 @@ func getProbeById(sess *session, id int64, orgId int64) (*m.ProbeDTO, error) {
 	sess.Join("LEFT", "probe_tag", "probe.id = probe_tag.probe_id AND probe_tag.org_id=?", orgId)
 	sess.Join("LEFT", "probe_session", "probe.id = probe_session.probe_id")
 	sess.Where("probe.id=?", id)
-	sess.And("probe.org_id=? OR probe.public=1", orgId)
+	sess.And(probeAccessCond, orgId, orgId)
 	sess.Cols("`probe`.*", "`probe_tag`.*", "`probe_session`.remote_ip")
 	err := sess.Find(&a)
 	if err != nil {
@@ -281,9 +287,14 @@ func addProbe(sess *session, p *m.ProbeDTO) error {
 		OnlineChange:  time.Now(),
 		Created:       time.Now(),
 		Updated:       time.Now(),
+		Notifications: p.Notifications,
+		// a location provided when the probe is created is never replaced by
+		// the location of its address.
+		LocationOverride: p.LocationOverride || p.Latitude != 0 || p.Longitude != 0,
 	}
 	probe.UpdateSlug()
 	p.Slug = probe.Slug
+	p.LocationOverride = probe.LocationOverride
 	sess.UseBool("public")
 	sess.UseBool("enabled")
 	sess.UseBool("online")
@@ -342,9 +353,6 @@ func updateProbe(sess *session, p *m.ProbeDTO) error {
 	if existing == nil {
 		return m.ErrProbeNotFound
 	}
-	if !existing.Public && p.OrgId != existing.OrgId {
-		return m.ErrProbeNotFound
-	}
 	// If the OrgId is different, the only changes that can be made is to Tags.
 	if p.OrgId == existing.OrgId {
 		log.Debug("users owns probe, so can update all fields.")
@@ -363,8 +371,27 @@ func updateProbe(sess *session, p *m.ProbeDTO) error {
 			Created:       existing.Created,
 			Updated:       time.Now(),
 		}
+		// changing the location makes it a manual override. Resetting the
+		// location to 0,0 lets the next lookup replace it.
+		if p.Latitude == 0 && p.Longitude == 0 {
+			probe.LocationOverride = false
+		} else {
+			probe.LocationOverride = existing.LocationOverride || p.LocationOverride || p.Latitude != existing.Latitude || p.Longitude != existing.Longitude
+		}
+		p.LocationOverride = probe.LocationOverride
+		// notification settings are left unchanged when not provided.
+		if p.Notifications == nil {
+			p.Notifications = existing.Notifications
+		}
+		// the column is always written so that disabled or empty settings
+		// replace the existing ones.
+		probe.Notifications = p.Notifications
+		sess.MustCols("notifications")
+		// capabilities can only be set by the probe itself.
+		p.Capabilities = existing.Capabilities
 		sess.UseBool("public")
 		sess.UseBool("enabled")
+		sess.UseBool("location_override")
 		probe.UpdateSlug()
 		p.Slug = probe.Slug
 		if _, err := sess.Id(probe.Id).Update(probe); err != nil {
@@ -453,6 +480,142 @@ func updateProbe(sess *session, p *m.ProbeDTO) error {
 	return nil
 }
 
+// GetProbesForOfflineNotification returns the probes whose owners may need to
+// be notified of the probe going offline or coming back online.
+func GetProbesForOfflineNotification() ([]m.Probe, error) {
+	sess, err := newSession(false, "probe")
+	if err != nil {
+		return nil, err
+	}
+	return getProbesForOfflineNotification(sess)
+}
+
+func getProbesForOfflineNotification(sess *session) ([]m.Probe, error) {
+	probes := make([]m.Probe, 0)
+	sess.Where("(probe.online=0 AND probe.enabled=1 AND probe.offline_notified=0) OR probe.offline_notified=1")
+	sess.And("probe.notifications IS NOT NULL")
+	err := sess.Find(&probes)
+	if err != nil {
+		return nil, err
+	}
+	return probes, nil
+}
+
+// SetProbeOfflineNotified records whether the owners of the probe have been
+// notified of it being offline. It returns false if the flag was already set
+// to the requested value, allowing only one instance to send the notification.
+func SetProbeOfflineNotified(id int64, notified bool) (bool, error) {
+	sess, err := newSession(true, "probe")
+	if err != nil {
+		return false, err
+	}
+	defer sess.Cleanup()
+	changed, err := setProbeOfflineNotified(sess, id, notified)
+	if err != nil {
+		return false, err
+	}
+	sess.Complete()
+	return changed, nil
+}
+
+func setProbeOfflineNotified(sess *session, id int64, notified bool) (bool, error) {
+	rawSql := "UPDATE probe SET offline_notified=? WHERE id=? AND offline_notified=?"
+	result, err := sess.Exec(rawSql, notified, id, !notified)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+// GetProbesForDegradedNotification returns the probes whose owners may need to
+// be notified of the probe becoming degraded or healthy again. The probes that
+// have had a degraded session since before degradedBefore are returned in the
+// map, with the reasons their sessions are degraded. Sessions that have not
+// been updated since activeSince are ignored.
+func GetProbesForDegradedNotification(degradedBefore, activeSince time.Time) ([]m.Probe, map[int64][]string, error) {
+	sess, err := newSession(false, "probe")
+	if err != nil {
+		return nil, nil, err
+	}
+	return getProbesForDegradedNotification(sess, degradedBefore, activeSince)
+}
+
+func getProbesForDegradedNotification(sess *session, degradedBefore, activeSince time.Time) ([]m.Probe, map[int64][]string, error) {
+	sessions := make([]m.ProbeSession, 0)
+	sess.Table("probe_session")
+	sess.Where("degraded=1 AND degraded_since<=? AND updated>?", degradedBefore, activeSince)
+	if err := sess.Find(&sessions); err != nil {
+		return nil, nil, err
+	}
+	degraded := make(map[int64][]string)
+	seen := make(map[int64]map[string]bool)
+	for _, s := range sessions {
+		if seen[s.ProbeId] == nil {
+			seen[s.ProbeId] = make(map[string]bool)
+			degraded[s.ProbeId] = make([]string, 0)
+		}
+		for _, r := range s.DegradedReasons {
+			if !seen[s.ProbeId][r] {
+				seen[s.ProbeId][r] = true
+				degraded[s.ProbeId] = append(degraded[s.ProbeId], r)
+			}
+		}
+	}
+
+	probes := make([]m.Probe, 0)
+	sess.Table("probe")
+	sess.Where("probe.notifications IS NOT NULL")
+	if len(degraded) > 0 {
+		rawParams := make([]interface{}, 0, len(degraded))
+		q := make([]string, 0, len(degraded))
+		for id := range degraded {
+			q = append(q, "?")
+			rawParams = append(rawParams, id)
+		}
+		sess.And(fmt.Sprintf("(probe.degraded_notified=1 OR probe.id IN (%s))", strings.Join(q, ",")), rawParams...)
+	} else {
+		sess.And("probe.degraded_notified=1")
+	}
+	if err := sess.Find(&probes); err != nil {
+		return nil, nil, err
+	}
+	return probes, degraded, nil
+}
+
+// SetProbeDegradedNotified records whether the owners of the probe have been
+// notified of it being degraded. Like SetProbeOfflineNotified it returns false
+// if the flag was already set to the requested value.
+func SetProbeDegradedNotified(id int64, notified bool) (bool, error) {
+	sess, err := newSession(true, "probe")
+	if err != nil {
+		return false, err
+	}
+	defer sess.Cleanup()
+	changed, err := setProbeDegradedNotified(sess, id, notified)
+	if err != nil {
+		return false, err
+	}
+	sess.Complete()
+	return changed, nil
+}
+
+func setProbeDegradedNotified(sess *session, id int64, notified bool) (bool, error) {
+	rawSql := "UPDATE probe SET degraded_notified=? WHERE id=? AND degraded_notified=?"
+	result, err := sess.Exec(rawSql, notified, id, !notified)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
 type ProbeId struct {
 	Id int64
 }
@@ -470,21 +633,37 @@ func getProbesForCheck(sess *session, c *m.Check) ([]int64, error) {
 	probes := make([]*ProbeId, 0)
 	switch c.Route.Type {
 	case m.RouteByTags:
-		//TODO: this list needs to be filtered by probes that support the metrics listed in the task.
 		tags := make([]string, len(c.Route.Config["tags"].([]string)))
 		for i, tag := range c.Route.Config["tags"].([]string) {
 			tags[i] = tag
 		}
 		sess.Join("LEFT", "probe_tag", "probe.id = probe_tag.probe_id AND probe_tag.org_id=?", c.OrgId)
 		sess.In("probe_tag.tag", tags)
+		sess.And(probeAccessCond, c.OrgId, c.OrgId)
 		sess.Distinct("probe.id")
 		err := sess.Find(&probes)
 		if err != nil {
 			return nil, err
 		}
 	case m.RouteByIds:
-		for _, id := range c.Route.Config["ids"].([]int64) {
-			probes = append(probes, &ProbeId{Id: id})
+		// probes the org has lost access to are skipped.
+		sess.Table("probe")
+		sess.In("probe.id", c.Route.Config["ids"].([]int64))
+		sess.And(probeAccessCond, c.OrgId, c.OrgId)
+		sess.Cols("probe.id")
+		err := sess.Find(&probes)
+		if err != nil {
+			return nil, err
+		}
+	case m.RouteByGroup:
+		sess.Join("INNER", "probe_group_member", "probe.id = probe_group_member.probe_id")
+		sess.Join("INNER", "probe_group", "probe_group_member.group_id = probe_group.id AND probe_group.org_id=?", c.OrgId)
+		sess.In("probe_group.id", c.Route.Config["groups"].([]int64))
+		sess.And(probeAccessCond, c.OrgId, c.OrgId)
+		sess.Distinct("probe.id")
+		err := sess.Find(&probes)
+		if err != nil {
+			return nil, err
 		}
 	default:
 		return nil, fmt.Errorf("unknown routeType")
@@ -493,7 +672,113 @@ func getProbesForCheck(sess *session, c *m.Check) ([]int64, error) {
 	for i, a := range probes {
 		probeIds[i] = a.Id
 	}
-	return probeIds, nil
+	return filterCapableProbes(sess, c, probeIds)
+}
+
+type probeCapabilities struct {
+	Id           int64
+	Capabilities *m.ProbeCapabilities `xorm:"JSON"`
+}
+
+type sessionCapabilities struct {
+	ProbeId      int64
+	Capabilities *m.ProbeCapabilities `xorm:"JSON"`
+}
+
+// filterCapableProbes removes the probes that are not able to run the check.
+// Each session of a probe advertises its own capabilities, so connected probes
+// are capable if any of their sessions is. The capabilities last advertised by
+// the probe are used for probes without sessions.
+func filterCapableProbes(sess *session, c *m.Check, probeIds []int64) ([]int64, error) {
+	if len(probeIds) == 0 {
+		return probeIds, nil
+	}
+	sessionRows := make([]sessionCapabilities, 0)
+	sess.Table("probe_session")
+	sess.In("probe_id", probeIds).Cols("probe_id", "capabilities")
+	// sessions of instances that stopped without removing them are ignored
+	// once they would be swept.
+	if setting.ProbeSessions.StaleAfter > 0 {
+		sess.And("updated>?", time.Now().Add(-setting.ProbeSessions.StaleAfter))
+	}
+	if err := sess.Find(&sessionRows); err != nil {
+		return nil, err
+	}
+	connected := make(map[int64]bool)
+	for _, row := range sessionRows {
+		connected[row.ProbeId] = connected[row.ProbeId] || row.Capabilities.Supports(c)
+	}
+	rows := make([]probeCapabilities, 0)
+	sess.Table("probe")
+	sess.In("id", probeIds).Cols("id", "capabilities")
+	if err := sess.Find(&rows); err != nil {
+		return nil, err
+	}
+	incapable := make(map[int64]struct{})
+	for _, row := range rows {
+		capable, ok := connected[row.Id]
+		if !ok {
+			capable = row.Capabilities.Supports(c)
+		}
+		if !capable {
+			incapable[row.Id] = struct{}{}
+		}
+	}
+	if len(incapable) == 0 {
+		return probeIds, nil
+	}
+	filtered := make([]int64, 0, len(probeIds))
+	for _, id := range probeIds {
+		if _, ok := incapable[id]; !ok {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered, nil
+}
+
+// UpdateProbeCapabilities stores the capabilities most recently advertised by
+// the probe. They are only used to route checks while the probe has no
+// sessions, as each session is routed using its own capabilities.
+func UpdateProbeCapabilities(probeId int64, capabilities *m.ProbeCapabilities) error {
+	sess, err := newSession(true, "probe")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+	err = updateProbeCapabilities(sess, probeId, capabilities)
+	if err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func updateProbeCapabilities(sess *session, probeId int64, capabilities *m.ProbeCapabilities) error {
+	var value interface{}
+	if capabilities != nil {
+		raw, err := json.Marshal(capabilities)
+		if err != nil {
+			return err
+		}
+		value = string(raw)
+	}
+	_, err := sess.Exec("UPDATE probe SET capabilities=? WHERE id=?", value, probeId)
+	return err
+}
+
+// UpdateProbeLocation stores the location looked up from the address of a
+// probe. The LocationOverride flag is left unchanged.
+func UpdateProbeLocation(probeId int64, latitude, longitude float64) error {
+	sess, err := newSession(false, "probe")
+	if err != nil {
+		return err
+	}
+	return updateProbeLocation(sess, probeId, latitude, longitude)
+}
+
+func updateProbeLocation(sess *session, probeId int64, latitude, longitude float64) error {
+	_, err := sess.Exec("UPDATE probe SET latitude=?, longitude=? WHERE id=?", latitude, longitude, probeId)
+	return err
 }
 
 func DeleteProbe(id int64, orgId int64) error {
@@ -531,6 +816,22 @@ func deleteProbe(sess *session, id int64, orgId int64) error {
 	if _, err := sess.Exec(rawSql, existing.Id); err != nil {
 		return err
 	}
+	rawSql = "DELETE FROM probe_token WHERE probe_id=?"
+	if _, err := sess.Exec(rawSql, existing.Id); err != nil {
+		return err
+	}
+	rawSql = "DELETE FROM probe_grant WHERE probe_id=?"
+	if _, err := sess.Exec(rawSql, existing.Id); err != nil {
+		return err
+	}
+	rawSql = "DELETE FROM probe_group_member WHERE probe_id=?"
+	if _, err := sess.Exec(rawSql, existing.Id); err != nil {
+		return err
+	}
+	rawSql = "DELETE FROM probe_check_revision WHERE probe_id=?"
+	if _, err := sess.Exec(rawSql, existing.Id); err != nil {
+		return err
+	}
 	events.Publish(&events.ProbeDeleted{
 		Ts:      time.Now(),
 		Payload: existing,
@@ -617,6 +918,59 @@ func updateProbeSession(sess *session, probeSess *m.ProbeSession) error {
 	return err
 }
 
+// UpdateProbeSessionHealth stores the latest health reported by the session.
+func UpdateProbeSessionHealth(probeSess *m.ProbeSession) error {
+	sess, err := newSession(true, "probe_session")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+	err = updateProbeSessionHealth(sess, probeSess)
+	if err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func updateProbeSessionHealth(sess *session, probeSess *m.ProbeSession) error {
+	// Cols is needed for the healthy state to be written, as Update skips
+	// zero values.
+	sess.Cols("health", "degraded", "degraded_since", "degraded_reasons")
+	_, err := sess.Id(probeSess.Id).Update(probeSess)
+	return err
+}
+
+// DrainProbeSession marks the session as draining so that no checks are
+// assigned to it.
+func DrainProbeSession(probeSess *m.ProbeSession) error {
+	sess, err := newSession(true, "probe_session")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+	err = drainProbeSession(sess, probeSess)
+	if err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func drainProbeSession(sess *session, probeSess *m.ProbeSession) error {
+	rawSql := "UPDATE probe_session SET draining=1 WHERE id=?"
+	if _, err := sess.Exec(rawSql, probeSess.Id); err != nil {
+		return err
+	}
+	probeSess.Draining = true
+	log.Info("draining socketId=%s of probeId=%d", probeSess.SocketId, probeSess.ProbeId)
+	events.Publish(&events.ProbeSessionDrained{
+		Ts:      time.Now(),
+		Payload: probeSess,
+	}, 0)
+	return nil
+}
+
 func GetProbeSessions(probeId int64, instance string, since time.Time) ([]m.ProbeSession, error) {
 	sess, err := newSession(false, "probe_session")
 	if err != nil {
@@ -674,6 +1028,12 @@ func deleteProbeSession(sess *session, p *m.ProbeSession) error {
 		//nothing was deleted. so no need to cleanup anything
 		return nil
 	}
+	return probeSessionDeleted(sess, existing)
+}
+
+// probeSessionDeleted marks the probe offline if the deleted session was its
+// last one.
+func probeSessionDeleted(sess *session, existing *m.ProbeSession) error {
 	sessions, err := getProbeSessions(sess, existing.ProbeId, "", time.Time{})
 	if err != nil {
 		return err
@@ -693,6 +1053,120 @@ func deleteProbeSession(sess *session, p *m.ProbeSession) error {
 	return nil
 }
 
+// SweepProbeSessions removes the sessions of all instances that have not
+// sent a heartbeat since staleBefore, and corrects the online state of probes
+// that does not match their sessions. Events for the removed sessions and the
+// probes that changed state are published once the changes are committed.
+func SweepProbeSessions(staleBefore time.Time) (*m.ProbeSessionSweep, error) {
+	sess, err := newSession(true, "probe_session")
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Cleanup()
+	sweep, removed, changed, err := sweepProbeSessions(sess, staleBefore)
+	if err != nil {
+		return nil, err
+	}
+	sess.Complete()
+
+	for i := range removed {
+		events.Publish(&events.ProbeSessionDeleted{
+			Ts:      time.Now(),
+			Payload: &removed[i],
+		}, 0)
+	}
+	for _, p := range changed {
+		current, err := GetProbeById(p.Id, p.OrgId)
+		if err != nil {
+			log.Error(3, "failed to get probeId=%d after sweeping sessions. %s", p.Id, err)
+			continue
+		}
+		last := *current
+		last.Online = p.Online
+		e := new(events.ProbeUpdated)
+		e.Ts = current.OnlineChange
+		e.Payload.Current = current
+		e.Payload.Last = &last
+		events.Publish(e, 0)
+	}
+	return sweep, nil
+}
+
+// sweepProbeSessions returns the sessions it removed and the probes whose
+// online state it changed, with the state they had before.
+func sweepProbeSessions(sess *session, staleBefore time.Time) (*m.ProbeSessionSweep, []m.ProbeSession, []m.Probe, error) {
+	sweep := &m.ProbeSessionSweep{}
+	stale := make([]m.ProbeSession, 0)
+	if err := sess.Where("updated<?", staleBefore).OrderBy("id").Find(&stale); err != nil {
+		return nil, nil, nil, err
+	}
+	removed := make([]m.ProbeSession, 0)
+	for i := range stale {
+		// the session may have sent a heartbeat since it was read.
+		rawSql := "DELETE FROM probe_session WHERE id=? AND updated<?"
+		result, err := sess.Exec(rawSql, stale[i].Id, staleBefore)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if rowsAffected == 0 {
+			continue
+		}
+		log.Info("removing stale session socketId=%s of probeId=%d on %s. last heartbeat %s", stale[i].SocketId, stale[i].ProbeId, stale[i].InstanceId, stale[i].Updated)
+		sweep.SessionsRemoved++
+		removed = append(removed, stale[i])
+	}
+
+	// probes that lost their last session are marked offline here too.
+	offline, err := setProbesOnline(sess, false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sweep.ProbesMarkedOffline = int64(len(offline))
+	online, err := setProbesOnline(sess, true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sweep.ProbesMarkedOnline = int64(len(online))
+	return sweep, removed, append(offline, online...), nil
+}
+
+// setProbesOnline sets the online state of the probes that have sessions, or
+// that have no sessions if online is false, and returns the probes that were
+// changed.
+func setProbesOnline(sess *session, online bool) ([]m.Probe, error) {
+	cond := "probe.online=1 AND probe.id NOT IN (SELECT probe_id FROM probe_session)"
+	if online {
+		cond = "probe.online=0 AND probe.id IN (SELECT probe_id FROM probe_session)"
+	}
+	probes := make([]m.Probe, 0)
+	sess.Table("probe")
+	sess.Where(cond).Cols("id", "org_id", "online")
+	if err := sess.Find(&probes); err != nil {
+		return nil, err
+	}
+	if len(probes) == 0 {
+		return probes, nil
+	}
+	rawParams := []interface{}{online, time.Now()}
+	q := make([]string, len(probes))
+	for i, p := range probes {
+		q[i] = "?"
+		rawParams = append(rawParams, p.Id)
+	}
+	rawSql := fmt.Sprintf("UPDATE probe SET online=?, online_change=? WHERE id IN (%s)", strings.Join(q, ","))
+	if _, err := sess.Exec(rawSql, rawParams...); err != nil {
+		return nil, err
+	}
+	for _, p := range probes {
+		log.Info("marking probeId=%d online=%t to match its sessions.", p.Id, online)
+	}
+	return probes, nil
+}
+
 type probeOnlineSession struct {
 	ProbeId   int64
 	Online    bool
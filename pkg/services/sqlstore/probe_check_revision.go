@@ -0,0 +1,108 @@
+package sqlstore
+
+import (
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+// revisions of the checks of a probe are kept this long, so that probes
+// reconnecting within this time are only sent the changes. Revisions stored
+// as changes can only be loaded while the full revision they build on is
+// kept, see ProbeCheckRevisionFullInterval.
+const probeCheckRevisionTTL = time.Hour * 24
+
+// ProbeCheckRevisionFullInterval is the maximum time between revisions stored
+// with all checks, so that revisions stored as changes are not left without
+// the full revision they build on.
+const ProbeCheckRevisionFullInterval = probeCheckRevisionTTL / 2
+
+// AddProbeCheckRevision stores a revision of the checks sent to a probe
+// session, and removes the expired revisions of the probe.
+func AddProbeCheckRevision(rev *m.ProbeCheckRevision) error {
+	sess, err := newSession(true, "probe_check_revision")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+	if err := addProbeCheckRevision(sess, rev); err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func addProbeCheckRevision(sess *session, rev *m.ProbeCheckRevision) error {
+	rev.Created = time.Now()
+	if _, err := sess.Insert(rev); err != nil {
+		return err
+	}
+	rawSql := "DELETE FROM probe_check_revision WHERE probe_id=? AND created < ?"
+	_, err := sess.Exec(rawSql, rev.ProbeId, rev.Created.Add(-probeCheckRevisionTTL))
+	return err
+}
+
+// GetProbeCheckRevision returns a revision of the checks sent to the probe,
+// with all of the checks of the revision. Revisions stored as changes are
+// applied to the full revision they are based on.
+func GetProbeCheckRevision(probeId int64, revision int64) (*m.ProbeCheckRevision, error) {
+	sess, err := newSession(false, "probe_check_revision")
+	if err != nil {
+		return nil, err
+	}
+	return getProbeCheckRevision(sess, probeId, revision)
+}
+
+func getProbeCheckRevision(sess *session, probeId int64, revision int64) (*m.ProbeCheckRevision, error) {
+	// walk back to the last full revision, then apply the changes forward.
+	changes := make([]*m.ProbeCheckRevision, 0)
+	rev, err := getStoredProbeCheckRevision(sess, probeId, revision)
+	if err != nil {
+		return nil, err
+	}
+	for rev.BaseRevision != 0 {
+		if rev.BaseRevision >= rev.Revision {
+			return nil, m.ErrProbeCheckRevisionNotFound
+		}
+		changes = append(changes, rev)
+		rev, err = getStoredProbeCheckRevision(sess, probeId, rev.BaseRevision)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result := &m.ProbeCheckRevision{
+		Id:          rev.Id,
+		ProbeId:     probeId,
+		Revision:    revision,
+		Checks:      rev.Checks,
+		Created:     rev.Created,
+		Changes:     len(changes),
+		FullCreated: rev.Created,
+	}
+	if result.Checks == nil {
+		result.Checks = make(map[int64]m.SyncedCheck)
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		for id, c := range changes[i].Checks {
+			result.Checks[id] = c
+		}
+		for _, id := range changes[i].Removed {
+			delete(result.Checks, id)
+		}
+		result.Id = changes[i].Id
+		result.Created = changes[i].Created
+	}
+	return result, nil
+}
+
+func getStoredProbeCheckRevision(sess *session, probeId int64, revision int64) (*m.ProbeCheckRevision, error) {
+	rev := &m.ProbeCheckRevision{}
+	has, err := sess.Where("probe_id=? AND revision=?", probeId, revision).Get(rev)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, m.ErrProbeCheckRevisionNotFound
+	}
+	return rev, nil
+}
@@ -0,0 +1,94 @@
+package sqlstore
+
+import (
+	"testing"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProbeCheckRevisions(t *testing.T) {
+	InitTestDB(t)
+	now := time.Now().Truncate(time.Second)
+
+	Convey("When storing a revision of the checks of a probe", t, func() {
+		revision := time.Now().UnixNano()
+		err := AddProbeCheckRevision(&m.ProbeCheckRevision{
+			ProbeId:  1,
+			Revision: revision,
+			Checks: map[int64]m.SyncedCheck{
+				1: {Updated: now, Slug: "a"},
+				2: {Updated: now, Slug: "b"},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("it should be returned for the probe", func() {
+			rev, err := GetProbeCheckRevision(1, revision)
+			So(err, ShouldBeNil)
+			So(rev.Checks, ShouldHaveLength, 2)
+			So(rev.Checks[2].Slug, ShouldEqual, "b")
+			So(rev.Checks[1].Updated.Equal(now), ShouldBeTrue)
+		})
+		Convey("it should not be returned for other probes or revisions", func() {
+			_, err := GetProbeCheckRevision(2, revision)
+			So(err, ShouldEqual, m.ErrProbeCheckRevisionNotFound)
+			_, err = GetProbeCheckRevision(1, revision+1)
+			So(err, ShouldEqual, m.ErrProbeCheckRevisionNotFound)
+		})
+	})
+	Convey("When storing revisions as changes", t, func() {
+		full := time.Now().UnixNano()
+		err := AddProbeCheckRevision(&m.ProbeCheckRevision{
+			ProbeId:  3,
+			Revision: full,
+			Checks: map[int64]m.SyncedCheck{
+				1: {Updated: now, Slug: "a"},
+				2: {Updated: now, Slug: "b"},
+			},
+		})
+		So(err, ShouldBeNil)
+		err = AddProbeCheckRevision(&m.ProbeCheckRevision{
+			ProbeId:      3,
+			Revision:     full + 1,
+			BaseRevision: full,
+			Checks:       map[int64]m.SyncedCheck{3: {Updated: now, Slug: "c"}},
+			Removed:      []int64{1},
+		})
+		So(err, ShouldBeNil)
+		err = AddProbeCheckRevision(&m.ProbeCheckRevision{
+			ProbeId:      3,
+			Revision:     full + 2,
+			BaseRevision: full + 1,
+			Checks:       map[int64]m.SyncedCheck{2: {Updated: now.Add(time.Minute), Slug: "b"}},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("the changes should be applied to the full revision", func() {
+			rev, err := GetProbeCheckRevision(3, full+2)
+			So(err, ShouldBeNil)
+			So(rev.Revision, ShouldEqual, full+2)
+			So(rev.Changes, ShouldEqual, 2)
+			So(rev.Checks, ShouldHaveLength, 2)
+			So(rev.Checks[2].Updated.Equal(now.Add(time.Minute)), ShouldBeTrue)
+			So(rev.Checks[3].Slug, ShouldEqual, "c")
+
+			rev, err = GetProbeCheckRevision(3, full+1)
+			So(err, ShouldBeNil)
+			So(rev.Changes, ShouldEqual, 1)
+			So(rev.Checks[2].Updated.Equal(now), ShouldBeTrue)
+		})
+		Convey("changes without their full revision should not be returned", func() {
+			err := AddProbeCheckRevision(&m.ProbeCheckRevision{
+				ProbeId:      4,
+				Revision:     full + 1,
+				BaseRevision: full,
+				Checks:       map[int64]m.SyncedCheck{3: {Updated: now, Slug: "c"}},
+			})
+			So(err, ShouldBeNil)
+			_, err = GetProbeCheckRevision(4, full+1)
+			So(err, ShouldEqual, m.ErrProbeCheckRevisionNotFound)
+		})
+	})
+}
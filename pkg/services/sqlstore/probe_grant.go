@@ -0,0 +1,167 @@
+package sqlstore
+
+import (
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/events"
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+// probeAccessCond restricts queries on the probe table to the probes owned by
+// the org, public probes and probes granted to the org. It takes the orgId
+// twice.
+const probeAccessCond = "(probe.org_id=? OR probe.public=1 OR probe.id IN (SELECT probe_id FROM probe_grant WHERE probe_grant.org_id=?))"
+
+// probeCheckOrgCond restricts the checks run by a private probe to the checks
+// of the owner and of the orgs the probe is granted to. It takes the orgId of
+// the probe and the probeId.
+const probeCheckOrgCond = "(`check`.org_id=? OR `check`.org_id IN (SELECT probe_grant.org_id FROM probe_grant WHERE probe_grant.probe_id=?))"
+
+// AddProbeGrant allows orgId to route checks to a probe owned by ownerOrgId.
+// The tags the owner has set on the probe are copied to the new org.
+func AddProbeGrant(probeId int64, ownerOrgId int64, orgId int64) (*m.ProbeGrantDTO, error) {
+	sess, err := newSession(true, "probe")
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Cleanup()
+	grant, err := addProbeGrant(sess, probeId, ownerOrgId, orgId)
+	if err != nil {
+		return nil, err
+	}
+	sess.Complete()
+	return grant.ToDTO(), nil
+}
+
+func addProbeGrant(sess *session, probeId int64, ownerOrgId int64, orgId int64) (*m.ProbeGrant, error) {
+	probe, err := getProbeById(sess, probeId, ownerOrgId)
+	if err != nil {
+		return nil, err
+	}
+	if probe.OrgId != ownerOrgId {
+		return nil, m.ErrProbeNotFound
+	}
+	if orgId == ownerOrgId {
+		return nil, m.ErrProbeGrantToOwner
+	}
+
+	grant := &m.ProbeGrant{}
+	has, err := sess.Table("probe_grant").Where("probe_id=? AND org_id=?", probeId, orgId).Get(grant)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		return grant, nil
+	}
+
+	grant = &m.ProbeGrant{
+		ProbeId: probeId,
+		OrgId:   orgId,
+		Created: time.Now(),
+	}
+	sess.Table("probe_grant")
+	if _, err := sess.Insert(grant); err != nil {
+		return nil, err
+	}
+
+	// tags left from when the probe was public are replaced by the owner's.
+	rawSql := "DELETE FROM probe_tag WHERE probe_id=? AND org_id=?"
+	if _, err := sess.Exec(rawSql, probeId, orgId); err != nil {
+		return nil, err
+	}
+	if len(probe.Tags) > 0 {
+		probeTags := make([]m.ProbeTag, len(probe.Tags))
+		for i, tag := range probe.Tags {
+			probeTags[i] = m.ProbeTag{
+				OrgId:   orgId,
+				ProbeId: probeId,
+				Tag:     tag,
+				Created: time.Now(),
+			}
+		}
+		sess.Table("probe_tag")
+		if _, err := sess.Insert(&probeTags); err != nil {
+			return nil, err
+		}
+	}
+	events.Publish(&events.ProbeGrantsUpdated{
+		Ts:      time.Now(),
+		Payload: grant,
+	}, 0)
+	return grant, nil
+}
+
+func GetProbeGrants(probeId int64, ownerOrgId int64) ([]*m.ProbeGrantDTO, error) {
+	sess, err := newSession(false, "probe")
+	if err != nil {
+		return nil, err
+	}
+	return getProbeGrants(sess, probeId, ownerOrgId)
+}
+
+func getProbeGrants(sess *session, probeId int64, ownerOrgId int64) ([]*m.ProbeGrantDTO, error) {
+	probe, err := getProbeById(sess, probeId, ownerOrgId)
+	if err != nil {
+		return nil, err
+	}
+	if probe.OrgId != ownerOrgId {
+		return nil, m.ErrProbeNotFound
+	}
+	grants := make([]m.ProbeGrant, 0)
+	sess.Table("probe_grant")
+	sess.Where("probe_id=?", probeId).Asc("org_id")
+	if err := sess.Find(&grants); err != nil {
+		return nil, err
+	}
+	result := make([]*m.ProbeGrantDTO, len(grants))
+	for i := range grants {
+		result[i] = grants[i].ToDTO()
+	}
+	return result, nil
+}
+
+// DeleteProbeGrant revokes the access of orgId to the probe. The tags the org
+// set on the probe are removed, and its checks stop being routed to the probe.
+func DeleteProbeGrant(probeId int64, ownerOrgId int64, orgId int64) error {
+	sess, err := newSession(true, "probe")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+	if err := deleteProbeGrant(sess, probeId, ownerOrgId, orgId); err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func deleteProbeGrant(sess *session, probeId int64, ownerOrgId int64, orgId int64) error {
+	probe, err := getProbeById(sess, probeId, ownerOrgId)
+	if err != nil {
+		return err
+	}
+	if probe.OrgId != ownerOrgId {
+		return m.ErrProbeNotFound
+	}
+	rawSql := "DELETE FROM probe_grant WHERE probe_id=? AND org_id=?"
+	res, err := sess.Exec(rawSql, probeId, orgId)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return m.ErrProbeGrantNotFound
+	}
+	rawSql = "DELETE FROM probe_tag WHERE probe_id=? AND org_id=?"
+	if _, err := sess.Exec(rawSql, probeId, orgId); err != nil {
+		return err
+	}
+	events.Publish(&events.ProbeGrantsUpdated{
+		Ts:      time.Now(),
+		Payload: &m.ProbeGrant{ProbeId: probeId, OrgId: orgId},
+	}, 0)
+	return nil
+}
@@ -0,0 +1,116 @@
+package sqlstore
+
+import (
+	"testing"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProbeGrants(t *testing.T) {
+	InitTestDB(t)
+	populateProbes(t)
+	grant, err := AddProbeGrant(1, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := &m.EndpointDTO{
+		Name:  "www.grafana.com",
+		OrgId: 3,
+		Checks: []m.Check{
+			{
+				Route: &m.CheckRoute{
+					Type:   m.RouteByIds,
+					Config: map[string]interface{}{"ids": []int64{1, 2}},
+				},
+				Frequency: 60,
+				Type:      m.PING_CHECK,
+				Enabled:   true,
+				Settings: map[string]interface{}{
+					"hostname": "www.grafana.com",
+					"timeout":  5,
+				},
+				HealthSettings: &m.CheckHealthSettings{
+					NumProbes: 1,
+					Steps:     3,
+				},
+			},
+		},
+	}
+	if err := AddEndpoint(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	check := endpoint.Checks[0]
+
+	Convey("When a probe is granted to another org", t, func() {
+		So(grant.ProbeId, ShouldEqual, 1)
+		So(grant.OrgId, ShouldEqual, 3)
+
+		Convey("the probe should be listed for the org with the owners tags", func() {
+			probes, err := GetProbes(&m.GetProbesQuery{OrgId: 3})
+			So(err, ShouldBeNil)
+			So(len(probes), ShouldEqual, 3)
+			probe, err := GetProbeById(1, 3)
+			So(err, ShouldBeNil)
+			So(probe.Tags, ShouldContain, "test")
+			probes, err = GetProbes(&m.GetProbesQuery{OrgId: 3, Public: "false"})
+			So(err, ShouldBeNil)
+			So(len(probes), ShouldEqual, 1)
+		})
+		Convey("only granted probes should be kept in check routes", func() {
+			So(check.Route.Config["ids"], ShouldResemble, []int64{1})
+			probes, err := GetProbesForCheck(&check)
+			So(err, ShouldBeNil)
+			So(probes, ShouldResemble, []int64{1})
+
+			byTags := m.Check{OrgId: 3, Route: &m.CheckRoute{
+				Type:   m.RouteByTags,
+				Config: map[string]interface{}{"tags": []string{"test"}},
+			}}
+			probes, err = GetProbesForCheck(&byTags)
+			So(err, ShouldBeNil)
+			So(probes, ShouldResemble, []int64{1})
+		})
+		Convey("the probe should run the checks of the org", func() {
+			checks, err := GetProbeChecksWithEndpointSlug(&m.ProbeDTO{Id: 1, OrgId: 1})
+			So(err, ShouldBeNil)
+			So(len(checks), ShouldEqual, 1)
+			So(checks[0].OrgId, ShouldEqual, 3)
+		})
+		Convey("the grants should be listed for the owner only", func() {
+			grants, err := GetProbeGrants(1, 1)
+			So(err, ShouldBeNil)
+			So(len(grants), ShouldEqual, 1)
+			So(grants[0].OrgId, ShouldEqual, 3)
+			_, err = GetProbeGrants(1, 3)
+			So(err, ShouldEqual, m.ErrProbeNotFound)
+		})
+	})
+	Convey("When granting a probe to the org that owns it", t, func() {
+		_, err := AddProbeGrant(1, 1, 1)
+		So(err, ShouldEqual, m.ErrProbeGrantToOwner)
+	})
+	Convey("When granting a probe owned by another org", t, func() {
+		_, err := AddProbeGrant(1, 3, 4)
+		So(err, ShouldEqual, m.ErrProbeNotFound)
+	})
+	Convey("When a grant is revoked", t, func() {
+		err := DeleteProbeGrant(1, 1, 3)
+		So(err, ShouldBeNil)
+		err = DeleteProbeGrant(1, 1, 3)
+		So(err, ShouldEqual, m.ErrProbeGrantNotFound)
+
+		probes, err := GetProbes(&m.GetProbesQuery{OrgId: 3})
+		So(err, ShouldBeNil)
+		So(len(probes), ShouldEqual, 2)
+		_, err = GetProbeById(1, 3)
+		So(err, ShouldEqual, m.ErrProbeNotFound)
+
+		probes, err = GetProbesForCheck(&check)
+		So(err, ShouldBeNil)
+		So(len(probes), ShouldEqual, 0)
+		checks, err := GetProbeChecksWithEndpointSlug(&m.ProbeDTO{Id: 1, OrgId: 1})
+		So(err, ShouldBeNil)
+		So(len(checks), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,314 @@
+package sqlstore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/events"
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+func GetProbeGroups(orgId int64) ([]*m.ProbeGroupDTO, error) {
+	sess, err := newSession(false, "probe_group")
+	if err != nil {
+		return nil, err
+	}
+	return getProbeGroups(sess, orgId)
+}
+
+func getProbeGroups(sess *session, orgId int64) ([]*m.ProbeGroupDTO, error) {
+	groups := make([]m.ProbeGroup, 0)
+	sess.Table("probe_group")
+	sess.Where("org_id=?", orgId).Asc("name")
+	if err := sess.Find(&groups); err != nil {
+		return nil, err
+	}
+	return probeGroupDTOs(sess, groups)
+}
+
+func GetProbeGroupById(id int64, orgId int64) (*m.ProbeGroupDTO, error) {
+	sess, err := newSession(false, "probe_group")
+	if err != nil {
+		return nil, err
+	}
+	return getProbeGroupById(sess, id, orgId)
+}
+
+func getProbeGroupById(sess *session, id int64, orgId int64) (*m.ProbeGroupDTO, error) {
+	groups := make([]m.ProbeGroup, 0)
+	sess.Table("probe_group")
+	sess.Where("id=? AND org_id=?", id, orgId)
+	if err := sess.Find(&groups); err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, m.ErrProbeGroupNotFound
+	}
+	dtos, err := probeGroupDTOs(sess, groups)
+	if err != nil {
+		return nil, err
+	}
+	return dtos[0], nil
+}
+
+// probeGroupDTOs adds the members of each group.
+func probeGroupDTOs(sess *session, groups []m.ProbeGroup) ([]*m.ProbeGroupDTO, error) {
+	result := make([]*m.ProbeGroupDTO, len(groups))
+	if len(groups) == 0 {
+		return result, nil
+	}
+	groupIds := make([]int64, len(groups))
+	for i, g := range groups {
+		groupIds[i] = g.Id
+	}
+	members := make([]m.ProbeGroupMember, 0)
+	sess.Table("probe_group_member")
+	sess.In("group_id", groupIds).Asc("probe_id")
+	if err := sess.Find(&members); err != nil {
+		return nil, err
+	}
+	probes := make(map[int64][]int64)
+	for _, member := range members {
+		probes[member.GroupId] = append(probes[member.GroupId], member.ProbeId)
+	}
+	for i, g := range groups {
+		result[i] = &m.ProbeGroupDTO{
+			Id:      g.Id,
+			OrgId:   g.OrgId,
+			Name:    g.Name,
+			Probes:  probes[g.Id],
+			Created: g.Created,
+			Updated: g.Updated,
+		}
+		if result[i].Probes == nil {
+			result[i].Probes = make([]int64, 0)
+		}
+	}
+	return result, nil
+}
+
+func AddProbeGroup(orgId int64, cmd *m.AddProbeGroupCmd) (*m.ProbeGroupDTO, error) {
+	sess, err := newSession(true, "probe_group")
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Cleanup()
+	group, err := addProbeGroup(sess, orgId, cmd)
+	if err != nil {
+		return nil, err
+	}
+	sess.Complete()
+	return group, nil
+}
+
+func addProbeGroup(sess *session, orgId int64, cmd *m.AddProbeGroupCmd) (*m.ProbeGroupDTO, error) {
+	if err := checkProbeGroupName(sess, orgId, 0, cmd.Name); err != nil {
+		return nil, err
+	}
+	probes, err := uniqueGroupProbes(sess, orgId, cmd.Probes)
+	if err != nil {
+		return nil, err
+	}
+	group := &m.ProbeGroup{
+		OrgId:   orgId,
+		Name:    cmd.Name,
+		Created: time.Now(),
+		Updated: time.Now(),
+	}
+	sess.Table("probe_group")
+	if _, err := sess.Insert(group); err != nil {
+		return nil, err
+	}
+	if err := addProbeGroupMembers(sess, group.Id, probes); err != nil {
+		return nil, err
+	}
+	return &m.ProbeGroupDTO{
+		Id:      group.Id,
+		OrgId:   group.OrgId,
+		Name:    group.Name,
+		Probes:  probes,
+		Created: group.Created,
+		Updated: group.Updated,
+	}, nil
+}
+
+// UpdateProbeGroup changes the name and members of a group. Checks routed to
+// the group are moved to the new members.
+func UpdateProbeGroup(id int64, orgId int64, cmd *m.UpdateProbeGroupCmd) (*m.ProbeGroupDTO, error) {
+	sess, err := newSession(true, "probe_group")
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Cleanup()
+	group, err := updateProbeGroup(sess, id, orgId, cmd)
+	if err != nil {
+		return nil, err
+	}
+	sess.Complete()
+	return group, nil
+}
+
+func updateProbeGroup(sess *session, id int64, orgId int64, cmd *m.UpdateProbeGroupCmd) (*m.ProbeGroupDTO, error) {
+	existing, err := getProbeGroupById(sess, id, orgId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProbeGroupName(sess, orgId, id, cmd.Name); err != nil {
+		return nil, err
+	}
+	probes, err := uniqueGroupProbes(sess, orgId, cmd.Probes)
+	if err != nil {
+		return nil, err
+	}
+	group := &m.ProbeGroup{
+		Id:      id,
+		OrgId:   orgId,
+		Name:    cmd.Name,
+		Created: existing.Created,
+		Updated: time.Now(),
+	}
+	sess.Table("probe_group")
+	if _, err := sess.Id(id).Update(group); err != nil {
+		return nil, err
+	}
+	rawSql := "DELETE FROM probe_group_member WHERE group_id=?"
+	if _, err := sess.Exec(rawSql, id); err != nil {
+		return nil, err
+	}
+	if err := addProbeGroupMembers(sess, id, probes); err != nil {
+		return nil, err
+	}
+	current := &m.ProbeGroupDTO{
+		Id:      id,
+		OrgId:   orgId,
+		Name:    group.Name,
+		Probes:  probes,
+		Created: group.Created,
+		Updated: group.Updated,
+	}
+	e := new(events.ProbeGroupUpdated)
+	e.Ts = group.Updated
+	e.Payload.Current = current
+	e.Payload.Last = existing
+	events.Publish(e, 0)
+	return current, nil
+}
+
+// DeleteProbeGroup removes a group. Groups that checks are routed to can not
+// be deleted.
+func DeleteProbeGroup(id int64, orgId int64) error {
+	sess, err := newSession(true, "probe_group")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+	if err := deleteProbeGroup(sess, id, orgId); err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func deleteProbeGroup(sess *session, id int64, orgId int64) error {
+	if _, err := getProbeGroupById(sess, id, orgId); err != nil {
+		return err
+	}
+	count, err := sess.Table("route_by_group_index").Where("group_id=?", id).Count(&m.RouteByGroupIndex{})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return m.ErrProbeGroupInUse
+	}
+	rawSql := "DELETE FROM probe_group WHERE id=? AND org_id=?"
+	if _, err := sess.Exec(rawSql, id, orgId); err != nil {
+		return err
+	}
+	rawSql = "DELETE FROM probe_group_member WHERE group_id=?"
+	_, err = sess.Exec(rawSql, id)
+	return err
+}
+
+func checkProbeGroupName(sess *session, orgId int64, id int64, name string) error {
+	count, err := sess.Table("probe_group").Where("org_id=? AND name=? AND id!=?", orgId, name, id).Count(&m.ProbeGroup{})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return m.ErrProbeGroupNameExists
+	}
+	return nil
+}
+
+// uniqueGroupProbes removes duplicate probes and ensures that the org can use
+// all of them.
+func uniqueGroupProbes(sess *session, orgId int64, probes []int64) ([]int64, error) {
+	ids := make([]int64, 0, len(probes))
+	seen := make(map[int64]struct{})
+	for _, id := range probes {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return ids, nil
+	}
+	results := make([]ProbeId, 0)
+	sess.Table("probe")
+	sess.In("probe.id", ids).And(probeAccessCond, orgId, orgId)
+	sess.Cols("probe.id")
+	if err := sess.Find(&results); err != nil {
+		return nil, err
+	}
+	if len(results) != len(ids) {
+		found := make(map[int64]struct{})
+		for _, row := range results {
+			found[row.Id] = struct{}{}
+		}
+		for _, id := range ids {
+			if _, ok := found[id]; !ok {
+				return nil, m.NewValidationError(fmt.Sprintf("probe %d not found", id))
+			}
+		}
+	}
+	return ids, nil
+}
+
+func addProbeGroupMembers(sess *session, groupId int64, probes []int64) error {
+	if len(probes) == 0 {
+		return nil
+	}
+	members := make([]m.ProbeGroupMember, len(probes))
+	for i, id := range probes {
+		members[i] = m.ProbeGroupMember{
+			GroupId: groupId,
+			ProbeId: id,
+			Created: time.Now(),
+		}
+	}
+	sess.Table("probe_group_member")
+	_, err := sess.Insert(&members)
+	return err
+}
+
+// GetChecksForProbeGroup returns the enabled checks routed to the group.
+func GetChecksForProbeGroup(groupId int64) ([]m.CheckWithSlug, error) {
+	sess, err := newSession(false, "check")
+	if err != nil {
+		return nil, err
+	}
+	return getChecksForProbeGroup(sess, groupId)
+}
+
+func getChecksForProbeGroup(sess *session, groupId int64) ([]m.CheckWithSlug, error) {
+	checks := make([]m.CheckWithSlug, 0)
+	sess.Table("check")
+	sess.Join("INNER", "endpoint", "`check`.endpoint_id=endpoint.id")
+	sess.Join("INNER", "route_by_group_index", "`check`.id=route_by_group_index.check_id")
+	sess.Where("route_by_group_index.group_id=?", groupId).And("`check`.enabled=1")
+	sess.Cols("`check`.*", "endpoint.slug")
+	err := sess.Find(&checks)
+	return checks, err
+}
@@ -0,0 +1,111 @@
+package sqlstore
+
+import (
+	"testing"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProbeGroups(t *testing.T) {
+	InitTestDB(t)
+	populateProbes(t)
+	group, err := AddProbeGroup(1, &m.AddProbeGroupCmd{Name: "EU", Probes: []int64{1, 4, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := &m.EndpointDTO{
+		Name:  "www.grafana.com",
+		OrgId: 1,
+		Checks: []m.Check{
+			{
+				Route: &m.CheckRoute{
+					Type:   m.RouteByGroup,
+					Config: map[string]interface{}{"groups": []int64{group.Id, 99}},
+				},
+				Frequency: 60,
+				Type:      m.PING_CHECK,
+				Enabled:   true,
+				Settings: map[string]interface{}{
+					"hostname": "www.grafana.com",
+					"timeout":  5,
+				},
+				HealthSettings: &m.CheckHealthSettings{
+					NumProbes: 1,
+					Steps:     3,
+				},
+			},
+		},
+	}
+	if err := AddEndpoint(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	check := endpoint.Checks[0]
+
+	Convey("When adding a probe group", t, func() {
+		So(group.Id, ShouldNotEqual, 0)
+		So(group.Probes, ShouldResemble, []int64{1, 4})
+
+		Convey("the group should be listed", func() {
+			groups, err := GetProbeGroups(1)
+			So(err, ShouldBeNil)
+			So(len(groups), ShouldEqual, 1)
+			So(groups[0].Name, ShouldEqual, "EU")
+			So(groups[0].Probes, ShouldResemble, []int64{1, 4})
+			groups, err = GetProbeGroups(2)
+			So(err, ShouldBeNil)
+			So(len(groups), ShouldEqual, 0)
+		})
+		Convey("groups with the same name should be rejected", func() {
+			_, err := AddProbeGroup(1, &m.AddProbeGroupCmd{Name: "EU"})
+			So(err, ShouldEqual, m.ErrProbeGroupNameExists)
+		})
+		Convey("groups with probes of other orgs should be rejected", func() {
+			_, err := AddProbeGroup(2, &m.AddProbeGroupCmd{Name: "EU", Probes: []int64{1}})
+			So(err, ShouldHaveSameTypeAs, m.ValidationError{})
+		})
+	})
+	Convey("When routing a check to a group", t, func() {
+		So(check.Route.Config["groups"], ShouldResemble, []int64{group.Id})
+		probes, err := GetProbesForCheck(&check)
+		So(err, ShouldBeNil)
+		So(len(probes), ShouldEqual, 2)
+		So(probes, ShouldContain, int64(1))
+		So(probes, ShouldContain, int64(4))
+
+		checks, err := GetProbeChecksWithEndpointSlug(&m.ProbeDTO{Id: 4, OrgId: 2, Public: true})
+		So(err, ShouldBeNil)
+		So(len(checks), ShouldEqual, 1)
+		So(checks[0].Slug, ShouldEqual, "www_grafana_com")
+
+		groupChecks, err := GetChecksForProbeGroup(group.Id)
+		So(err, ShouldBeNil)
+		So(len(groupChecks), ShouldEqual, 1)
+		So(groupChecks[0].Id, ShouldEqual, check.Id)
+	})
+	Convey("When the members of a group change", t, func() {
+		updated, err := UpdateProbeGroup(group.Id, 1, &m.UpdateProbeGroupCmd{Name: "Europe", Probes: []int64{2}})
+		So(err, ShouldBeNil)
+		So(updated.Name, ShouldEqual, "Europe")
+		So(updated.Probes, ShouldResemble, []int64{2})
+
+		probes, err := GetProbesForCheck(&check)
+		So(err, ShouldBeNil)
+		So(probes, ShouldResemble, []int64{2})
+		checks, err := GetProbeChecksWithEndpointSlug(&m.ProbeDTO{Id: 4, OrgId: 2, Public: true})
+		So(err, ShouldBeNil)
+		So(len(checks), ShouldEqual, 0)
+	})
+	Convey("When deleting a group", t, func() {
+		err := DeleteProbeGroup(group.Id, 1)
+		So(err, ShouldEqual, m.ErrProbeGroupInUse)
+
+		other, err := AddProbeGroup(1, &m.AddProbeGroupCmd{Name: "APAC"})
+		So(err, ShouldBeNil)
+		So(other.Probes, ShouldResemble, []int64{})
+		err = DeleteProbeGroup(other.Id, 1)
+		So(err, ShouldBeNil)
+		_, err = GetProbeGroupById(other.Id, 1)
+		So(err, ShouldEqual, m.ErrProbeGroupNotFound)
+	})
+}
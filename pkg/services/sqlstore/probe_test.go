@@ -1,11 +1,14 @@
 package sqlstore
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/raintank/worldping-api/pkg/events"
 	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/raintank/worldping-api/pkg/setting"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -157,3 +160,309 @@ func TestProbeSessions(t *testing.T) {
 		})
 	})
 }
+
+func TestProbeOfflineNotification(t *testing.T) {
+	InitTestDB(t)
+	p := &m.ProbeDTO{
+		Name:    "test1",
+		OrgId:   1,
+		Tags:    []string{"test"},
+		Online:  false,
+		Enabled: true,
+		Notifications: &m.ProbeNotificationSettings{
+			Enabled:     true,
+			Addresses:   "ops@example.com",
+			GracePeriod: 60,
+		},
+	}
+	err := AddProbe(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Convey("When getting probes for offline notification", t, func() {
+		probes, err := GetProbesForOfflineNotification()
+		So(err, ShouldBeNil)
+		So(len(probes), ShouldEqual, 1)
+		So(probes[0].Notifications, ShouldResemble, p.Notifications)
+		So(probes[0].OfflineNotified, ShouldBeFalse)
+
+		Convey("marking probe as notified should only succeed once", func() {
+			changed, err := SetProbeOfflineNotified(p.Id, true)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeTrue)
+			changed, err = SetProbeOfflineNotified(p.Id, true)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeFalse)
+
+			Convey("updating probe without notifications should keep settings", func() {
+				p.Notifications = nil
+				err := UpdateProbe(p)
+				So(err, ShouldBeNil)
+				So(p.Notifications, ShouldNotBeNil)
+				probes, err := GetProbesForOfflineNotification()
+				So(err, ShouldBeNil)
+				So(len(probes), ShouldEqual, 1)
+				So(probes[0].OfflineNotified, ShouldBeTrue)
+				So(probes[0].Notifications.Addresses, ShouldEqual, "ops@example.com")
+
+				Convey("updating probe with empty notifications should clear settings", func() {
+					p.Notifications = &m.ProbeNotificationSettings{}
+					err := UpdateProbe(p)
+					So(err, ShouldBeNil)
+					probes, err := GetProbesForOfflineNotification()
+					So(err, ShouldBeNil)
+					So(len(probes), ShouldEqual, 1)
+					So(probes[0].Notifications.Enabled, ShouldBeFalse)
+					So(probes[0].Notifications.Addresses, ShouldEqual, "")
+				})
+			})
+		})
+	})
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	InitTestDB(t)
+	populateProbes(t)
+	Convey("When probes advertise capabilities", t, func() {
+		err := UpdateProbeCapabilities(1, &m.ProbeCapabilities{
+			CheckTypes: []m.CheckType{m.HTTP_CHECK, m.HTTPS_CHECK},
+			IpVersions: []string{"v4"},
+		})
+		So(err, ShouldBeNil)
+		err = UpdateProbeCapabilities(2, &m.ProbeCapabilities{
+			CheckTypes: []m.CheckType{m.HTTP_CHECK, m.PING_CHECK},
+			IpVersions: []string{"v4", "v6"},
+		})
+		So(err, ShouldBeNil)
+		probe, err := GetProbeById(1, 1)
+		So(err, ShouldBeNil)
+		So(probe.Capabilities, ShouldNotBeNil)
+		So(probe.Capabilities.CheckTypes, ShouldResemble, []m.CheckType{m.HTTP_CHECK, m.HTTPS_CHECK})
+
+		check := &m.Check{
+			OrgId: 1,
+			Type:  m.PING_CHECK,
+			Route: &m.CheckRoute{
+				Type: m.RouteByIds,
+				Config: map[string]interface{}{
+					"ids": []int64{1, 2, 3},
+				},
+			},
+			Settings: map[string]interface{}{
+				"hostname": "www.google.com",
+			},
+		}
+		Convey("probes that dont support the check type should be skipped", func() {
+			probes, err := GetProbesForCheck(check)
+			So(err, ShouldBeNil)
+			So(len(probes), ShouldEqual, 2)
+			So(probes, ShouldContain, int64(2))
+			So(probes, ShouldContain, int64(3))
+		})
+		Convey("probes that dont support the ip version should be skipped", func() {
+			check.Type = m.HTTP_CHECK
+			check.Settings = map[string]interface{}{"host": "www.google.com", "path": "/", "ipversion": "v6"}
+			check.Route = &m.CheckRoute{
+				Type: m.RouteByTags,
+				Config: map[string]interface{}{
+					"tags": []string{"test"},
+				},
+			}
+			probes, err := GetProbesForCheck(check)
+			So(err, ShouldBeNil)
+			So(len(probes), ShouldEqual, 2)
+			So(probes, ShouldContain, int64(2))
+			So(probes, ShouldContain, int64(3))
+		})
+		Convey("probes that only advertise unrelated features should run IPv6 checks", func() {
+			err := UpdateProbeCapabilities(3, &m.ProbeCapabilities{
+				Features: []string{m.ProbeFeatureIncrementalRefresh},
+			})
+			So(err, ShouldBeNil)
+			defer UpdateProbeCapabilities(3, nil)
+			check.Type = m.HTTP_CHECK
+			check.Settings = map[string]interface{}{"host": "www.google.com", "path": "/", "ipversion": "v6"}
+			probes, err := GetProbesForCheck(check)
+			So(err, ShouldBeNil)
+			So(probes, ShouldContain, int64(3))
+			So(probes, ShouldNotContain, int64(1))
+		})
+		Convey("clearing capabilities should allow all checks", func() {
+			err := UpdateProbeCapabilities(1, nil)
+			So(err, ShouldBeNil)
+			probes, err := GetProbesForCheck(check)
+			So(err, ShouldBeNil)
+			So(len(probes), ShouldEqual, 3)
+		})
+		Convey("the sessions of connected probes should be used instead", func() {
+			sess := &m.ProbeSession{
+				OrgId:    1,
+				ProbeId:  1,
+				SocketId: "capable-session",
+				Capabilities: &m.ProbeCapabilities{
+					CheckTypes: []m.CheckType{m.PING_CHECK},
+				},
+			}
+			err := AddProbeSession(sess)
+			So(err, ShouldBeNil)
+			probes, err := GetProbesForCheck(check)
+			So(err, ShouldBeNil)
+			So(len(probes), ShouldEqual, 3)
+
+			err = DeleteProbeSession(sess)
+			So(err, ShouldBeNil)
+		})
+		Convey("stale sessions should be ignored", func() {
+			setting.ProbeSessions.StaleAfter = time.Minute * 2
+			defer func() { setting.ProbeSessions.StaleAfter = 0 }()
+			sess := &m.ProbeSession{
+				OrgId:    1,
+				ProbeId:  1,
+				SocketId: "stale-session",
+				Capabilities: &m.ProbeCapabilities{
+					CheckTypes: []m.CheckType{m.PING_CHECK},
+				},
+			}
+			err := AddProbeSession(sess)
+			So(err, ShouldBeNil)
+			sess.Updated = time.Now().Add(-time.Hour)
+			So(UpdateProbeSession(sess), ShouldBeNil)
+			probes, err := GetProbesForCheck(check)
+			So(err, ShouldBeNil)
+			So(len(probes), ShouldEqual, 2)
+			So(probes, ShouldNotContain, int64(1))
+
+			err = DeleteProbeSession(sess)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestProbeLocationOverride(t *testing.T) {
+	InitTestDB(t)
+	Convey("When a probe is created without a location", t, func() {
+		probe := &m.ProbeDTO{Name: "located", OrgId: 1, Enabled: true}
+		err := AddProbe(probe)
+		So(err, ShouldBeNil)
+		So(probe.LocationOverride, ShouldBeFalse)
+
+		Convey("the looked up location should be stored", func() {
+			err := UpdateProbeLocation(probe.Id, 52.37, 4.89)
+			So(err, ShouldBeNil)
+			p, err := GetProbeById(probe.Id, 1)
+			So(err, ShouldBeNil)
+			So(p.Latitude, ShouldEqual, 52.37)
+			So(p.LocationOverride, ShouldBeFalse)
+
+			Convey("changing the location should make it an override", func() {
+				p.Latitude = 1.5
+				err := UpdateProbe(p)
+				So(err, ShouldBeNil)
+				p, err = GetProbeById(probe.Id, 1)
+				So(err, ShouldBeNil)
+				So(p.Latitude, ShouldEqual, 1.5)
+				So(p.LocationOverride, ShouldBeTrue)
+
+				Convey("resetting the location should clear the override", func() {
+					p.Latitude = 0
+					p.Longitude = 0
+					p.LocationOverride = false
+					err := UpdateProbe(p)
+					So(err, ShouldBeNil)
+					p, err = GetProbeById(probe.Id, 1)
+					So(err, ShouldBeNil)
+					So(p.LocationOverride, ShouldBeFalse)
+				})
+			})
+		})
+	})
+}
+
+func TestSweepProbeSessions(t *testing.T) {
+	InitTestDB(t)
+	events.Init()
+	updates := make(chan events.RawEvent, 100)
+	events.Subscribe("Probe.updated", updates)
+	p := &m.ProbeDTO{
+		Name:    "test1",
+		OrgId:   1,
+		Online:  false,
+		Enabled: true,
+	}
+	if err := AddProbe(p); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("When sweeping stale sessions", t, func() {
+		_, err := x.Exec("DELETE FROM probe_session")
+		So(err, ShouldBeNil)
+		live := m.ProbeSession{OrgId: 1, ProbeId: p.Id, SocketId: "sid1", Version: "1.0.0", InstanceId: "default", RemoteIp: "127.0.0.1"}
+		stale := m.ProbeSession{OrgId: 1, ProbeId: p.Id, SocketId: "sid2", Version: "1.0.0", InstanceId: "crashed", RemoteIp: "127.0.0.1"}
+		So(AddProbeSession(&live), ShouldBeNil)
+		So(AddProbeSession(&stale), ShouldBeNil)
+		stale.Updated = time.Now().Add(-time.Hour)
+		So(UpdateProbeSession(&stale), ShouldBeNil)
+
+		sweep, err := SweepProbeSessions(time.Now().Add(-time.Minute))
+		So(err, ShouldBeNil)
+		So(sweep.SessionsRemoved, ShouldEqual, 1)
+		sessions, err := GetProbeSessions(p.Id, "", time.Time{})
+		So(err, ShouldBeNil)
+		So(len(sessions), ShouldEqual, 1)
+		So(sessions[0].SocketId, ShouldEqual, "sid1")
+
+		Convey("the probe should stay online while it has sessions", func() {
+			probe, err := GetProbeById(p.Id, p.OrgId)
+			So(err, ShouldBeNil)
+			So(probe.Online, ShouldBeTrue)
+		})
+		Convey("probes marked offline with sessions should be marked online", func() {
+			_, err := x.Exec("UPDATE probe SET online=0 WHERE id=?", p.Id)
+			So(err, ShouldBeNil)
+			sweep, err := SweepProbeSessions(time.Now().Add(-time.Minute))
+			So(err, ShouldBeNil)
+			So(sweep.ProbesMarkedOnline, ShouldEqual, 1)
+
+			Convey("a probe updated event should be published", func() {
+				timeout := time.After(time.Second * 5)
+				var current *m.ProbeDTO
+			WAIT:
+				for current == nil {
+					select {
+					case e := <-updates:
+						event := events.ProbeUpdated{}
+						So(json.Unmarshal(e.Body, &event.Payload), ShouldBeNil)
+						if event.Payload.Current.Online {
+							current = event.Payload.Current
+							So(event.Payload.Last.Online, ShouldBeFalse)
+						}
+					case <-timeout:
+						break WAIT
+					}
+				}
+				So(current, ShouldNotBeNil)
+				So(current.Id, ShouldEqual, p.Id)
+			})
+		})
+		Convey("removing the last session should mark the probe offline", func() {
+			sweep, err := SweepProbeSessions(time.Now().Add(time.Minute))
+			So(err, ShouldBeNil)
+			So(sweep.SessionsRemoved, ShouldEqual, 1)
+			probe, err := GetProbeById(p.Id, p.OrgId)
+			So(err, ShouldBeNil)
+			So(probe.Online, ShouldBeFalse)
+
+			Convey("probes marked online without sessions should be marked offline", func() {
+				_, err := x.Exec("UPDATE probe SET online=1 WHERE id=?", p.Id)
+				So(err, ShouldBeNil)
+				sweep, err := SweepProbeSessions(time.Now().Add(-time.Minute))
+				So(err, ShouldBeNil)
+				So(sweep.SessionsRemoved, ShouldEqual, 0)
+				So(sweep.ProbesMarkedOffline, ShouldEqual, 1)
+				probe, err := GetProbeById(p.Id, p.OrgId)
+				So(err, ShouldBeNil)
+				So(probe.Online, ShouldBeFalse)
+			})
+		})
+	})
+}
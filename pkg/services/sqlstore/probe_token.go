@@ -0,0 +1,139 @@
+package sqlstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+// AddProbeToken creates a new registration token for the probe. The returned
+// DTO is the only place the token itself is available.
+func AddProbeToken(probeId int64, orgId int64, name string) (*m.ProbeTokenDTO, error) {
+	sess, err := newSession(true, "probe")
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Cleanup()
+	dto, err := addProbeToken(sess, probeId, orgId, name)
+	if err != nil {
+		return nil, err
+	}
+	sess.Complete()
+	return dto, nil
+}
+
+func addProbeToken(sess *session, probeId int64, orgId int64, name string) (*m.ProbeTokenDTO, error) {
+	probe, err := getProbeById(sess, probeId, orgId)
+	if err != nil {
+		return nil, err
+	}
+	if probe.OrgId != orgId {
+		return nil, m.ErrProbeNotFound
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	secret := m.ProbeTokenPrefix + hex.EncodeToString(b)
+	token := &m.ProbeToken{
+		OrgId:   orgId,
+		ProbeId: probeId,
+		Name:    name,
+		Hash:    m.HashProbeToken(secret),
+		Created: time.Now(),
+	}
+	sess.Table("probe_token")
+	if _, err := sess.Insert(token); err != nil {
+		return nil, err
+	}
+	dto := token.ToDTO()
+	dto.Token = secret
+	return dto, nil
+}
+
+func GetProbeTokens(probeId int64, orgId int64) ([]*m.ProbeTokenDTO, error) {
+	sess, err := newSession(false, "probe_token")
+	if err != nil {
+		return nil, err
+	}
+	return getProbeTokens(sess, probeId, orgId)
+}
+
+func getProbeTokens(sess *session, probeId int64, orgId int64) ([]*m.ProbeTokenDTO, error) {
+	tokens := make([]m.ProbeToken, 0)
+	sess.Where("probe_id=? AND org_id=?", probeId, orgId).Asc("id")
+	if err := sess.Find(&tokens); err != nil {
+		return nil, err
+	}
+	result := make([]*m.ProbeTokenDTO, len(tokens))
+	for i := range tokens {
+		result[i] = tokens[i].ToDTO()
+	}
+	return result, nil
+}
+
+// GetProbeTokenByToken returns the token matching the secret provided by a
+// probe and records that it was used.
+func GetProbeTokenByToken(secret string) (*m.ProbeToken, error) {
+	sess, err := newSession(true, "probe_token")
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Cleanup()
+	token, err := getProbeTokenByToken(sess, secret)
+	if err != nil {
+		return nil, err
+	}
+	sess.Complete()
+	return token, nil
+}
+
+func getProbeTokenByToken(sess *session, secret string) (*m.ProbeToken, error) {
+	token := &m.ProbeToken{}
+	has, err := sess.Where("hash=?", m.HashProbeToken(secret)).Get(token)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, m.ErrProbeTokenNotFound
+	}
+	token.LastUsed = time.Now()
+	rawSql := "UPDATE probe_token SET last_used=? WHERE id=?"
+	if _, err := sess.Exec(rawSql, token.LastUsed, token.Id); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// DeleteProbeToken revokes a token so that it can no longer be used to connect.
+func DeleteProbeToken(probeId int64, orgId int64, id int64) error {
+	sess, err := newSession(true, "probe_token")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+	if err := deleteProbeToken(sess, probeId, orgId, id); err != nil {
+		return err
+	}
+	sess.Complete()
+	return nil
+}
+
+func deleteProbeToken(sess *session, probeId int64, orgId int64, id int64) error {
+	rawSql := "DELETE FROM probe_token WHERE id=? AND probe_id=? AND org_id=?"
+	res, err := sess.Exec(rawSql, id, probeId, orgId)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return m.ErrProbeTokenNotFound
+	}
+	return nil
+}
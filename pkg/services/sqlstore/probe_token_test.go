@@ -0,0 +1,67 @@
+package sqlstore
+
+import (
+	"strings"
+	"testing"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProbeTokens(t *testing.T) {
+	InitTestDB(t)
+	populateProbes(t)
+	token, err := AddProbeToken(1, 1, "host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Convey("When adding a probe token", t, func() {
+		So(token.Id, ShouldNotEqual, 0)
+		So(token.ProbeId, ShouldEqual, 1)
+		So(strings.HasPrefix(token.Token, m.ProbeTokenPrefix), ShouldBeTrue)
+
+		Convey("the token should authenticate the probe", func() {
+			found, err := GetProbeTokenByToken(token.Token)
+			So(err, ShouldBeNil)
+			So(found.Id, ShouldEqual, token.Id)
+			So(found.ProbeId, ShouldEqual, 1)
+			So(found.OrgId, ShouldEqual, 1)
+			So(found.Hash, ShouldNotEqual, token.Token)
+		})
+		Convey("listing tokens should not return the secret", func() {
+			unused, err := AddProbeToken(1, 1, "host2")
+			So(err, ShouldBeNil)
+			_, err = GetProbeTokenByToken(token.Token)
+			So(err, ShouldBeNil)
+
+			tokens, err := GetProbeTokens(1, 1)
+			So(err, ShouldBeNil)
+			So(len(tokens), ShouldEqual, 2)
+			byId := make(map[int64]*m.ProbeTokenDTO)
+			for _, tok := range tokens {
+				So(tok.Token, ShouldEqual, "")
+				byId[tok.Id] = tok
+			}
+			So(byId[token.Id], ShouldNotBeNil)
+			So(byId[token.Id].LastUsed.IsZero(), ShouldBeFalse)
+			So(byId[unused.Id], ShouldNotBeNil)
+			So(byId[unused.Id].LastUsed.IsZero(), ShouldBeTrue)
+		})
+		Convey("revoked tokens should not authenticate", func() {
+			err := DeleteProbeToken(1, 1, token.Id)
+			So(err, ShouldBeNil)
+			_, err = GetProbeTokenByToken(token.Token)
+			So(err, ShouldEqual, m.ErrProbeTokenNotFound)
+			err = DeleteProbeToken(1, 1, token.Id)
+			So(err, ShouldEqual, m.ErrProbeTokenNotFound)
+		})
+	})
+	Convey("When adding a token for a probe owned by another org", t, func() {
+		_, err := AddProbeToken(4, 1, "host1")
+		So(err, ShouldEqual, m.ErrProbeNotFound)
+	})
+	Convey("When authenticating with an unknown token", t, func() {
+		_, err := GetProbeTokenByToken(m.ProbeTokenPrefix + "unknown")
+		So(err, ShouldEqual, m.ErrProbeTokenNotFound)
+	})
+}
@@ -2,6 +2,7 @@ package setting
 
 import (
 	"net/url"
+	"time"
 
 	"github.com/raintank/worldping-api/pkg/log"
 )
@@ -17,8 +18,19 @@ type AlertingSettings struct {
 	EnableWorker         bool
 	Executors            int
 	GraphiteUrl          string
+	CatchUpMode          string
+	CatchUpLimit         time.Duration
+	SkipThreshold        time.Duration
+	OutboxClaimAge       time.Duration
 }
 
+// modes for handling alerting slots that the scheduler fell behind on.
+const (
+	CatchUpModeCatchUp = "catchup"
+	CatchUpModeSkip    = "skip"
+	CatchUpModeLatest  = "latest"
+)
+
 func readAlertingSettings() {
 	alerting := Cfg.Section("alerting")
 	Alerting.Enabled = alerting.Key("enabled").MustBool(false)
@@ -31,6 +43,11 @@ func readAlertingSettings() {
 	Alerting.EnableScheduler = alerting.Key("enable_scheduler").MustBool(true)
 	Alerting.EnableWorker = alerting.Key("enable_worker").MustBool(true)
 
+	Alerting.CatchUpMode = alerting.Key("catchup_mode").In(CatchUpModeCatchUp, []string{CatchUpModeCatchUp, CatchUpModeSkip, CatchUpModeLatest})
+	Alerting.CatchUpLimit = alerting.Key("catchup_limit").MustDuration(time.Minute * 10)
+	Alerting.SkipThreshold = alerting.Key("skip_threshold").MustDuration(time.Second * 30)
+	Alerting.OutboxClaimAge = alerting.Key("outbox_claim_age").MustDuration(time.Hour)
+
 	Alerting.GraphiteUrl = alerting.Key("graphite_url").MustString("http://localhost:8888/")
 	if Alerting.GraphiteUrl[len(Alerting.GraphiteUrl)-1] != '/' {
 		Alerting.GraphiteUrl += "/"
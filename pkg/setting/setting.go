@@ -91,6 +91,17 @@ var (
 
 	Alerting AlertingSettings
 
+	ProbeAlerting ProbeAlertingSettings
+
+	ProbeVersions ProbeVersionSettings
+
+	GeoIP GeoIPSettings
+
+	ProbeResults  ProbeResultsSettings
+	ProbeHealth   ProbeHealthSettings
+	ProbeShutdown ProbeShutdownSettings
+	ProbeSessions ProbeSessionsSettings
+
 	// SMTP email settings
 	Smtp SmtpSettings
 
@@ -377,6 +388,13 @@ func NewConfigContext(args *CommandLineArgs) error {
 
 	readKafkaSettings()
 	readAlertingSettings()
+	readProbeAlertingSettings()
+	readProbeVersionSettings()
+	readGeoIPSettings()
+	readProbeResultsSettings()
+	readProbeHealthSettings()
+	readProbeShutdownSettings()
+	readProbeSessionsSettings()
 	readSmtpSettings()
 	readQuotaSettings()
 	return nil
@@ -0,0 +1,24 @@
+package setting
+
+import "time"
+
+type GeoIPSettings struct {
+	// path to a local City mmdb file. When empty the database is downloaded.
+	CityDbPath string
+	// optional path to a local ASN mmdb file.
+	AsnDbPath string
+	// url the City database is downloaded from when no local file is used.
+	DownloadUrl    string
+	UpdateInterval time.Duration
+	// how long to wait before retrying a failed download.
+	RetryInterval time.Duration
+}
+
+func readGeoIPSettings() {
+	sec := Cfg.Section("geoip")
+	GeoIP.CityDbPath = sec.Key("city_db_path").String()
+	GeoIP.AsnDbPath = sec.Key("asn_db_path").String()
+	GeoIP.DownloadUrl = sec.Key("download_url").MustString("http://geolite.maxmind.com/download/geoip/database/GeoLite2-City.mmdb.gz")
+	GeoIP.UpdateInterval = sec.Key("update_interval").MustDuration(time.Hour * 6)
+	GeoIP.RetryInterval = sec.Key("retry_interval").MustDuration(time.Hour)
+}
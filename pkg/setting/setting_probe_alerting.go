@@ -0,0 +1,16 @@
+package setting
+
+import "time"
+
+type ProbeAlertingSettings struct {
+	Enabled     bool
+	Interval    time.Duration
+	GracePeriod time.Duration
+}
+
+func readProbeAlertingSettings() {
+	sec := Cfg.Section("probe_alerting")
+	ProbeAlerting.Enabled = sec.Key("enabled").MustBool(true)
+	ProbeAlerting.Interval = sec.Key("interval").MustDuration(time.Second * 30)
+	ProbeAlerting.GracePeriod = sec.Key("grace_period").MustDuration(time.Minute * 5)
+}
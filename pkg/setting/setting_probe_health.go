@@ -0,0 +1,25 @@
+package setting
+
+import "time"
+
+type ProbeHealthSettings struct {
+	// probe sessions are degraded while the health they report exceeds any
+	// of these thresholds. A threshold of 0 is not checked.
+	MaxCheckLag     time.Duration
+	MaxQueueDepth   int64
+	MaxCpu          float64
+	MaxMemory       int64
+	MaxFailedChecks int64
+	// owners are notified once a probe has been degraded for this long.
+	GracePeriod time.Duration
+}
+
+func readProbeHealthSettings() {
+	sec := Cfg.Section("probe_health")
+	ProbeHealth.MaxCheckLag = sec.Key("max_check_lag").MustDuration(time.Second * 30)
+	ProbeHealth.MaxQueueDepth = sec.Key("max_queue_depth").MustInt64(1000)
+	ProbeHealth.MaxCpu = sec.Key("max_cpu").MustFloat64(90)
+	ProbeHealth.MaxMemory = sec.Key("max_memory_mb").MustInt64(1024) * 1024 * 1024
+	ProbeHealth.MaxFailedChecks = sec.Key("max_failed_checks").MustInt64(0)
+	ProbeHealth.GracePeriod = sec.Key("grace_period").MustDuration(time.Minute * 5)
+}
@@ -0,0 +1,30 @@
+package setting
+
+import "time"
+
+type ProbeResultsSettings struct {
+	// number of result batches buffered before they are published.
+	QueueSize int
+	// number of goroutines publishing result batches.
+	Publishers int
+	// how long results that are not acked wait for space in the queue before
+	// they are dropped.
+	QueueTimeout time.Duration
+	// results with timestamps older than MaxAge or more than MaxFuture ahead
+	// of the server clock are rejected.
+	MaxAge    time.Duration
+	MaxFuture time.Duration
+	// maximum number of metrics accepted per second from each probe session.
+	// 0 disables the limit.
+	RateLimit int
+}
+
+func readProbeResultsSettings() {
+	sec := Cfg.Section("probe_results")
+	ProbeResults.QueueSize = sec.Key("queue_size").MustInt(1000)
+	ProbeResults.Publishers = sec.Key("publishers").MustInt(4)
+	ProbeResults.QueueTimeout = sec.Key("queue_timeout").MustDuration(time.Second * 5)
+	ProbeResults.MaxAge = sec.Key("max_age").MustDuration(time.Hour)
+	ProbeResults.MaxFuture = sec.Key("max_future").MustDuration(time.Minute)
+	ProbeResults.RateLimit = sec.Key("rate_limit").MustInt(1000)
+}
@@ -0,0 +1,17 @@
+package setting
+
+import "time"
+
+type ProbeSessionsSettings struct {
+	SweepEnabled  bool
+	SweepInterval time.Duration
+	// sessions that have not sent a heartbeat for this long are removed.
+	StaleAfter time.Duration
+}
+
+func readProbeSessionsSettings() {
+	sec := Cfg.Section("probe_sessions")
+	ProbeSessions.SweepEnabled = sec.Key("sweep_enabled").MustBool(true)
+	ProbeSessions.SweepInterval = sec.Key("sweep_interval").MustDuration(time.Minute)
+	ProbeSessions.StaleAfter = sec.Key("stale_after").MustDuration(time.Minute * 2)
+}
@@ -0,0 +1,29 @@
+package setting
+
+import (
+	"strings"
+	"time"
+)
+
+type ProbeShutdownSettings struct {
+	// how long probes are given to reconnect to another instance before
+	// their sessions are removed.
+	Deadline time.Duration
+	// probes wait a random time up to MaxBackoff before reconnecting.
+	MaxBackoff time.Duration
+	// urls of other instances probes are asked to reconnect to.
+	Peers []string
+}
+
+func readProbeShutdownSettings() {
+	sec := Cfg.Section("probe_shutdown")
+	ProbeShutdown.Deadline = sec.Key("deadline").MustDuration(time.Second * 30)
+	ProbeShutdown.MaxBackoff = sec.Key("max_backoff").MustDuration(time.Second * 10)
+	ProbeShutdown.Peers = make([]string, 0)
+	for _, peer := range strings.Split(sec.Key("peers").String(), ",") {
+		peer = strings.TrimSpace(peer)
+		if peer != "" {
+			ProbeShutdown.Peers = append(ProbeShutdown.Peers, peer)
+		}
+	}
+}
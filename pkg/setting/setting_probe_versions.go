@@ -0,0 +1,26 @@
+package setting
+
+// ProbeVersionSettings control which probe versions can connect and which
+// features are used when talking to them.
+type ProbeVersionSettings struct {
+	// probes older than this are refused.
+	MinVersion string
+	// version constraint, eg. "< 0.9.1". Matching probes are warned when they connect.
+	Deprecated string
+	// minimum probe version for each feature.
+	Features map[string]string
+}
+
+func readProbeVersionSettings() {
+	sec := Cfg.Section("probe_versions")
+	ProbeVersions.MinVersion = sec.Key("min_version").MustString("0.1.4")
+	ProbeVersions.Deprecated = sec.Key("deprecated").String()
+
+	ProbeVersions.Features = map[string]string{
+		"check_payload": "0.9.1",
+		"reconnect":     "1.0.0",
+	}
+	for _, key := range Cfg.Section("probe_features").Keys() {
+		ProbeVersions.Features[key.Name()] = key.String()
+	}
+}